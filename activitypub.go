@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/placetime/datastore"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each feed driven profile is published as an ActivityPub actor at
+// {api baseurl}/ap/{pid}. Remote users follow the actor through its inbox and
+// are sent a Create activity for every new item ingested for the profile.
+
+const (
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	activityStreamsPublic  = "https://www.w3.org/ns/activitystreams#Public"
+	activityContentType    = "application/activity+json"
+	outboxLimit            = 20
+)
+
+var (
+	apKey       *rsa.PrivateKey
+	apFollowers = &FollowerStore{}
+
+	// Actor documents and inboxes are wherever remote servers say, so they
+	// are fetched through the same address checks as feeds. Set up with
+	// the fetch client.
+	apClient = &http.Client{Timeout: 15 * time.Second}
+)
+
+func activityPubEnabled() bool {
+	return config.ActivityPub.Enabled
+}
+
+// Load the signing key and follower lists, creating them if this is the
+// first run
+func initActivityPub() {
+	if err := os.MkdirAll(config.ActivityPub.Path, 0755); err != nil {
+		log.Printf("Could not create activitypub path %s: %s", config.ActivityPub.Path, err.Error())
+		os.Exit(1)
+	}
+
+	key, err := loadOrCreateKey(filepath.Join(config.ActivityPub.Path, "key.pem"))
+	if err != nil {
+		log.Printf("Could not load activitypub key: %s", err.Error())
+		os.Exit(1)
+	}
+	apKey = key
+
+	apFollowers.filename = filepath.Join(config.ActivityPub.Path, "followers.json")
+	if err := apFollowers.Load(); err != nil {
+		log.Printf("Could not load activitypub followers: %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+func loadOrCreateKey(filename string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM data found in " + filename)
+		}
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("Generating activitypub key %s", filename)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// FollowerStore records the inbox of each remote actor following a profile
+type FollowerStore struct {
+	mu        sync.Mutex
+	filename  string
+	followers map[datastore.PidType]map[string]string
+}
+
+func (fs *FollowerStore) Load() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.followers = make(map[datastore.PidType]map[string]string)
+	data, err := ioutil.ReadFile(fs.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &fs.followers)
+}
+
+func (fs *FollowerStore) save() error {
+	data, err := json.Marshal(fs.followers)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fs.filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fs.filename+".tmp", fs.filename)
+}
+
+func (fs *FollowerStore) Add(pid datastore.PidType, actor string, inbox string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.followers[pid] == nil {
+		fs.followers[pid] = make(map[string]string)
+	}
+	fs.followers[pid][actor] = inbox
+	return fs.save()
+}
+
+func (fs *FollowerStore) Remove(pid datastore.PidType, actor string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.followers[pid], actor)
+	return fs.save()
+}
+
+// Return the distinct inboxes of the followers of a profile
+func (fs *FollowerStore) Inboxes(pid datastore.PidType) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	seen := make(map[string]bool)
+	inboxes := make([]string, 0, len(fs.followers[pid]))
+	for _, inbox := range fs.followers[pid] {
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	return inboxes
+}
+
+func (fs *FollowerStore) Count(pid datastore.PidType) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return len(fs.followers[pid])
+}
+
+func actorUrl(pid datastore.PidType) string {
+	return apiUrl("/ap/" + url.PathEscape(string(pid)))
+}
+
+func registerActivityPub(mux *http.ServeMux) {
+	mux.HandleFunc("/.well-known/webfinger", handleWebfinger)
+	mux.HandleFunc("/ap/", handleActivityPub)
+}
+
+func isFeedProfile(pid datastore.PidType) bool {
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	profiles, err := s.FeedDrivenProfiles()
+	if err != nil {
+		return false
+	}
+	for _, p := range profiles {
+		if p.Pid == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func handleWebfinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	acct := strings.TrimPrefix(resource, "acct:")
+	parts := strings.SplitN(acct, "@", 2)
+	if len(parts) != 2 || parts[1] != config.ActivityPub.Domain || !isFeedProfile(datastore.PidType(parts[0])) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subject": resource,
+		"links": []map[string]string{
+			{"rel": "self", "type": activityContentType, "href": actorUrl(datastore.PidType(parts[0]))},
+		},
+	})
+}
+
+// Dispatch /ap/{pid}, /ap/{pid}/outbox, /ap/{pid}/inbox and /ap/{pid}/followers
+func handleActivityPub(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ap/"), "/")
+	pid := datastore.PidType(parts[0])
+	if pid == "" || !isFeedProfile(pid) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		writeActivity(w, actorDocument(pid))
+	case len(parts) == 2 && parts[1] == "outbox":
+		writeActivity(w, outboxDocument(pid))
+	case len(parts) == 2 && parts[1] == "followers":
+		writeActivity(w, map[string]interface{}{
+			"@context":   activityStreamsContext,
+			"id":         actorUrl(pid) + "/followers",
+			"type":       "OrderedCollection",
+			"totalItems": apFollowers.Count(pid),
+		})
+	case len(parts) == 2 && parts[1] == "inbox" && r.Method == "POST":
+		handleInbox(w, r, pid)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeActivity(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", activityContentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("ActivityPub failed to write response: %s", err.Error())
+	}
+}
+
+func actorDocument(pid datastore.PidType) map[string]interface{} {
+	id := actorUrl(pid)
+	pubKey, _ := x509.MarshalPKIXPublicKey(&apKey.PublicKey)
+
+	return map[string]interface{}{
+		"@context":          []string{activityStreamsContext, "https://w3id.org/security/v1"},
+		"id":                id,
+		"type":              "Service",
+		"preferredUsername": string(pid),
+		"name":              string(pid),
+		"inbox":             id + "/inbox",
+		"outbox":            id + "/outbox",
+		"followers":         id + "/followers",
+		"publicKey": map[string]string{
+			"id":           id + "#main-key",
+			"owner":        id,
+			"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey})),
+		},
+	}
+}
+
+func outboxDocument(pid datastore.PidType) map[string]interface{} {
+	items, err := readItemMetas(itemIndex.Query(&ItemQuery{Pid: pid}, 0, outboxLimit))
+	if err != nil {
+		log.Printf("ActivityPub failed to read item metadata: %s", err.Error())
+	}
+
+	activities := make([]map[string]interface{}, 0, len(items))
+	for _, meta := range items {
+		activities = append(activities, createActivity(meta))
+	}
+
+	return map[string]interface{}{
+		"@context":     activityStreamsContext,
+		"id":           actorUrl(pid) + "/outbox",
+		"type":         "OrderedCollection",
+		"totalItems":   len(activities),
+		"orderedItems": activities,
+	}
+}
+
+func createActivity(meta *ItemMeta) map[string]interface{} {
+	actor := actorUrl(meta.Pid)
+	noteId := actor + "/items/" + string(meta.Id)
+	published := time.Unix(meta.Added, 0).UTC().Format(time.RFC3339)
+
+	note := map[string]interface{}{
+		"id":           noteId,
+		"type":         "Note",
+		"attributedTo": actor,
+		"content":      fmt.Sprintf(`<p><a href="%s">%s</a></p>`, htmlEscape(meta.Link), htmlEscape(meta.Title)),
+		"url":          meta.Link,
+		"published":    published,
+		"to":           []string{activityStreamsPublic},
+		"cc":           []string{actor + "/followers"},
+	}
+	if meta.Image != "" {
+		note["attachment"] = []map[string]string{{"type": "Image", "url": meta.Image}}
+	}
+
+	return map[string]interface{}{
+		"@context":  activityStreamsContext,
+		"id":        noteId + "/activity",
+		"type":      "Create",
+		"actor":     actor,
+		"published": published,
+		"to":        note["to"],
+		"cc":        note["cc"],
+		"object":    note,
+	}
+}
+
+func htmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(s)
+}
+
+// An incoming activity, only the fields needed for follow handling
+type InboxActivity struct {
+	Id     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+func handleInbox(w http.ResponseWriter, r *http.Request, pid datastore.PidType) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "could not read activity", http.StatusBadRequest)
+		return
+	}
+	var activity InboxActivity
+	if err := json.Unmarshal(body, &activity); err != nil {
+		http.Error(w, "invalid activity", http.StatusBadRequest)
+		return
+	}
+
+	// Nothing is done for an activity its actor has not signed. The key is
+	// the one published in the actor's own document, which is also where
+	// the follower's inbox is taken from rather than anything in the
+	// request, so deliveries only go where the remote actor says they
+	// should.
+	actor, err := fetchActor(activity.Actor)
+	if err != nil {
+		log.Printf("ActivityPub could not resolve actor %s: %s", activity.Actor, err.Error())
+		http.Error(w, "could not resolve actor", http.StatusBadRequest)
+		return
+	}
+	if err := verifySignature(r, body, actor); err != nil {
+		log.Printf("ActivityPub rejected unsigned activity from %s: %s", activity.Actor, err.Error())
+		countMetric("activitypub.rejected", 1)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		if err := apFollowers.Add(pid, actor.Id, actor.Inbox); err != nil {
+			log.Printf("ActivityPub failed to record follower %s: %s", actor.Id, err.Error())
+			http.Error(w, "could not record follower", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("ActivityPub %s is now followed by %s", pid, actor.Id)
+
+		accept := map[string]interface{}{
+			"@context": activityStreamsContext,
+			"id":       fmt.Sprintf("%s#accepts/%d", actorUrl(pid), time.Now().UnixNano()),
+			"type":     "Accept",
+			"actor":    actorUrl(pid),
+			"object":   activity,
+		}
+		go deliverActivity(pid, actor.Inbox, accept)
+
+	case "Undo":
+		// Only the actor that made a Follow can undo it
+		var inner InboxActivity
+		if err := json.Unmarshal(activity.Object, &inner); err == nil && inner.Type == "Follow" {
+			if inner.Actor != actor.Id {
+				log.Printf("ActivityPub rejected undo by %s of a follow by %s", actor.Id, inner.Actor)
+				http.Error(w, "not the follower", http.StatusForbidden)
+				return
+			}
+			if err := apFollowers.Remove(pid, actor.Id); err != nil {
+				log.Printf("ActivityPub failed to remove follower %s: %s", actor.Id, err.Error())
+			}
+			log.Printf("ActivityPub %s is no longer followed by %s", pid, actor.Id)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// The parts of a remote actor's document needed to verify its activities
+// and deliver to it
+type RemoteActor struct {
+	Id        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	PublicKey struct {
+		Id           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+func fetchActor(actor string) (*RemoteActor, error) {
+	u, err := url.Parse(actor)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, errors.New("invalid actor id")
+	}
+
+	req, err := http.NewRequest("GET", actor, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activityContentType)
+
+	resp, err := apClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(resp.Status)
+	}
+
+	var doc RemoteActor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Id != actor {
+		return nil, errors.New("actor document is for " + doc.Id)
+	}
+	if doc.Inbox == "" {
+		return nil, errors.New("actor has no inbox")
+	}
+	if iu, err := url.Parse(doc.Inbox); err != nil || (iu.Scheme != "https" && iu.Scheme != "http") {
+		return nil, errors.New("invalid actor inbox")
+	}
+	return &doc, nil
+}
+
+// Signatures dated further than this from now are refused, so a captured
+// request cannot be replayed later
+const maxSignatureSkew = 12 * time.Hour
+
+var signatureParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Check an HTTP signature (draft-cavage-http-signatures) made with the
+// actor's published key, covering at least the request target, host, date
+// and a digest of the body
+func verifySignature(r *http.Request, body []byte, actor *RemoteActor) error {
+	params := make(map[string]string)
+	for _, m := range signatureParam.FindAllStringSubmatch(r.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+	if params["signature"] == "" {
+		return errors.New("no signature")
+	}
+	if params["keyId"] != actor.PublicKey.Id || (actor.PublicKey.Owner != "" && actor.PublicKey.Owner != actor.Id) {
+		return fmt.Errorf("key %s is not the actor's", params["keyId"])
+	}
+	switch strings.ToLower(params["algorithm"]) {
+	case "", "rsa-sha256", "hs2019":
+	default:
+		return fmt.Errorf("unsupported algorithm %s", params["algorithm"])
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	covered := make(map[string]bool)
+	for _, h := range headers {
+		covered[h] = true
+	}
+	for _, h := range []string{"(request-target)", "host", "date", "digest"} {
+		if !covered[h] {
+			return fmt.Errorf("signature does not cover %s", h)
+		}
+	}
+
+	digest := sha256.Sum256(body)
+	if r.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		return errors.New("digest does not match body")
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return errors.New("invalid date")
+	}
+	if d := time.Since(date); d > maxSignatureSkew || d < -maxSignatureSkew {
+		return errors.New("date is too far from now")
+	}
+
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, h+": "+strings.ToLower(r.Method)+" "+r.URL.RequestURI())
+		case "host":
+			lines = append(lines, h+": "+r.Host)
+		default:
+			lines = append(lines, h+": "+r.Header.Get(h))
+		}
+	}
+
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return errors.New("actor has no public key")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("actor key is not an RSA key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig)
+}
+
+// Send a Create activity for a newly ingested item to every follower
+func publishItem(meta *ItemMeta) {
+	if !activityPubEnabled() {
+		return
+	}
+
+	activity := createActivity(meta)
+	for _, inbox := range apFollowers.Inboxes(meta.Pid) {
+		deliverActivity(meta.Pid, inbox, activity)
+	}
+}
+
+// Announce many items to followers with one note listing the first few
+func publishBatch(pid datastore.PidType, metas []*ItemMeta) {
+	if !activityPubEnabled() || len(metas) == 0 {
+		return
+	}
+
+	activity := createBatchActivity(pid, metas)
+	for _, inbox := range apFollowers.Inboxes(pid) {
+		deliverActivity(pid, inbox, activity)
+	}
+}
+
+func createBatchActivity(pid datastore.PidType, metas []*ItemMeta) map[string]interface{} {
+	actor := actorUrl(pid)
+	now := time.Now()
+	noteId := fmt.Sprintf("%s/batches/%d", actor, now.UnixNano())
+	published := now.UTC().Format(time.RFC3339)
+
+	content := "<p>" + batchTitle(len(metas)) + "</p><ul>"
+	for i, meta := range metas {
+		if i == maxBatchNoteItems {
+			break
+		}
+		content += fmt.Sprintf(`<li><a href="%s">%s</a></li>`, htmlEscape(meta.Link), htmlEscape(meta.Title))
+	}
+	content += "</ul>"
+
+	note := map[string]interface{}{
+		"id":           noteId,
+		"type":         "Note",
+		"attributedTo": actor,
+		"content":      content,
+		"published":    published,
+		"to":           []string{activityStreamsPublic},
+		"cc":           []string{actor + "/followers"},
+	}
+
+	return map[string]interface{}{
+		"@context":  activityStreamsContext,
+		"id":        noteId + "/activity",
+		"type":      "Create",
+		"actor":     actor,
+		"published": published,
+		"to":        note["to"],
+		"cc":        note["cc"],
+		"object":    note,
+	}
+}
+
+func deliverActivity(pid datastore.PidType, inbox string, activity interface{}) {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		log.Printf("ActivityPub failed to encode activity: %s", err.Error())
+		return
+	}
+
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("ActivityPub failed to create delivery to %s: %s", inbox, err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", activityContentType)
+
+	if err := signRequest(req, body, actorUrl(pid)+"#main-key"); err != nil {
+		log.Printf("ActivityPub failed to sign delivery to %s: %s", inbox, err.Error())
+		return
+	}
+
+	resp, err := apClient.Do(req)
+	if err != nil {
+		log.Printf("ActivityPub failed to deliver to %s: %s", inbox, err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("ActivityPub delivery to %s rejected: %s", inbox, resp.Status)
+	}
+}
+
+// Add an HTTP signature (draft-cavage-http-signatures) covering the request
+// target, host, date and body digest
+func signRequest(req *http.Request, body []byte, keyId string) error {
+	digest := sha256.Sum256(body)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	req.Header.Set("Host", req.URL.Host)
+
+	signed := fmt.Sprintf("(request-target): %s %s\nhost: %s\ndate: %s\ndigest: %s",
+		strings.ToLower(req.Method), req.URL.RequestURI(), req.URL.Host, req.Header.Get("Date"), req.Header.Get("Digest"))
+
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, apKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="(request-target) host date digest",signature="%s"`,
+		keyId, base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The query API must be public when it serves ActivityPub or WebSub, so
+// the requests that change the fetcher's state, such as pausing a profile,
+// are only accepted from an operator. That is either a request carrying
+// the configured admin token as a bearer token, or any request to the
+// admin listener, which serves the same API on a loopback address. With
+// neither configured such requests are refused.
+
+type adminKey struct{}
+
+// Marks requests arriving on the admin listener
+type adminHandler struct {
+	handler http.Handler
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminKey{}, true)))
+}
+
+func serveAdminApi(addr string, handler http.Handler) {
+	log.Printf("Serving admin API on %s", addr)
+	if err := http.ListenAndServe(addr, adminHandler{handler}); err != nil {
+		log.Printf("Admin API stopped: %s", err.Error())
+	}
+}
+
+// Whether a request may change state, writing the refusal if not
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if admin, _ := r.Context().Value(adminKey{}).(bool); admin {
+		return true
+	}
+
+	token := config.Api.AdminToken
+	if token == "" {
+		http.Error(w, "admin requests are not enabled", http.StatusForbidden)
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="placetime-fetcher"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		countMetric("api.unauthorized", 1)
+		return false
+	}
+	return true
+}
+
+// The admin listener serves without authentication so must not be
+// reachable from elsewhere
+func checkAdminListen(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("admin listen address %s is not a loopback address", addr)
+}
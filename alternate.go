@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Article pages often advertise lighter representations of themselves, an
+// AMP version or a printer friendly one, which carry the same feature
+// image with far less markup and fewer scripts in the way. When enabled,
+// images are picked from such a variant first.
+var (
+	linkTagPattern  = regexp.MustCompile(`(?is)<link\s[^>]*>`)
+	linkAttrPattern = regexp.MustCompile(`(?is)(rel|href|media|type|title)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+)
+
+// The rel, href, media, type and title attributes of each link element in some markup
+func linkTags(page []byte) []map[string]string {
+	var tags []map[string]string
+	for _, tag := range linkTagPattern.FindAll(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range linkAttrPattern.FindAllSubmatch(tag, -1) {
+			attrs[strings.ToLower(string(m[1]))] = strings.Trim(string(m[2]), `"'`)
+		}
+		tags = append(tags, attrs)
+	}
+	return tags
+}
+
+// Find the url of a lighter variant of a page in the start of its markup,
+// preferring AMP, resolved against the page's url
+func alternatePage(page []byte, base string) string {
+	var amp, print string
+	for _, attrs := range linkTags(page) {
+		rel := strings.ToLower(attrs["rel"])
+		switch {
+		case rel == "amphtml" && amp == "":
+			amp = attrs["href"]
+		case rel == "alternate" && strings.ToLower(attrs["media"]) == "print" && print == "":
+			print = attrs["href"]
+		}
+	}
+
+	return resolveHref(firstNonEmpty(amp, print), base)
+}
+
+// Resolve a link found in a page against the page's url, accepting only
+// http and https targets
+func resolveHref(href string, base string) string {
+	if href == "" {
+		return ""
+	}
+
+	bu, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	u, err := bu.Parse(href)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
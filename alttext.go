@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Alt text for a picked image is taken from the page it was picked from:
+// the og:image:alt or twitter:image:alt the page declares for its feature
+// image, or else the alt attribute of an img element showing the image.
+// When the page has none and a captioning service is configured, the
+// service is asked to describe the image.
+type CaptionConfig struct {
+	Url     string `toml:"url"`
+	Timeout int    `toml:"timeout"`
+}
+
+type CaptionRequest struct {
+	Image string `json:"image"`
+	Title string `json:"title,omitempty"`
+}
+
+type Caption struct {
+	Caption string `json:"caption"`
+}
+
+var (
+	metaTagPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	imgTagPattern   = regexp.MustCompile(`(?is)<img\s[^>]*>`)
+	tagAttrPattern  = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	maxAltTextRunes = 500
+)
+
+func tagAttrs(tag []byte) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range tagAttrPattern.FindAllSubmatch(tag, -1) {
+		attrs[strings.ToLower(string(m[1]))] = html.UnescapeString(strings.Trim(string(m[2]), `"'`))
+	}
+	return attrs
+}
+
+// Find alt text for an image in the start of the markup of the page it was
+// picked from
+func pageAltText(page []byte, image string, base string) string {
+	var declared string
+	for _, tag := range metaTagPattern.FindAll(page, -1) {
+		attrs := tagAttrs(tag)
+		switch strings.ToLower(firstNonEmpty(attrs["property"], attrs["name"])) {
+		case "og:image:alt", "twitter:image:alt":
+			if declared == "" {
+				declared = attrs["content"]
+			}
+		}
+	}
+
+	for _, tag := range imgTagPattern.FindAll(page, -1) {
+		attrs := tagAttrs(tag)
+		if attrs["alt"] != "" && resolveHref(attrs["src"], base) == image {
+			return cleanAltText(attrs["alt"])
+		}
+	}
+	return cleanAltText(declared)
+}
+
+// Alt text for a picked image, from the page or failing that the
+// captioning service
+func imageAltText(ls *LinkStatus, image string, title string) string {
+	if ls != nil {
+		if alt := pageAltText(ls.Peek, image, ls.FinalUrl); alt != "" {
+			return alt
+		}
+	}
+	if config.Image.Caption.Url == "" {
+		return ""
+	}
+
+	alt, err := captionImage(CaptionRequest{Image: image, Title: title})
+	if err != nil {
+		log.Printf("Image job failed to caption image %s: %s", image, err.Error())
+		countMetric("caption.errors", 1)
+		return ""
+	}
+	countMetric("caption.generated", 1)
+	return alt
+}
+
+func cleanAltText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > maxAltTextRunes {
+		s = string(r[:maxAltTextRunes])
+	}
+	return s
+}
+
+func captionImage(cr CaptionRequest) (string, error) {
+	data, err := json.Marshal(cr)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Image.Caption.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.Image.Caption.Url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// The captioning service is ours like the annotation service
+	resp, err := annotateClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("captioning service returned %s", resp.Status)
+	}
+
+	var c Caption
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&c); err != nil {
+		return "", err
+	}
+	return cleanAltText(c.Caption), nil
+}
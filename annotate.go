@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// An external annotation service is sent each new item before it is
+// stored and may reply with fields to merge into it. Any field it leaves
+// out is left as it was.
+type AnnotationRequest struct {
+	Pid       string    `json:"pid"`
+	Id        string    `json:"id"`
+	Title     string    `json:"title"`
+	Link      string    `json:"link"`
+	Image     string    `json:"image,omitempty"`
+	Published int64     `json:"published,omitempty"`
+	Location  *GeoPoint `json:"location,omitempty"`
+}
+
+type Annotation struct {
+	Tags     []string  `json:"tags"`
+	Score    *float64  `json:"score"`
+	Location *GeoPoint `json:"location"`
+	Place    string    `json:"place"`
+}
+
+// The annotation service is our own, so it is not held to the limits the
+// default client has for fetching from other sites
+var annotateClient = &http.Client{}
+
+func annotateItem(ar AnnotationRequest) (*Annotation, error) {
+	data, err := json.Marshal(ar)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Annotate.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.Annotate.Url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := annotateClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return &Annotation{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("annotation service returned %s", resp.Status)
+	}
+
+	var ann Annotation
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&ann); err != nil {
+		return nil, err
+	}
+	if p := ann.Location; p != nil && (p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180) {
+		ann.Location = nil
+	}
+	return &ann, nil
+}
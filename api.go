@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultApiLimit = 50
+	maxApiLimit     = 1000
+
+	// Kilometres searched around a point when no radius is given
+	defaultNearRadius = 5.0
+)
+
+// Serve a read only HTTP API over the items recorded by the fetcher:
+//
+//	GET /items?pid=&since=&until=&tag=&bbox=minlon,minlat,maxlon,maxlat&near=lat,lon&radius=&q=&limit=&offset=
+//	GET /items/{id}
+//	GET /feeds/{pid}.atom
+//	GET /breakers
+//	GET /deadletters
+//	POST /deadletters/{id}/redrive
+//	GET /paused
+//	POST /paused/{pid}?reason=
+//	DELETE /paused/{pid}
+//	GET /backlog
+//	GET /documents/{id}.png
+//	GET /stages
+func serveApi(addr string) {
+	itemIndex.Load()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items", handleItems)
+	mux.HandleFunc("/items/", handleItem)
+	mux.HandleFunc("/feeds/", handleAtomFeed)
+	mux.HandleFunc("/breakers", handleBreakers)
+	mux.HandleFunc("/deadletters", handleDeadLetters)
+	mux.HandleFunc("/deadletters/", handleDeadLetters)
+	mux.HandleFunc("/paused", handlePaused)
+	mux.HandleFunc("/paused/", handlePaused)
+	mux.HandleFunc("/backlog", handleBacklog)
+	mux.HandleFunc("/stages", handleStages)
+	if activityPubEnabled() {
+		registerActivityPub(mux)
+	}
+	if config.Document.Path != "" {
+		registerDocuments(mux)
+	}
+
+	if config.Api.AdminListen != "" {
+		go serveAdminApi(config.Api.AdminListen, mux)
+	}
+
+	log.Printf("Serving query API on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Query API stopped: %s", err.Error())
+	}
+}
+
+// Build the public url of a path served by the API
+func apiUrl(path string) string {
+	return strings.TrimRight(config.Api.BaseUrl, "/") + path
+}
+
+type ItemQuery struct {
+	Pid   datastore.PidType
+	Since int64
+	Until int64
+	Tag   string
+	Bbox  []float64
+	Text  string
+	Limit int
+
+	// How many of the newest matches to skip, for paging through them
+	Offset int
+
+	// Items within Radius kilometres of Near
+	Near   *GeoPoint
+	Radius float64
+}
+
+func parseItemQuery(r *http.Request) (*ItemQuery, error) {
+	v := r.URL.Query()
+	q := &ItemQuery{
+		Pid:   datastore.PidType(v.Get("pid")),
+		Tag:   v.Get("tag"),
+		Text:  v.Get("q"),
+		Limit: defaultApiLimit,
+	}
+
+	var err error
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid since: %s", s)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid until: %s", s)
+		}
+	}
+	if q.Text != "" && !searchEnabled() {
+		return nil, fmt.Errorf("search is not enabled")
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 {
+			return nil, fmt.Errorf("invalid limit: %s", s)
+		}
+		if q.Limit > maxApiLimit {
+			q.Limit = maxApiLimit
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return nil, fmt.Errorf("invalid offset: %s", s)
+		}
+	}
+	if s := v.Get("near"); s != "" {
+		parts := strings.Split(s, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid near: %s", s)
+		}
+		if q.Near = ingest.ParsePoint(parts[0], parts[1]); q.Near == nil {
+			return nil, fmt.Errorf("invalid near: %s", s)
+		}
+		if !searchEnabled() {
+			return nil, fmt.Errorf("search is not enabled")
+		}
+		q.Radius = defaultNearRadius
+		if s := v.Get("radius"); s != "" {
+			if q.Radius, err = strconv.ParseFloat(s, 64); err != nil || q.Radius <= 0 {
+				return nil, fmt.Errorf("invalid radius: %s", s)
+			}
+		}
+	}
+	if s := v.Get("bbox"); s != "" {
+		parts := strings.Split(s, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid bbox: %s", s)
+		}
+		for _, p := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bbox: %s", s)
+			}
+			q.Bbox = append(q.Bbox, f)
+		}
+	}
+
+	return q, nil
+}
+
+func (q *ItemQuery) Matches(meta *ItemMeta) bool {
+	if q.Pid != "" && meta.Pid != q.Pid {
+		return false
+	}
+	if q.Since != 0 && meta.Added < q.Since {
+		return false
+	}
+	if q.Until != 0 && meta.Added > q.Until {
+		return false
+	}
+	if q.Tag != "" && !hasTag(meta.Tags, q.Tag) {
+		return false
+	}
+	if q.Bbox != nil && !inBbox(meta.Location, q.Bbox) {
+		return false
+	}
+	if q.Near != nil && (meta.Location == nil || distanceKm(q.Near, meta.Location) > q.Radius) {
+		return false
+	}
+	return true
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleItems(w http.ResponseWriter, r *http.Request) {
+	q, err := parseItemQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var metas []*ItemMeta
+	offset := q.Offset
+	switch {
+	case q.Text != "":
+		metas, err = searchItemMeta(q.Text)
+	case q.Near != nil:
+		metas, err = nearbyItemMeta(q.Near, q.Radius)
+	default:
+		// Filtered and paged by the index, only the page is read
+		metas, err = readItemMetas(itemIndex.Query(q, q.Offset, q.Limit))
+		offset = 0
+	}
+	if err != nil {
+		log.Printf("Query API failed to read item metadata: %s", err.Error())
+		http.Error(w, "could not read items", http.StatusInternalServerError)
+		return
+	}
+
+	matches := make([]*ItemMeta, 0)
+	for _, meta := range metas {
+		if q.Matches(meta) {
+			matches = append(matches, meta)
+		}
+	}
+
+	// Newest first
+	sort.Sort(sort.Reverse(byAdded(matches)))
+	if offset >= len(matches) {
+		matches = matches[:0]
+	} else {
+		matches = matches[offset:]
+	}
+	if len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+
+	writeJson(w, matches)
+}
+
+// Metadata of the items matching a text query, read from the search index
+// rather than scanning every item
+func searchItemMeta(text string) ([]*ItemMeta, error) {
+	ids, err := searchItems(text, maxApiLimit)
+	if err != nil {
+		return nil, err
+	}
+	return readItemMetas(ids)
+}
+
+// Metadata of the items in the geohash buckets around a point
+func nearbyItemMeta(p *GeoPoint, radius float64) ([]*ItemMeta, error) {
+	ids, err := nearbyItems(p, radius, maxApiLimit)
+	if err != nil {
+		return nil, err
+	}
+	return readItemMetas(ids)
+}
+
+func readItemMetas(ids []datastore.ItemIdType) ([]*ItemMeta, error) {
+	metas := make([]*ItemMeta, 0, len(ids))
+	for _, id := range ids {
+		meta, err := readItemMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+func handleItem(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/items/")
+	if id == "" || strings.ContainsAny(id, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+
+	meta, err := readItemMeta(datastore.ItemIdType(id))
+	if err != nil {
+		log.Printf("Query API failed to read item %s: %s", id, err.Error())
+		http.Error(w, "could not read item", http.StatusInternalServerError)
+		return
+	}
+	if meta.Added == 0 && meta.Checked == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJson(w, meta)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Query API failed to write response: %s", err.Error())
+	}
+}
+
+type byAdded []*ItemMeta
+
+func (b byAdded) Len() int           { return len(b) }
+func (b byAdded) Less(i, j int) bool { return b[i].Added < b[j].Added }
+func (b byAdded) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
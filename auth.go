@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"github.com/placetime/datastore"
+	"net/http"
+	"net/url"
+)
+
+// Credentials for a private feed, either a username and password sent with
+// HTTP Basic authentication, a fixed bearer token or an OAuth2 client whose
+// tokens are obtained from TokenUrl with the client credentials grant.
+// They are never logged.
+type FeedAuthConfig struct {
+	Username     string   `toml:"username"`
+	Password     string   `toml:"password"`
+	Token        string   `toml:"token"`
+	TokenUrl     string   `toml:"tokenurl"`
+	ClientId     string   `toml:"clientid"`
+	ClientSecret string   `toml:"clientsecret"`
+	Scopes       []string `toml:"scopes"`
+}
+
+func (a FeedAuthConfig) validate() error {
+	kinds := 0
+	if a.Username != "" || a.Password != "" {
+		kinds++
+	}
+	if a.Token != "" {
+		kinds++
+	}
+	if a.TokenUrl != "" || a.ClientId != "" || a.ClientSecret != "" {
+		kinds++
+	}
+	if kinds > 1 {
+		return fmt.Errorf("give one of a username and password, a token or an oauth client")
+	}
+	if a.Password != "" && a.Username == "" {
+		return fmt.Errorf("password given without a username")
+	}
+	if (a.ClientId != "" || a.ClientSecret != "") && a.TokenUrl == "" {
+		return fmt.Errorf("oauth client given without a token url")
+	}
+	if a.TokenUrl != "" && a.ClientId == "" {
+		return fmt.Errorf("token url given without a client id")
+	}
+	return nil
+}
+
+func (a FeedAuthConfig) oauth() bool {
+	return a.TokenUrl != ""
+}
+
+// Keep secrets out of anything that prints the config
+func (a FeedAuthConfig) String() string {
+	switch {
+	case a.oauth():
+		return "oauth client " + a.ClientId
+	case a.Token != "":
+		return "bearer token"
+	case a.Username != "":
+		return "basic auth for " + a.Username
+	}
+	return "none"
+}
+
+// Authenticate a request for a profile's feed with its credentials, if it
+// has any
+func setFeedAuth(req *http.Request, pid datastore.PidType) error {
+	auth := config.Feeds[string(pid)].Auth
+	switch {
+	case auth.oauth():
+		t, err := oauthTokens.Token(req.Context(), auth)
+		if err != nil {
+			return fmt.Errorf("could not obtain oauth token: %s", err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+t.AccessToken)
+	case auth.Token != "":
+		req.Header.Set("Authorization", "Bearer "+auth.Token)
+	case auth.Username != "":
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	return nil
+}
+
+// Drop the token a source has refused so that the next fetch gets a new one
+func rejectedFeedAuth(pid datastore.PidType) {
+	if auth := config.Feeds[string(pid)].Auth; auth.oauth() {
+		oauthTokens.Invalidate(auth)
+	}
+}
+
+// A url fit for logging, with any password it carries masked
+func redactedUrl(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A profile's feed url sometimes names a site's home page rather than its
+// feed. Such a page is searched for the feed it advertises with a link
+// element, which is fetched in the page's place and recorded as where the
+// profile's feed has moved to, so later fetches go straight to it as they
+// would after a permanent redirect.
+
+type NoFeedError struct {
+	Url string
+}
+
+func (e *NoFeedError) Error() string {
+	return fmt.Sprintf("%s is a web page that advertises no feed", redactedUrl(e.Url))
+}
+
+// Whether a fetched body is a web page rather than a feed. The body is
+// sniffed rather than trusting the content type, which too many servers
+// give as text/html for their feeds. A body opening with a comment sniffs
+// as HTML, so a feed root element after any comments is looked for first.
+func isWebPage(body []byte) bool {
+	if hasFeedRoot(body) {
+		return false
+	}
+	return strings.HasPrefix(http.DetectContentType(body), "text/html")
+}
+
+var feedRoots = []string{"<rss", "<feed", "<rdf:RDF"}
+
+// Whether the first element of a body, after any byte order mark,
+// whitespace, comments and processing instructions, is the root of an RSS,
+// Atom or RDF feed
+func hasFeedRoot(body []byte) bool {
+	if len(body) > 4096 {
+		body = body[:4096]
+	}
+	rest := strings.TrimPrefix(string(body), "\ufeff")
+	for {
+		rest = strings.TrimLeft(rest, " \t\r\n")
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			end := strings.Index(rest, "-->")
+			if end < 0 {
+				return false
+			}
+			rest = rest[end+3:]
+		case strings.HasPrefix(rest, "<?"):
+			end := strings.Index(rest, "?>")
+			if end < 0 {
+				return false
+			}
+			rest = rest[end+2:]
+		default:
+			for _, root := range feedRoots {
+				if strings.HasPrefix(rest, root) && len(rest) > len(root) && strings.ContainsRune(" \t\r\n>/", rune(rest[len(root)])) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+}
+
+// Fetch the feed a page advertises in place of the page
+func (job RssJob) discoverFeed(ctx context.Context, page []byte, base string) (*FetchedFeed, error) {
+	feedUrl, _ := feedLink(page, base)
+	if feedUrl == "" || job.discovered {
+		return nil, &NoFeedError{Url: base}
+	}
+
+	log.Printf("Feed url %s of profile %s is a web page advertising the feed %s", redactedUrl(job.Url), job.Pid, redactedUrl(feedUrl))
+	countMetric("feed.discovered", 1)
+
+	found := RssJob{Url: feedUrl, Pid: job.Pid, ItemType: job.ItemType, Full: true, discovered: true}
+	ff, err := found.fetchFeed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ff.MovedTo == "" {
+		ff.MovedTo = feedUrl
+	}
+	return ff, nil
+}
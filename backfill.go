@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"log"
+)
+
+// Some feeds carry only their latest entries, with older ones on further
+// pages linked as RFC 5005 describes. On a profile's first fetch up to
+// Backfill of those pages are followed and their items ingested with the
+// feed's own, so a new profile's timeline starts with the feed's history
+// rather than its last few entries.
+
+// The most older pages of a profile's feed to follow, zero for none
+func feedBackfillPages(pid datastore.PidType) int {
+	pages := config.Feeds[string(pid)].Backfill
+	if pages == 0 {
+		pages = config.Fetcher.Feed.Backfill
+	}
+	if pages < 0 {
+		return 0
+	}
+	return pages
+}
+
+// Add the items of the feed's older pages to the fetched feed, stopping at
+// the first page that fails
+func (job RssJob) backfill(ctx context.Context, ff *FetchedFeed, pages int) {
+	page, body := job.Url, ff.Body
+	visited := map[string]bool{job.Url: true}
+	for i := 0; i < pages && ctx.Err() == nil; i++ {
+		older := resolveHref(ingest.OlderPage(body), page)
+		if older == "" || visited[older] {
+			return
+		}
+		visited[older] = true
+
+		extra, err := RssJob{Url: older, Pid: job.Pid, ItemType: job.ItemType, Full: true, discovered: true}.fetchFeed(ctx)
+		if err != nil {
+			log.Printf("RSS job failed to fetch older page %s: %s", redactedUrl(older), err.Error())
+			countMetric("feed.errors", 1)
+			return
+		}
+		countMetric("feed.backfill.pages", 1)
+		if extra.Feed != nil {
+			log.Printf("RSS job backfilling %d items from older page %s", len(extra.Feed.Items), redactedUrl(older))
+			ff.appendItems(extra, older)
+		}
+		page, body = older, extra.Body
+	}
+}
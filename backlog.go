@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The fetcher's backlog is sampled every Interval seconds and sent to the
+// metrics sinks as the backlog.images and backlog.feeds gauges. With File
+// set it is also written there for autoscalers that read a file rather than
+// metrics. The API serves it at /backlog.
+type BacklogConfig struct {
+	Interval int    `toml:"interval"`
+	File     string `toml:"file"`
+}
+
+// How much work is waiting. ImagesPending counts image jobs queued for the
+// enrichment workers and FeedsDue the feeds that were due at the last
+// check of the schedule, including any held back by the catch up limit.
+type Backlog struct {
+	ImagesPending int64 `json:"imagespending"`
+	FeedsDue      int64 `json:"feedsdue"`
+	Sampled       int64 `json:"sampled"`
+}
+
+var feedsDue int64
+
+func recordFeedsDue(n int) {
+	atomic.StoreInt64(&feedsDue, int64(n))
+}
+
+func currentBacklog() Backlog {
+	b := Backlog{
+		FeedsDue: atomic.LoadInt64(&feedsDue),
+		Sampled:  time.Now().Unix(),
+	}
+	if imageDispatcher != nil {
+		b.ImagesPending = int64(imageDispatcher.Queued())
+	}
+	return b
+}
+
+func exportBacklog(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.Backlog.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b := currentBacklog()
+		gaugeMetric("backlog.images", b.ImagesPending)
+		gaugeMetric("backlog.feeds", b.FeedsDue)
+		if config.Backlog.File != "" {
+			writeBacklog(config.Backlog.File, b)
+		}
+	}
+}
+
+func writeBacklog(filename string, b Backlog) {
+	data, err := json.Marshal(b)
+	if err == nil {
+		if err = ioutil.WriteFile(filename+".tmp", data, 0644); err == nil {
+			err = os.Rename(filename+".tmp", filename)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not write backlog %s: %s", filename, err.Error())
+	}
+}
+
+func handleBacklog(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, currentBacklog())
+}
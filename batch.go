@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Items needing images are grabbed in batches sized to the headroom the
+// fetcher has. The batch shrinks as the dispatcher queue fills and halves
+// when the heap nears MaxMemory or the machine is loaded beyond its CPUs,
+// staying between Min and Max.
+type ImageBatchConfig struct {
+	Min       int `toml:"min"`
+	Max       int `toml:"max"`
+	MaxMemory int `toml:"maxmemory"` // megabytes, 0 to ignore memory
+}
+
+// Grabbing stops until the dispatcher queue falls below this many jobs
+func imageQueueHighWater() int {
+	return config.Fetcher.Image.Batch.Max * 2
+}
+
+func imageBatchSize(queued int) int {
+	bc := config.Fetcher.Image.Batch
+
+	size := bc.Max - bc.Max*queued/imageQueueHighWater()
+
+	if bc.MaxMemory > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		if ms.HeapAlloc > uint64(bc.MaxMemory)*1024*1024*8/10 {
+			size /= 2
+		}
+	}
+
+	if load, ok := loadAverage(); ok && load > float64(runtime.NumCPU()) {
+		size /= 2
+	}
+
+	if size < bc.Min {
+		size = bc.Min
+	}
+	if size > bc.Max {
+		size = bc.Max
+	}
+	return size
+}
+
+// The one minute load average, where the platform provides one
+func loadAverage() (float64, bool) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return load, true
+}
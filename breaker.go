@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A circuit breaker for each remote host. After a run of consecutive
+// failures the breaker opens and requests to the host fail immediately
+// until the cool down has passed. The next request is then let through as
+// a trial: success closes the breaker, failure opens it again.
+type Breaker struct {
+	Host      string `json:"host"`
+	Failures  int    `json:"failures"`
+	OpenUntil int64  `json:"openuntil,omitempty"`
+	trial     bool
+}
+
+type BreakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+var breakers = &BreakerSet{breakers: make(map[string]*Breaker)}
+
+type BreakerOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+func (bs *BreakerSet) Allow(host string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b, exists := bs.breakers[strings.ToLower(host)]
+	if !exists || b.OpenUntil == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	if now < b.OpenUntil || b.trial {
+		countMetric("breaker.rejected", 1)
+		return &BreakerOpenError{Host: host, Until: time.Unix(b.OpenUntil, 0)}
+	}
+
+	// Cool down has passed, let one request through
+	b.trial = true
+	return nil
+}
+
+// Report whether requests to the host would be rejected right now, without
+// claiming the trial request
+func (bs *BreakerSet) Tripped(host string) bool {
+	return bs.Check(host) != nil
+}
+
+// The error Allow would return for the host right now, without claiming
+// the trial request
+func (bs *BreakerSet) Check(host string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b, exists := bs.breakers[strings.ToLower(host)]
+	if !exists || b.OpenUntil == 0 {
+		return nil
+	}
+	if time.Now().Unix() < b.OpenUntil || b.trial {
+		return &BreakerOpenError{Host: host, Until: time.Unix(b.OpenUntil, 0)}
+	}
+	return nil
+}
+
+func (bs *BreakerSet) Success(host string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	host = strings.ToLower(host)
+	if b, exists := bs.breakers[host]; exists {
+		if b.OpenUntil != 0 {
+			log.Printf("Circuit breaker for %s closed", host)
+		}
+		delete(bs.breakers, host)
+	}
+}
+
+func (bs *BreakerSet) Failure(host string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	host = strings.ToLower(host)
+	b, exists := bs.breakers[host]
+	if !exists {
+		b = &Breaker{Host: host}
+		bs.breakers[host] = b
+	}
+
+	b.Failures++
+	if b.trial || b.Failures >= config.Breaker.Threshold {
+		if b.OpenUntil == 0 || b.trial {
+			log.Printf("Circuit breaker for %s opened after %d failures", host, b.Failures)
+			countMetric("breaker.tripped", 1)
+		}
+		b.trial = false
+		b.OpenUntil = time.Now().Unix() + int64(config.Breaker.Cooldown)
+	}
+}
+
+// Give back a trial request that ended without saying whether the host is
+// up, so the next request can try instead
+func (bs *BreakerSet) Release(host string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if b, exists := bs.breakers[strings.ToLower(host)]; exists {
+		b.trial = false
+	}
+}
+
+// List the breakers that are currently open
+func (bs *BreakerSet) Open() []Breaker {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	open := make([]Breaker, 0)
+	for _, b := range bs.breakers {
+		if b.OpenUntil != 0 {
+			open = append(open, *b)
+		}
+	}
+	sort.Sort(byHost(open))
+	return open
+}
+
+type byHost []Breaker
+
+func (b byHost) Len() int           { return len(b) }
+func (b byHost) Less(i, j int) bool { return b[i].Host < b[j].Host }
+func (b byHost) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// BreakerTransport applies the host breakers to every request. Network
+// errors and server errors count as failures; other responses show the
+// host is up. Requests cancelled by the caller, such as the loser of a
+// hedged fetch or those cut off by shutdown, count as neither.
+type BreakerTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t *BreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if err := breakers.Allow(host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil && (errors.Is(err, context.Canceled) || req.Context().Err() != nil) {
+		breakers.Release(host)
+	} else if err != nil || resp.StatusCode >= 500 {
+		breakers.Failure(host)
+	} else {
+		breakers.Success(host)
+	}
+	return resp, err
+}
+
+func handleBreakers(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, breakers.Open())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const budgetWindow = time.Hour
+
+// Budget tracks resource consumption over a rolling hourly window so that
+// fetching can be paused once a configured limit has been reached. Image
+// processing is accounted as the elapsed time spent picking images.
+type Budget struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int64
+	bytes       int64
+	imageTime   time.Duration
+	exhausted   bool
+}
+
+var budget = &Budget{windowStart: time.Now()}
+
+// Must be called with the lock held
+func (b *Budget) roll() {
+	if time.Since(b.windowStart) < budgetWindow {
+		return
+	}
+
+	log.Printf("Budget used in the last hour: %d requests, %d bytes, %s image processing", b.requests, b.bytes, b.imageTime)
+	countMetric("budget.requests", b.requests)
+	countMetric("budget.bytes", b.bytes)
+	countMetric("budget.imageseconds", int64(b.imageTime.Seconds()))
+
+	b.windowStart = time.Now()
+	b.requests = 0
+	b.bytes = 0
+	b.imageTime = 0
+	b.exhausted = false
+}
+
+// Report whether any budget has been used up for the current window
+func (b *Budget) Exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+
+	limits := config.Budget
+	over := (limits.Requests > 0 && b.requests >= limits.Requests) ||
+		(limits.Bytes > 0 && b.bytes >= limits.Bytes) ||
+		(limits.ImageSeconds > 0 && b.imageTime >= time.Duration(limits.ImageSeconds)*time.Second)
+
+	if over && !b.exhausted {
+		log.Printf("Budget exhausted, pausing fetches until %s", b.windowStart.Add(budgetWindow).Format(time.RFC3339))
+		countMetric("budget.exhausted", 1)
+	}
+	b.exhausted = over
+	return over
+}
+
+func (b *Budget) AddRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.requests++
+}
+
+func (b *Budget) AddBytes(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.bytes += n
+}
+
+func (b *Budget) AddImageTime(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.imageTime += d
+}
+
+// countingReader adds everything read through it to the byte budget
+type countingReader struct {
+	r io.Reader
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	budget.AddBytes(int64(n))
+	return n, err
+}
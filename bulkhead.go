@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"github.com/placetime/datastore"
+	"sync"
+)
+
+// The most jobs held waiting for dispatch before Submit blocks
+const maxQueuedJobs = 10000
+
+// A Dispatcher shares workers fairly between profiles. Jobs are queued per
+// profile and handed out round robin, and no profile may have more than a
+// fixed number of jobs in flight, so one feed with a large backlog cannot
+// monopolise the workers.
+type Dispatcher struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	perPid   int
+	queued   int
+	queues   map[datastore.PidType][]Job
+	order    []datastore.PidType
+	next     int
+	inflight map[datastore.PidType]int
+}
+
+func NewDispatcher(perPid int) *Dispatcher {
+	d := &Dispatcher{
+		perPid:   perPid,
+		queues:   make(map[datastore.PidType][]Job),
+		inflight: make(map[datastore.PidType]int),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// Queue a job, waiting while the queue is full. Gives up with ctx's error
+// once ctx is done.
+func (d *Dispatcher) Submit(ctx context.Context, pid datastore.PidType, job Job) error {
+	defer d.wakeOnDone(ctx)()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.queued >= maxQueuedJobs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		d.cond.Wait()
+	}
+
+	if _, exists := d.queues[pid]; !exists {
+		d.order = append(d.order, pid)
+	}
+	d.queues[pid] = append(d.queues[pid], job)
+	d.queued++
+	d.cond.Broadcast()
+	return nil
+}
+
+// Wake every waiter when ctx is done, so none waits on after the workers
+// that would make room have gone. The returned func stops watching.
+func (d *Dispatcher) wakeOnDone(ctx context.Context) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.mu.Lock()
+			d.cond.Broadcast()
+			d.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Must be called with the lock held. Returns nil if no profile with queued
+// jobs has capacity.
+func (d *Dispatcher) take() Job {
+	for i := 0; i < len(d.order); i++ {
+		idx := (d.next + i) % len(d.order)
+		pid := d.order[idx]
+		if d.perPid > 0 && d.inflight[pid] >= d.perPid {
+			continue
+		}
+
+		queue := d.queues[pid]
+		job := queue[0]
+		if len(queue) == 1 {
+			// Drop the empty queue, the slot at idx is now the next profile
+			delete(d.queues, pid)
+			d.order = append(d.order[:idx], d.order[idx+1:]...)
+			d.next = idx
+		} else {
+			d.queues[pid] = queue[1:]
+			d.next = idx + 1
+		}
+		if len(d.order) > 0 {
+			d.next %= len(d.order)
+		} else {
+			d.next = 0
+		}
+
+		d.queued--
+		d.inflight[pid]++
+		d.cond.Broadcast()
+		return dispatchedJob{pid: pid, job: job, d: d}
+	}
+	return nil
+}
+
+// Hand jobs to workers as profiles have capacity for them
+func (d *Dispatcher) Run(ctx context.Context, out chan<- Job) {
+	go func() {
+		<-ctx.Done()
+		d.mu.Lock()
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	}()
+
+	for {
+		d.mu.Lock()
+		job := d.take()
+		for job == nil {
+			if ctx.Err() != nil {
+				d.mu.Unlock()
+				return
+			}
+			d.cond.Wait()
+			job = d.take()
+		}
+		d.mu.Unlock()
+
+		select {
+		case out <- job:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) release(pid datastore.PidType) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.inflight[pid]--
+	if d.inflight[pid] <= 0 {
+		delete(d.inflight, pid)
+	}
+	d.cond.Broadcast()
+}
+
+// The number of jobs waiting for dispatch
+func (d *Dispatcher) Queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queued
+}
+
+// Block until fewer than n jobs are waiting for dispatch, or until ctx is
+// done
+func (d *Dispatcher) WaitQueued(ctx context.Context, n int) error {
+	defer d.wakeOnDone(ctx)()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.queued >= n {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		d.cond.Wait()
+	}
+	return nil
+}
+
+// Block until every submitted job has completed
+func (d *Dispatcher) Wait() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.queued > 0 || len(d.inflight) > 0 {
+		d.cond.Wait()
+	}
+}
+
+type dispatchedJob struct {
+	pid datastore.PidType
+	job Job
+	d   *Dispatcher
+}
+
+func (dj dispatchedJob) Do(ctx context.Context) {
+	defer dj.d.release(dj.pid)
+	dj.job.Do(ctx)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"github.com/placetime/datastore"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Timeouts in seconds for fetches of feeds, pages and images. Connect
+// bounds establishing the connection, Header waiting for the response
+// headers once the request is sent and Total the whole request including
+// reading the body. HostRate caps the requests per second to any one
+// hostname whatever its politeness profile allows, zero for no cap.
+// UserAgent is sent with every request, naming the fetcher and its version
+// when empty. Proxy is the url of an http or socks5 proxy to fetch through.
+// Tls holds the certificate authorities and client certificate to use.
+// Allow lists hosts and networks that may be fetched from even though they
+// are not public. Bandwidth caps the kilobytes per second downloaded for
+// feeds and images together, zero for no cap.
+type HttpConfig struct {
+	Connect   int       `toml:"connect"`
+	Header    int       `toml:"header"`
+	Total     int       `toml:"total"`
+	HostRate  float64   `toml:"hostrate"`
+	UserAgent string    `toml:"useragent"`
+	Proxy     string    `toml:"proxy"`
+	Tls       TlsConfig `toml:"tls"`
+	Allow     []string  `toml:"allow"`
+	Bandwidth int       `toml:"bandwidth"`
+}
+
+// All fetches of feeds, pages and images go through this client
+var fetchClient = &http.Client{
+	Transport: &BreakerTransport{Transport: http.DefaultTransport},
+}
+
+// The same as fetchClient but without verifying certificates, for feeds
+// marked insecure
+var insecureClient = fetchClient
+
+// HeaderTransport adds headers to requests that do not already set them
+type HeaderTransport struct {
+	Transport http.RoundTripper
+	Header    http.Header
+}
+
+func (t *HeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var cloned bool
+	for k, v := range t.Header {
+		if _, exists := req.Header[k]; exists {
+			continue
+		}
+		// A RoundTripper must not modify the request it was given
+		if !cloned {
+			req = req.Clone(req.Context())
+			cloned = true
+		}
+		req.Header[k] = v
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+func userAgent() string {
+	if ua := config.Fetcher.Http.UserAgent; ua != "" {
+		return ua
+	}
+	return "placetime-fetcher/" + version + " (+http://placetime.com/)"
+}
+
+// Set the extra headers configured for a profile's feed on a request for it
+func setFeedHeaders(req *http.Request, pid datastore.PidType) {
+	for k, v := range config.Feeds[string(pid)].Headers {
+		req.Header.Set(k, v)
+	}
+}
+
+// Layer decoding, default headers and politeness over a transport
+func politeTransport(transport http.RoundTripper) http.RoundTripper {
+	headers := &HeaderTransport{
+		Transport: &DecodingTransport{Transport: &SafeTransport{Transport: transport}},
+		Header:    http.Header{"User-Agent": {userAgent()}},
+	}
+	return &PolitenessTransport{Transport: headers}
+}
+
+func initFetchClient() {
+	initDnsCache()
+
+	hc := config.Fetcher.Http
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(hc.Connect) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy: requestProxy,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return dialHost(ctx, dialer, network, addr)
+		},
+		TLSHandshakeTimeout:   time.Duration(hc.Connect) * time.Second,
+		ResponseHeaderTimeout: time.Duration(hc.Header) * time.Second,
+		MaxIdleConnsPerHost:   4,
+	}
+
+	tlsConfig, err := fetchTlsConfig(hc.Tls)
+	if err != nil {
+		log.Printf("Invalid TLS configuration: %s", err.Error())
+		os.Exit(1)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	apClient.Transport = &SafeTransport{Transport: transport}
+
+	polite := politeTransport(transport)
+	fetchClient.Transport = &BreakerTransport{Transport: polite}
+	fetchClient.Timeout = time.Duration(hc.Total) * time.Second
+
+	insecure := transport.Clone()
+	insecure.TLSClientConfig = tlsConfig.Clone()
+	insecure.TLSClientConfig.InsecureSkipVerify = true
+	insecureClient = &http.Client{
+		Transport: &BreakerTransport{Transport: politeTransport(insecure)},
+		Timeout:   fetchClient.Timeout,
+	}
+
+	// imgpick makes its requests with the default client, give it the
+	// same limits and host breakers. Everything it downloads is for the
+	// image pipeline.
+	initBandwidth()
+	http.DefaultClient.Transport = &LimitTransport{
+		Transport: &BreakerTransport{Transport: &ThrottleTransport{Transport: polite, Bucket: imageBandwidth}},
+		Limit:     int64(config.Fetcher.Image.MaxBytes),
+	}
+	http.DefaultClient.Timeout = fetchClient.Timeout
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"log"
+)
+
+// Items about the same event, such as coverage of a festival from several
+// sources, are grouped into a cluster once ingested. Two items are in the
+// same cluster when they lie in neighbouring geohash cells of Precision
+// characters and their times are at most Window seconds apart. The item's
+// time is when it happens, or when it was published if the feed gives no
+// event time. Clustering uses the search index's redis server.
+type ClusterConfig struct {
+	Enabled   bool `toml:"enabled"`
+	Precision int  `toml:"precision"`
+	Window    int  `toml:"window"`
+}
+
+func clusteringEnabled() bool {
+	return config.Cluster.Enabled && searchEnabled()
+}
+
+func clusterKey(hash string) string {
+	return config.Search.Prefix + "events:" + hash
+}
+
+func clusterTime(meta *ItemMeta) int64 {
+	if meta.HappensAt != 0 {
+		return meta.HappensAt
+	}
+	return meta.Published
+}
+
+// Place newly ingested items in clusters with the items already recorded
+// near them in place and time
+func clusterItems(metas []*ItemMeta) {
+	if !clusteringEnabled() {
+		return
+	}
+
+	conn := searchPool.Get()
+	defer conn.Close()
+
+	for _, meta := range metas {
+		if meta.Location == nil || clusterTime(meta) == 0 {
+			continue
+		}
+		if err := clusterItem(conn, meta); err != nil {
+			log.Printf("Could not cluster item %s: %s", meta.Id, err.Error())
+			countMetric("cluster.errors", 1)
+		}
+	}
+}
+
+func clusterItem(conn redis.Conn, meta *ItemMeta) error {
+	t := clusterTime(meta)
+	window := int64(config.Cluster.Window)
+
+	var cluster string
+	var unclustered []datastore.ItemIdType
+	for _, hash := range geohashNeighbourhood(meta.Location, config.Cluster.Precision) {
+		members, err := redis.Strings(conn.Do("ZRANGEBYSCORE", clusterKey(hash), t-window, t+window))
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			id := datastore.ItemIdType(m)
+			if id == meta.Id {
+				continue
+			}
+			other, err := readItemMeta(id)
+			if err != nil {
+				continue
+			}
+			if other.Cluster != "" && cluster == "" {
+				cluster = other.Cluster
+			} else if other.Cluster == "" {
+				unclustered = append(unclustered, id)
+			}
+		}
+	}
+
+	hash := ingest.Geohash(meta.Location, config.Cluster.Precision)
+	if _, err := conn.Do("ZADD", clusterKey(hash), t, string(meta.Id)); err != nil {
+		return err
+	}
+
+	if cluster == "" && len(unclustered) == 0 {
+		return nil
+	}
+	if cluster == "" {
+		// A new cluster is named after its first item
+		cluster = string(unclustered[0])
+	}
+
+	for _, id := range append(unclustered, meta.Id) {
+		err := updateItemMeta(id, func(m *ItemMeta) {
+			m.Cluster = cluster
+		})
+		if err != nil {
+			return err
+		}
+	}
+	meta.Cluster = cluster
+	countMetric("cluster.items", 1)
+	return nil
+}
@@ -4,49 +4,436 @@ import (
 	"flag"
 	"github.com/BurntSushi/toml"
 	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
 	"log"
 	"os"
 	"os/user"
-	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Fetcher   FetcherConfig    `toml:"fetcher"`
-	Image     ImageConfig      `toml:"image"`
-	Datastore datastore.Config `toml:"datastore"`
+	Fetcher     FetcherConfig                   `toml:"fetcher"`
+	Image       ImageConfig                     `toml:"image"`
+	Meta        MetaConfig                      `toml:"meta"`
+	Webhook     WebhookConfig                   `toml:"webhook"`
+	Alerts      AlertConfig                     `toml:"alerts"`
+	Notify      NotifyConfig                    `toml:"notify"`
+	Annotate    AnnotateConfig                  `toml:"annotate"`
+	Api         ApiConfig                       `toml:"api"`
+	ActivityPub ActivityPubConfig               `toml:"activitypub"`
+	WebSub      WebSubConfig                    `toml:"websub"`
+	Wayback     WaybackConfig                   `toml:"wayback"`
+	Links       LinksConfig                     `toml:"links"`
+	Rank        RankConfig                      `toml:"rank"`
+	Search      SearchConfig                    `toml:"search"`
+	Places      PlacesConfig                    `toml:"places"`
+	Leases      LeaseConfig                     `toml:"leases"`
+	Discover    DiscoverConfig                  `toml:"discover"`
+	Shadow      ShadowConfig                    `toml:"shadow"`
+	Normalize   ingest.NormalizeConfig          `toml:"normalize"`
+	Seen        SeenConfig                      `toml:"seen"`
+	Document    DocumentConfig                  `toml:"document"`
+	Cluster     ClusterConfig                   `toml:"cluster"`
+	Statsd      StatsdConfig                    `toml:"statsd"`
+	StatsFile   StatsFileConfig                 `toml:"statsfile"`
+	Slos        []SloConfig                     `toml:"slo"`
+	History     HistoryConfig                   `toml:"history"`
+	Backlog     BacklogConfig                   `toml:"backlog"`
+	Log         LogConfig                       `toml:"log"`
+	Budget      BudgetConfig                    `toml:"budget"`
+	Breaker     BreakerConfig                   `toml:"breaker"`
+	Dns         DnsConfig                       `toml:"dns"`
+	Datastore   datastore.Config                `toml:"datastore"`
+	Feeds       map[string]FeedConfig           `toml:"feeds"`
+	Virtual     map[string]VirtualProfileConfig `toml:"virtual"`
+	Trust       map[string]TrustPolicy          `toml:"trust"`
+	Politeness  map[string]PolitenessProfile    `toml:"politeness"`
+	Hosts       map[string]HostConfig           `toml:"hosts"`
+	Plugins     []PluginConfig                  `toml:"plugin"`
+	Script      ScriptConfig                    `toml:"script"`
 }
 
+// With -runonce, Cycle bounds the seconds the single pass may take before work
+// still outstanding is abandoned, zero for no bound
 type FetcherConfig struct {
-	Workers int                `toml:"workers"`
-	Feed    FetcherFeedConfig  `toml:"feed"`
-	Image   FetcherImageConfig `toml:"image"`
+	Workers     int                 `toml:"workers"`
+	Cycle       int                 `toml:"cycle"`
+	State       string              `toml:"state"`
+	DeadLetters string              `toml:"deadletters"`
+	Paused      string              `toml:"paused"`
+	Tokens      string              `toml:"tokens"`
+	Cookies     string              `toml:"cookies"`
+	Http        HttpConfig          `toml:"http"`
+	Feed        FetcherFeedConfig   `toml:"feed"`
+	Image       FetcherImageConfig  `toml:"image"`
+	Enrich      FetcherEnrichConfig `toml:"enrich"`
 }
 
+// Enrichment jobs such as image picking run on their own pool of workers.
+// PerFeed limits how many of those workers one profile's jobs may occupy.
+type FetcherEnrichConfig struct {
+	Workers int `toml:"workers"`
+	PerFeed int `toml:"perfeed"`
+}
+
+// Each feed is fetched every Interval seconds, backing off exponentially up
+// to MaxBackoff seconds when fetches fail. After MaxFailures consecutive
+// failures the feed is moved to the dead letter queue. A feed that answers
+// 410 Gone, or 404 Not Found MaxNotFound times in a row, is paused until it
+// is resumed by hand. Feeds larger than MaxBytes fail. The schedule is
+// checked every Check seconds and at most CatchUp overdue feeds are queued
+// per check, so a backlog after downtime is worked through gradually. A
+// single fetch and ingest of a feed is stopped after Timeout seconds. A
+// feed that has not answered after Hedge milliseconds is requested a second
+// time and whichever answers first is used, zero to never hedge. Bandwidth
+// caps the kilobytes per second downloaded for feeds, zero for no cap. Feed
+// urls may be file:// urls of files within the Files directory. On a
+// profile's first fetch up to Backfill older pages of a paged or archived
+// feed are followed, zero for none.
 type FetcherFeedConfig struct {
-	Interval int `toml:"interval"`
+	Interval    int         `toml:"interval"`
+	Check       int         `toml:"check"`
+	MaxBackoff  int         `toml:"maxbackoff"`
+	MaxFailures int         `toml:"maxfailures"`
+	MaxNotFound int         `toml:"maxnotfound"`
+	MaxBytes    int         `toml:"maxbytes"`
+	Retry       RetryConfig `toml:"retry"`
+	CatchUp     int         `toml:"catchup"`
+	Hedge       int         `toml:"hedge"`
+	Timeout     int         `toml:"timeout"`
+	Bandwidth   int         `toml:"bandwidth"`
+	Files       string      `toml:"files"`
+	Backfill    int         `toml:"backfill"`
 }
 
+// Timeout bounds the seconds spent picking and inspecting the image for a
+// single item. When Refresh is non-zero, images of items older than
+// RefreshAge seconds are revalidated against their source every Refresh
+// seconds. Batch bounds how many items are grabbed for image picking at
+// once. With Alternate, images are picked from a page's AMP or printer
+// friendly variant where it has one. Robots is obey to skip pages robots.txt
+// disallows, flag to pick from them but mark the item, or ignore. Bandwidth
+// caps the kilobytes per second downloaded for images, zero for no cap.
+// Pages and images larger than MaxBytes are not downloaded.
 type FetcherImageConfig struct {
-	Interval int `toml:"interval"`
+	Interval   int              `toml:"interval"`
+	Timeout    int              `toml:"timeout"`
+	Refresh    int              `toml:"refresh"`
+	RefreshAge int              `toml:"refreshage"`
+	Batch      ImageBatchConfig `toml:"batch"`
+	Alternate  bool             `toml:"alternate"`
+	Robots     string           `toml:"robots"`
+	Bandwidth  int              `toml:"bandwidth"`
+	MaxBytes   int              `toml:"maxbytes"`
+}
+
+// Settings that apply to a single feed driven profile, keyed by pid.
+// Headers are added to each request for the profile's feed, replacing any
+// the fetcher would send itself such as its User-Agent. Proxy overrides the
+// proxy the feed is fetched through, "direct" fetching it without one.
+// Timezone is the IANA zone of dates the feed gives without one, and with
+// ForceZone of all its dates whatever zone they claim. New items repeating
+// the title of one seen in the last TitleWindow seconds are dropped. Urls
+// are further feeds whose items are merged into the profile's timeline.
+// Auth holds credentials for a private feed. With Cookies the feed keeps the
+// cookies its site sets from one fetch to the next. Insecure fetches the
+// feed without verifying its server's certificate. With NoImages the
+// profile's items are never scraped for images, for sources such as status
+// pages that have nothing worth picking. Hedge overrides the milliseconds
+// after which a slow fetch of the feed is hedged, -1 to never hedge it.
+// Normalize replaces the [normalize] settings for tidying the feed's titles.
+// Backfill overrides the older pages followed on the feed's first fetch, -1
+// to follow none. License is the url of the license the source publishes
+// under, for items whose feed does not give one.
+type FeedConfig struct {
+	Transforms  []ingest.TransformConfig `toml:"transform"`
+	Dedup       string                   `toml:"dedup"`
+	DedupWindow int                      `toml:"dedupwindow"`
+	Geofence    GeofenceConfig           `toml:"geofence"`
+	Event       string                   `toml:"event"`
+	Trust       string                   `toml:"trust"`
+	Script      string                   `toml:"script"`
+	Paused      bool                     `toml:"paused"`
+	Headers     map[string]string        `toml:"headers"`
+	Proxy       string                   `toml:"proxy"`
+	Timezone    string                   `toml:"timezone"`
+	ForceZone   bool                     `toml:"forcezone"`
+	TitleWindow int                      `toml:"titlewindow"`
+	Urls        []string                 `toml:"urls"`
+	Auth        FeedAuthConfig           `toml:"auth"`
+	Cookies     bool                     `toml:"cookies"`
+	Insecure    bool                     `toml:"insecure"`
+	NoImages    bool                     `toml:"noimages"`
+	Hedge       int                      `toml:"hedge"`
+	Normalize   *ingest.NormalizeConfig  `toml:"normalize"`
+	Backfill    int                      `toml:"backfill"`
+	License     string                   `toml:"license"`
 }
 
+// Rewrite replaces the link of an item once it has been checked, with the
+// url its redirects ended at for "final" or with the url the page declares
+// canonical for "canonical". Empty keeps links as the feed gave them.
+type LinksConfig struct {
+	Rewrite string `toml:"rewrite"`
+}
+
+// Placeholder is used when no picked image meets the quality thresholds,
+// defaulting to the favicon of the item's site. Replicas are further
+// directories or http base urls each image file is copied to.
 type ImageConfig struct {
+	Path        string             `toml:"path"`
+	Placeholder string             `toml:"placeholder"`
+	Quality     ImageQualityConfig `toml:"quality"`
+	Proxy       ImageProxyConfig   `toml:"proxy"`
+	Caption     CaptionConfig      `toml:"caption"`
+	Replicas    []string           `toml:"replicas"`
+}
+
+// Aspect is width divided by height. MaxFlatness is the largest fraction of
+// an image that may be a single color, catching spacers and tracking pixels.
+type ImageQualityConfig struct {
+	MinWidth    int     `toml:"minwidth"`
+	MinHeight   int     `toml:"minheight"`
+	MinAspect   float64 `toml:"minaspect"`
+	MaxAspect   float64 `toml:"maxaspect"`
+	MaxFlatness float64 `toml:"maxflatness"`
+}
+
+type MetaConfig struct {
 	Path string `toml:"path"`
 }
 
+// The query API is only started when a listen address is configured. The
+// base url is the public address of the API, used when publishing links to
+// it elsewhere. Requests that change state are accepted with AdminToken as
+// a bearer token, or on AdminListen, a loopback address serving the same
+// API without one.
+type ApiConfig struct {
+	Listen      string `toml:"listen"`
+	BaseUrl     string `toml:"baseurl"`
+	AdminToken  string `toml:"admintoken"`
+	AdminListen string `toml:"adminlisten"`
+}
+
+// ActivityPub publishing is served by the query API
+type ActivityPubConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Domain  string `toml:"domain"`
+	Path    string `toml:"path"`
+}
+
+// Hub to notify when a profile's Atom feed changes
+type WebSubConfig struct {
+	Hub string `toml:"hub"`
+}
+
+// Metrics are only sent to statsd when an address is configured
+type StatsdConfig struct {
+	Addr   string   `toml:"addr"`
+	Prefix string   `toml:"prefix"`
+	Tags   []string `toml:"tags"`
+}
+
+// Target is one of stderr, syslog or journald, or eventlog on Windows
+type LogConfig struct {
+	Target   string `toml:"target"`
+	Syslog   string `toml:"syslog"`
+	Facility int    `toml:"facility"`
+	Tag      string `toml:"tag"`
+}
+
+// Hourly resource limits, zero means unlimited
+type BudgetConfig struct {
+	Requests     int64 `toml:"requests"`
+	Bytes        int64 `toml:"bytes"`
+	ImageSeconds int64 `toml:"imageseconds"`
+}
+
+// A host's breaker opens after Threshold consecutive failures and stays
+// open for Cooldown seconds
+type BreakerConfig struct {
+	Threshold int `toml:"threshold"`
+	Cooldown  int `toml:"cooldown"`
+}
+
+// When a path is given, metrics are totalled every Interval seconds and the
+// last Keep periods written to the file
+type StatsFileConfig struct {
+	Path     string `toml:"path"`
+	Interval int    `toml:"interval"`
+	Keep     int    `toml:"keep"`
+}
+
+// New items are sent to the annotation service when a url is configured
+type AnnotateConfig struct {
+	Url     string `toml:"url"`
+	Timeout int    `toml:"timeout"`
+}
+
+// Limits applied to every call of a feed's transform script. Timeout is in
+// milliseconds.
+type ScriptConfig struct {
+	MaxSteps uint64 `toml:"maxsteps"`
+	Timeout  int    `toml:"timeout"`
+}
+
+type WebhookConfig struct {
+	Url    string `toml:"url"`
+	Format string `toml:"format"`
+}
+
 var (
 	DefaultConfig Config = Config{
 		Fetcher: FetcherConfig{
-			Workers: 5,
+			Workers:     5,
+			State:       filepath.Join(dataDir, "fetcher-state.json"),
+			DeadLetters: filepath.Join(dataDir, "fetcher-deadletters.json"),
+			Paused:      filepath.Join(dataDir, "fetcher-paused.json"),
+			Tokens:      filepath.Join(dataDir, "fetcher-tokens.json"),
+			Cookies:     filepath.Join(dataDir, "fetcher-cookies.json"),
+			Http: HttpConfig{
+				Connect: 10,
+				Header:  30,
+				Total:   120,
+			},
 			Feed: FetcherFeedConfig{
-				Interval: 30 * 60,
+				Interval:    30 * 60,
+				Check:       60,
+				MaxBackoff:  24 * 60 * 60,
+				MaxFailures: 10,
+				MaxNotFound: 5,
+				MaxBytes:    20 * 1024 * 1024,
+				Timeout:     300,
+				Retry: RetryConfig{
+					Attempts: 3,
+					Backoff:  1000,
+				},
+				CatchUp: 20,
+			},
+			Enrich: FetcherEnrichConfig{
+				Workers: 5,
+				PerFeed: 2,
 			},
 			Image: FetcherImageConfig{
-				Interval: 30,
+				Interval:   30,
+				Timeout:    60,
+				RefreshAge: 30 * 24 * 60 * 60,
+				Robots:     "obey",
+				MaxBytes:   8 * 1024 * 1024,
+				Batch: ImageBatchConfig{
+					Min:       5,
+					Max:       100,
+					MaxMemory: 512,
+				},
 			},
 		},
 		Image: ImageConfig{
-			Path: "/var/opt/timescroll/img",
+			Path: filepath.Join(dataDir, "img"),
+			Quality: ImageQualityConfig{
+				MinWidth:    100,
+				MinHeight:   100,
+				MinAspect:   0.25,
+				MaxAspect:   4,
+				MaxFlatness: 0.95,
+			},
+			Proxy: ImageProxyConfig{
+				Style:   "imgproxy",
+				Width:   640,
+				Height:  360,
+				Resize:  "fill",
+				Gravity: "sm",
+			},
+			Caption: CaptionConfig{
+				Timeout: 10,
+			},
+		},
+		Meta: MetaConfig{
+			Path: filepath.Join(dataDir, "meta"),
+		},
+		Annotate: AnnotateConfig{
+			Timeout: 10,
+		},
+		Webhook: WebhookConfig{
+			Format: "full",
+		},
+		Notify: NotifyConfig{
+			Batch: 20,
+		},
+		ActivityPub: ActivityPubConfig{
+			Path: filepath.Join(dataDir, "activitypub"),
+		},
+		Wayback: WaybackConfig{
+			Api: "https://archive.org/wayback/available",
+		},
+		Search: SearchConfig{
+			Prefix:        "placetime:search:",
+			GeoPrecisions: []int{3, 4, 5, 6},
+		},
+		Cluster: ClusterConfig{
+			Precision: 6,
+			Window:    6 * 60 * 60,
+		},
+		Places: PlacesConfig{
+			Prefix:    "placetime:places:",
+			Precision: 7,
+		},
+		Leases: LeaseConfig{
+			Prefix: "placetime:leases:",
+			Ttl:    600,
+		},
+		Seen: SeenConfig{
+			Capacity:      1000000,
+			FalsePositive: 0.001,
+			Rebuild:       24 * 60 * 60,
+		},
+		Discover: DiscoverConfig{
+			Prefix:    "placetime:discover:",
+			Threshold: 5,
+		},
+		Statsd: StatsdConfig{
+			Prefix: "placetime.fetcher.",
+		},
+		Dns: DnsConfig{
+			Family:        "any",
+			FallbackDelay: 300,
+			Cache:         true,
+			MinTtl:        30,
+			MaxTtl:        3600,
+			Stale:         300,
+		},
+		Log: LogConfig{
+			Target:   "stderr",
+			Syslog:   defaultSyslogAddr(),
+			Facility: 16, // local0
+			Tag:      "placetime-fetcher",
+		},
+		History: HistoryConfig{
+			Path: filepath.Join(dataDir, "fetcher-history.json"),
+			Keep: 365,
+		},
+		Backlog: BacklogConfig{
+			Interval: 15,
+		},
+		StatsFile: StatsFileConfig{
+			Interval: 60,
+			Keep:     24 * 60,
+		},
+		Script: ScriptConfig{
+			MaxSteps: 100000,
+			Timeout:  250,
+		},
+		Rank: RankConfig{
+			Trust:     0.3,
+			Image:     0.3,
+			Text:      0.2,
+			Freshness: 0.2,
+			HalfLife:  24,
+		},
+		Breaker: BreakerConfig{
+			Threshold: 5,
+			Cooldown:  5 * 60,
 		},
 		Datastore: datastore.DefaultConfig,
 	}
@@ -57,15 +444,42 @@ func readConfig() {
 
 	flag.StringVar(&configFile, "config", "", "configuration file to use")
 	flag.BoolVar(&runOnce, "runonce", false, "run the fetcher once and then exit")
-	flag.StringVar(&feedurl, "debugfeed", "", "run the fetcher on the given feed url and debug results")
+	flag.StringVar(&feedurl, "debugfeed", "", "run the fetcher on the given feed url, or - for a feed on stdin, and debug results")
+	flag.StringVar(&debugPid, "debugpid", "", "profile whose feed settings apply to -debugfeed")
+	flag.BoolVar(&listDead, "deadletters", false, "list the jobs in the dead letter queue and exit")
+	flag.StringVar(&redriveId, "redrive", "", "retry the dead letter with the given id and exit")
+	flag.IntVar(&minBatch, "minbatch", 0, "smallest batch of items to grab for images, overriding the config")
+	flag.IntVar(&maxBatch, "maxbatch", 0, "largest batch of items to grab for images, overriding the config")
+	flag.StringVar(&pausePid, "pause", "", "pause fetching the given profile and exit")
+	flag.StringVar(&resumePid, "resume", "", "resume fetching the given paused profile and exit")
+	flag.StringVar(&pauseReason, "reason", "", "reason recorded when pausing a profile")
+	flag.IntVar(&reportWeeks, "weeks", 8, "number of weeks covered by the report command")
+	flag.IntVar(&connectTimeout, "connecttimeout", 0, "seconds allowed to connect when fetching, overriding the config")
+	flag.IntVar(&headerTimeout, "headertimeout", 0, "seconds allowed for response headers when fetching, overriding the config")
+	flag.IntVar(&totalTimeout, "totaltimeout", 0, "seconds allowed for a whole fetch, overriding the config")
+	flag.StringVar(&userAgentFlag, "user-agent", "", "User-Agent sent with every request, overriding the config")
+	flag.StringVar(&proxyFlag, "proxy", "", "url of the http or socks5 proxy to fetch through, overriding the config and environment")
+	flag.IntVar(&maxFeedBytes, "max-feed-bytes", 0, "largest feed in bytes that is read, overriding the config")
+	flag.IntVar(&maxImageBytes, "max-image-bytes", 0, "largest page or image in bytes that is read, overriding the config")
+	flag.StringVar(&allowHosts, "allow-private", "", "comma separated hosts and networks that may be fetched from although not public")
+	flag.StringVar(&ownedHosts, "owned", "", "comma separated hosts we own, scraped without consulting robots.txt")
+	flag.Float64Var(&hostRate, "hostrate", 0, "most requests per second to any one host, overriding the config")
 	flag.Parse()
 
 	config = DefaultConfig
+	config.Trust = make(map[string]TrustPolicy)
+	for tier, policy := range DefaultTrustPolicies {
+		config.Trust[tier] = policy
+	}
+	config.Politeness = make(map[string]PolitenessProfile)
+	for name, profile := range DefaultPolitenessProfiles {
+		config.Politeness[name] = profile
+	}
 
 	if configFile == "" {
 		// Test home directory
 		if u, err := user.Current(); err == nil {
-			testFile := path.Join(u.HomeDir, ".placetime", "config")
+			testFile := filepath.Join(u.HomeDir, ".placetime", "config")
 			if _, err := os.Stat(testFile); err == nil {
 				configFile = testFile
 			}
@@ -73,42 +487,340 @@ func readConfig() {
 	}
 
 	if configFile == "" {
-		// Test /etc directory
-		testFile := "/etc/placetime.conf"
-		if _, err := os.Stat(testFile); err == nil {
-			configFile = testFile
+		// Test the system configuration file
+		if _, err := os.Stat(systemConfigFile); err == nil {
+			configFile = systemConfigFile
 		}
 	}
 
 	if configFile != "" {
-		configFile = path.Clean(configFile)
+		configFile = filepath.Clean(configFile)
 		if _, err := toml.DecodeFile(configFile, &config); err != nil {
 			log.Printf("Could not read config file %s: %s", configFile, err.Error())
 			os.Exit(1)
 		}
 
 		log.Printf("Reading configuration from %s", configFile)
+		configFilename = configFile
 	} else {
 		log.Printf("Using default configuration")
 	}
 
+	if connectTimeout > 0 {
+		config.Fetcher.Http.Connect = connectTimeout
+	}
+	if headerTimeout > 0 {
+		config.Fetcher.Http.Header = headerTimeout
+	}
+	if totalTimeout > 0 {
+		config.Fetcher.Http.Total = totalTimeout
+	}
+	if hostRate > 0 {
+		config.Fetcher.Http.HostRate = hostRate
+	}
+	if userAgentFlag != "" {
+		config.Fetcher.Http.UserAgent = userAgentFlag
+	}
+	if proxyFlag != "" {
+		config.Fetcher.Http.Proxy = proxyFlag
+	}
+	if maxFeedBytes > 0 {
+		config.Fetcher.Feed.MaxBytes = maxFeedBytes
+	}
+	if maxImageBytes > 0 {
+		config.Fetcher.Image.MaxBytes = maxImageBytes
+	}
+	if config.Fetcher.Feed.Timeout <= 0 {
+		log.Printf("Feed timeout must be positive, got %d", config.Fetcher.Feed.Timeout)
+		os.Exit(1)
+	}
+
+	if config.Fetcher.Feed.MaxBytes <= 0 || config.Fetcher.Image.MaxBytes <= 0 {
+		log.Printf("Feed and image size limits must be positive, got %d and %d", config.Fetcher.Feed.MaxBytes, config.Fetcher.Image.MaxBytes)
+		os.Exit(1)
+	}
+
+	if minBatch > 0 {
+		config.Fetcher.Image.Batch.Min = minBatch
+	}
+	if maxBatch > 0 {
+		config.Fetcher.Image.Batch.Max = maxBatch
+	}
+	if len(config.Search.GeoPrecisions) == 0 {
+		log.Printf("At least one search geo precision is needed")
+		os.Exit(1)
+	}
+	for _, p := range config.Search.GeoPrecisions {
+		if p < 1 || p > 12 {
+			log.Printf("Search geo precisions must be between 1 and 12, got %d", p)
+			os.Exit(1)
+		}
+	}
+
+	if cc := config.Cluster; cc.Enabled && (cc.Precision < 1 || cc.Precision > 12 || cc.Window <= 0) {
+		log.Printf("Cluster precision must be between 1 and 12 and window positive, got %d and %d", cc.Precision, cc.Window)
+		os.Exit(1)
+	}
+
+	if config.Places.Precision < 1 || config.Places.Precision > 12 {
+		log.Printf("Place precision must be between 1 and 12, got %d", config.Places.Precision)
+		os.Exit(1)
+	}
+
+	if config.Leases.Addr != "" && config.Leases.Ttl < 3 {
+		log.Printf("Lease ttl must be at least 3 seconds, got %d", config.Leases.Ttl)
+		os.Exit(1)
+	}
+
+	if config.Discover.Addr != "" && config.Discover.Threshold < 1 {
+		log.Printf("Discover threshold must be positive, got %d", config.Discover.Threshold)
+		os.Exit(1)
+	}
+
+	if sc := config.Seen; sc.Capacity > 0 && (sc.FalsePositive <= 0 || sc.FalsePositive >= 1 || sc.Rebuild <= 0) {
+		log.Printf("Seen filter false positive rate must be between 0 and 1 and rebuild positive, got %g and %d", sc.FalsePositive, sc.Rebuild)
+		os.Exit(1)
+	}
+
+	if config.Backlog.Interval <= 0 {
+		log.Printf("Backlog interval must be positive, got %d", config.Backlog.Interval)
+		os.Exit(1)
+	}
+
+	if config.Rank.HalfLife <= 0 {
+		log.Printf("Rank halflife must be positive, got %g", config.Rank.HalfLife)
+		os.Exit(1)
+	}
+
+	if config.Fetcher.Image.Batch.Min < 1 || config.Fetcher.Image.Batch.Max < config.Fetcher.Image.Batch.Min {
+		log.Printf("Image batch bounds must satisfy 1 <= min <= max, got %d and %d", config.Fetcher.Image.Batch.Min, config.Fetcher.Image.Batch.Max)
+		os.Exit(1)
+	}
+
+	if err := config.Normalize.Validate(); err != nil {
+		log.Printf("Invalid normalization: %s", err.Error())
+		os.Exit(1)
+	}
+
+	for pid, fc := range config.Feeds {
+		transforms, err := ingest.CompileTransforms(fc.Transforms)
+		if err != nil {
+			log.Printf("Invalid transform for feed %s: %s", pid, err.Error())
+			os.Exit(1)
+		}
+
+		pipeline := &ingest.Pipeline{
+			Transforms:  transforms,
+			Dedup:       fc.Dedup,
+			DedupWindow: fc.DedupWindow,
+			Event:       fc.Event,
+			Normalize:   config.Normalize,
+		}
+		if fc.Normalize != nil {
+			if err := fc.Normalize.Validate(); err != nil {
+				log.Printf("Invalid normalization for feed %s: %s", pid, err.Error())
+				os.Exit(1)
+			}
+			pipeline.Normalize = *fc.Normalize
+		}
+		feedPipelines[datastore.PidType(pid)] = pipeline
+
+		if fc.Timezone != "" {
+			loc, err := time.LoadLocation(fc.Timezone)
+			if err != nil {
+				log.Printf("Unknown timezone %s for feed %s", fc.Timezone, pid)
+				os.Exit(1)
+			}
+			pipeline.Location = loc
+			pipeline.ForceLocation = fc.ForceZone
+		}
+
+		if fc.Script != "" {
+			script, err := loadScript(fc.Script)
+			if err != nil {
+				log.Printf("Could not load script for feed %s: %s", pid, err.Error())
+				os.Exit(1)
+			}
+			pipeline.Script = script
+		}
+
+		if !ingest.ValidDedupStrategy(fc.Dedup) {
+			log.Printf("Unknown dedup strategy %s for feed %s", fc.Dedup, pid)
+			os.Exit(1)
+		}
+
+		if !ingest.ValidEvent(fc.Event) {
+			log.Printf("Unknown event time %s for feed %s", fc.Event, pid)
+			os.Exit(1)
+		}
+
+		if fc.Insecure {
+			log.Printf("Feed %s will be fetched without verifying certificates", pid)
+		}
+
+		if err := fc.Auth.validate(); err != nil {
+			log.Printf("Invalid auth for feed %s: %s", pid, err.Error())
+			os.Exit(1)
+		}
+
+		if !validTrustTier(fc.Trust) {
+			log.Printf("Unknown trust tier %s for feed %s", fc.Trust, pid)
+			os.Exit(1)
+		}
+
+		if gf := fc.Geofence; gf.Action != "" && gf.Action != "drop" && gf.Action != "downrank" {
+			log.Printf("Unknown geofence action %s for feed %s", gf.Action, pid)
+			os.Exit(1)
+		}
+		if err := fc.Geofence.validate(); err != nil {
+			log.Printf("Invalid geofence for feed %s: %s", pid, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err := initProxies(); err != nil {
+		log.Printf("Invalid proxy: %s", err.Error())
+		os.Exit(1)
+	}
+
+	if allowHosts != "" {
+		config.Fetcher.Http.Allow = append(config.Fetcher.Http.Allow, strings.Split(allowHosts, ",")...)
+	}
+	if err := initAllowlist(); err != nil {
+		log.Printf("Invalid allowlist: %s", err.Error())
+		os.Exit(1)
+	}
+
+	for pid, vp := range config.Virtual {
+		if err := checkBbox(vp.Bbox); err != nil {
+			log.Printf("Invalid virtual profile %s: %s", pid, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err := registerPlugins(); err != nil {
+		log.Printf("Invalid plugin configuration: %s", err.Error())
+		os.Exit(1)
+	}
+	if err := checkDocumentConfig(); err != nil {
+		log.Printf("Invalid document configuration: %s", err.Error())
+		os.Exit(1)
+	}
+	if err := checkSloConfig(); err != nil {
+		log.Printf("Invalid slo configuration: %s", err.Error())
+		os.Exit(1)
+	}
+
+	if config.Shadow.Sample < 0 || config.Shadow.Sample > 1 {
+		log.Printf("Shadow parser sample must be between 0 and 1, got %g", config.Shadow.Sample)
+		os.Exit(1)
+	}
+
+	if config.Hosts == nil {
+		config.Hosts = make(map[string]HostConfig)
+	}
+	for _, host := range strings.Split(ownedHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hc := config.Hosts[host]
+			hc.Owned = true
+			config.Hosts[host] = hc
+		}
+	}
+
+	if r := config.Fetcher.Image.Robots; r != "obey" && r != "flag" && r != "ignore" {
+		log.Printf("Unknown robots handling %s", r)
+		os.Exit(1)
+	}
+
+	for host, hc := range config.Hosts {
+		if _, exists := config.Politeness[hc.Politeness]; hc.Politeness != "" && !exists {
+			log.Printf("Unknown politeness profile %s for host %s", hc.Politeness, host)
+			os.Exit(1)
+		}
+	}
+
+	if !validFamily(config.Dns.Family) {
+		log.Printf("Unknown address family %s", config.Dns.Family)
+		os.Exit(1)
+	}
+
+	if r := config.Links.Rewrite; r != "" && r != "final" && r != "canonical" {
+		log.Printf("Unknown link rewrite %s", r)
+		os.Exit(1)
+	}
+
+	if imageProxyEnabled() {
+		if config.Image.Proxy.Style != "imgproxy" && config.Image.Proxy.Style != "thumbor" {
+			log.Printf("Unknown image proxy style %s", config.Image.Proxy.Style)
+			os.Exit(1)
+		}
+		if _, err := imageProxyUrl(""); err != nil {
+			log.Printf("Could not configure image proxy: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if len(config.Image.Replicas) > 0 && imageProxyEnabled() {
+		log.Printf("Image replicas cannot be used with an image proxy, which stores no images")
+		os.Exit(1)
+	}
+	for _, target := range config.Image.Replicas {
+		if _, err := newImageReplica(target); err != nil {
+			log.Printf("Could not configure image replica: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if config.Webhook.Format != "full" && config.Webhook.Format != "simple" {
+		log.Printf("Unknown webhook format %s", config.Webhook.Format)
+		os.Exit(1)
+	}
+
+	if (config.ActivityPub.Enabled || config.WebSub.Hub != "") && (config.Api.Listen == "" || config.Api.BaseUrl == "") {
+		log.Printf("ActivityPub and WebSub publishing require the query API listen address and base url")
+		os.Exit(1)
+	}
+	if config.Api.AdminListen != "" {
+		if err := checkAdminListen(config.Api.AdminListen); err != nil {
+			log.Printf("Invalid admin API configuration: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
 }
 
 func checkEnvironment() {
-	f, err := os.Open(config.Image.Path)
+	if !imageProxyEnabled() {
+		checkDirectory("image", config.Image.Path)
+	}
+	for _, target := range config.Image.Replicas {
+		if replica, err := newImageReplica(target); err == nil {
+			if dr, ok := replica.(*dirReplica); ok {
+				checkDirectory("image replica", dr.dir)
+			}
+		}
+	}
+	checkDirectory("metadata", config.Meta.Path)
+	if config.Document.Path != "" {
+		checkDirectory("document", config.Document.Path)
+	}
+}
+
+func checkDirectory(name string, dir string) {
+	f, err := os.Open(dir)
 	if err != nil {
-		log.Printf("Could not open image path %s: %s", config.Image.Path, err.Error())
+		log.Printf("Could not open %s path %s: %s", name, dir, err.Error())
 		os.Exit(1)
 	}
 	defer f.Close()
 	fi, err := f.Stat()
 	if err != nil {
-		log.Printf("Could not stat image path %s: %s", config.Image.Path, err.Error())
+		log.Printf("Could not stat %s path %s: %s", name, dir, err.Error())
 		os.Exit(1)
 	}
 
 	if !fi.IsDir() {
-		log.Printf("Image path is not a directory %s: %s", config.Image.Path, err.Error())
+		log.Printf("The %s path is not a directory %s", name, dir)
 		os.Exit(1)
 	}
 
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/placetime/datastore"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Feeds with cookies enabled are fetched with a cookie jar of their own,
+// for sites that hand out a session cookie on the first request and refuse
+// requests without it. The cookies are persisted so they survive between
+// fetches and restarts.
+type StoredCookie struct {
+	Url    string       `json:"url"`
+	Cookie *http.Cookie `json:"cookie"`
+}
+
+type CookieStore struct {
+	mu       sync.Mutex
+	filename string
+	cookies  map[datastore.PidType]map[string]*StoredCookie
+	jars     map[datastore.PidType]*FeedCookieJar
+}
+
+var feedCookies = &CookieStore{
+	cookies: make(map[datastore.PidType]map[string]*StoredCookie),
+	jars:    make(map[datastore.PidType]*FeedCookieJar),
+}
+
+func loadFeedCookies() {
+	feedCookies.filename = config.Fetcher.Cookies
+	if feedCookies.filename == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(feedCookies.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not read cookies %s: %s", feedCookies.filename, err.Error())
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &feedCookies.cookies); err != nil {
+		log.Printf("Could not read cookies %s, starting afresh: %s", feedCookies.filename, err.Error())
+		feedCookies.cookies = make(map[datastore.PidType]map[string]*StoredCookie)
+	}
+}
+
+// Must be called with the lock held
+func (cs *CookieStore) save() {
+	if cs.filename == "" {
+		return
+	}
+
+	data, err := json.Marshal(cs.cookies)
+	if err == nil {
+		if err = ioutil.WriteFile(cs.filename+".tmp", data, 0600); err == nil {
+			err = os.Rename(cs.filename+".tmp", cs.filename)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not write cookies %s: %s", cs.filename, err.Error())
+	}
+}
+
+// The jar of a profile's feed, filled with its stored cookies when first
+// used
+func (cs *CookieStore) Jar(pid datastore.PidType) *FeedCookieJar {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if jar, exists := cs.jars[pid]; exists {
+		return jar
+	}
+
+	// Without a public suffix list cookies are only ever sent back to the
+	// host that set them, which is all a feed needs
+	inner, _ := cookiejar.New(nil)
+	jar := &FeedCookieJar{jar: inner, store: cs, pid: pid}
+	now := time.Now()
+	for key, sc := range cs.cookies[pid] {
+		u, err := url.Parse(sc.Url)
+		if err != nil || (!sc.Cookie.Expires.IsZero() && sc.Cookie.Expires.Before(now)) {
+			delete(cs.cookies[pid], key)
+			continue
+		}
+		inner.SetCookies(u, []*http.Cookie{sc.Cookie})
+	}
+	cs.jars[pid] = jar
+	return jar
+}
+
+// Must be called with the lock held
+func (cs *CookieStore) record(pid datastore.PidType, u *url.URL, cookies []*http.Cookie) {
+	stored, exists := cs.cookies[pid]
+	if !exists {
+		stored = make(map[string]*StoredCookie)
+		cs.cookies[pid] = stored
+	}
+
+	now := time.Now()
+	for _, c := range cookies {
+		key := c.Domain + ";" + c.Path + ";" + c.Name
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+			delete(stored, key)
+			continue
+		}
+		kept := *c
+		if c.MaxAge > 0 {
+			// The jar counts max-age from now, which is lost on reload
+			kept.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+			kept.MaxAge = 0
+		}
+		stored[key] = &StoredCookie{Url: u.String(), Cookie: &kept}
+	}
+	cs.save()
+}
+
+// FeedCookieJar is a cookie jar that records the cookies it is given in the
+// cookie store
+type FeedCookieJar struct {
+	jar   *cookiejar.Jar
+	store *CookieStore
+	pid   datastore.PidType
+}
+
+func (j *FeedCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.store.mu.Lock()
+	defer j.store.mu.Unlock()
+	j.store.record(j.pid, u, cookies)
+}
+
+func (j *FeedCookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// The client to fetch a profile's feed with, which carries the profile's
+// cookies when it has them enabled and skips certificate checks for a feed
+// marked insecure
+func feedClient(pid datastore.PidType) *http.Client {
+	fc := config.Feeds[string(pid)]
+	base := fetchClient
+	if fc.Insecure {
+		base = insecureClient
+	}
+	if !fc.Cookies {
+		return base
+	}
+	client := *base
+	client.Jar = feedCookies.Jar(pid)
+	return &client
+}
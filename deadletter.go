@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/placetime/datastore"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jobs that keep failing are moved to a dead letter queue rather than being
+// retried forever or dropped. A feed lands there after too many consecutive
+// failed fetches and is not fetched again until it is redriven. An image
+// job lands there when no image could be picked for the item.
+//
+// The queue is a JSON file so that it can be inspected and redriven from
+// the command line while the fetcher is running; it is re-read whenever the
+// file changes. A running fetcher makes a feed due again when it finds its
+// letter gone from the file, and at startup for any feed left at its
+// failure limit without a letter, as a redrive from the command line cannot
+// change the fetcher's schedule itself.
+const (
+	deadFeed  = "feed"
+	deadImage = "image"
+)
+
+type DeadLetter struct {
+	Id       string               `json:"id"`
+	Kind     string               `json:"kind"`
+	Pid      datastore.PidType    `json:"pid,omitempty"`
+	ItemId   datastore.ItemIdType `json:"itemid,omitempty"`
+	Url      string               `json:"url"`
+	Error    string               `json:"error"`
+	Failures int                  `json:"failures,omitempty"`
+	Added    int64                `json:"added"`
+}
+
+type DeadLetterStore struct {
+	mu       sync.Mutex
+	filename string
+	modified time.Time
+	letters  map[string]*DeadLetter
+
+	// Feeds whose letters were removed from the file by another process
+	redriven []datastore.PidType
+}
+
+var deadLetters = &DeadLetterStore{letters: make(map[string]*DeadLetter)}
+
+func deadLetterId(kind string, key string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(kind+"\n"+key)))[:12]
+}
+
+// Must be called with the lock held
+func (dl *DeadLetterStore) refresh() {
+	if dl.filename == "" {
+		return
+	}
+
+	fi, err := os.Stat(dl.filename)
+	if err != nil || !fi.ModTime().After(dl.modified) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(dl.filename)
+	if err != nil {
+		log.Printf("Could not read dead letters %s: %s", dl.filename, err.Error())
+		return
+	}
+
+	letters := make(map[string]*DeadLetter)
+	if err := json.Unmarshal(data, &letters); err != nil {
+		log.Printf("Could not read dead letters %s: %s", dl.filename, err.Error())
+		return
+	}
+	for id, letter := range dl.letters {
+		if _, exists := letters[id]; !exists && letter.Kind == deadFeed {
+			dl.redriven = append(dl.redriven, letter.Pid)
+		}
+	}
+	dl.letters = letters
+	dl.modified = fi.ModTime()
+}
+
+// Must be called with the lock held
+func (dl *DeadLetterStore) save() {
+	if dl.filename == "" {
+		return
+	}
+
+	data, err := json.Marshal(dl.letters)
+	if err == nil {
+		if err = ioutil.WriteFile(dl.filename+".tmp", data, 0644); err == nil {
+			err = os.Rename(dl.filename+".tmp", dl.filename)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not write dead letters %s: %s", dl.filename, err.Error())
+		return
+	}
+	if fi, err := os.Stat(dl.filename); err == nil {
+		dl.modified = fi.ModTime()
+	}
+}
+
+func (dl *DeadLetterStore) Add(letter *DeadLetter) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.refresh()
+
+	letter.Added = time.Now().Unix()
+	dl.letters[letter.Id] = letter
+	dl.save()
+
+	log.Printf("Moved %s job for %s to the dead letter queue: %s", letter.Kind, letter.Url, letter.Error)
+	countMetric("deadletter."+letter.Kind, 1)
+}
+
+func (dl *DeadLetterStore) AddFeed(pid datastore.PidType, url string, err error, failures int) {
+	dl.Add(&DeadLetter{
+		Id:       deadLetterId(deadFeed, string(pid)),
+		Kind:     deadFeed,
+		Pid:      pid,
+		Url:      url,
+		Error:    err.Error(),
+		Failures: failures,
+	})
+}
+
+func (dl *DeadLetterStore) AddImage(itemId datastore.ItemIdType, url string, err error) {
+	dl.Add(&DeadLetter{
+		Id:     deadLetterId(deadImage, string(itemId)),
+		Kind:   deadImage,
+		ItemId: itemId,
+		Url:    url,
+		Error:  err.Error(),
+	})
+}
+
+func (dl *DeadLetterStore) HasFeed(pid datastore.PidType) bool {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.refresh()
+
+	_, exists := dl.letters[deadLetterId(deadFeed, string(pid))]
+	return exists
+}
+
+func (dl *DeadLetterStore) List() []*DeadLetter {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.refresh()
+
+	list := make([]*DeadLetter, 0, len(dl.letters))
+	for _, letter := range dl.letters {
+		list = append(list, letter)
+	}
+	sort.Sort(byDeadLetterAdded(list))
+	return list
+}
+
+// Remove a letter from the queue, returning it
+func (dl *DeadLetterStore) Take(id string) *DeadLetter {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.refresh()
+
+	letter, exists := dl.letters[id]
+	if !exists {
+		return nil
+	}
+	delete(dl.letters, id)
+	dl.save()
+	return letter
+}
+
+// Take the feeds redriven by another process since the last call
+func (dl *DeadLetterStore) Redriven() []datastore.PidType {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.refresh()
+
+	redriven := dl.redriven
+	dl.redriven = nil
+	return redriven
+}
+
+type byDeadLetterAdded []*DeadLetter
+
+func (b byDeadLetterAdded) Len() int           { return len(b) }
+func (b byDeadLetterAdded) Less(i, j int) bool { return b[i].Added < b[j].Added }
+func (b byDeadLetterAdded) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func loadDeadLetters() {
+	deadLetters.filename = config.Fetcher.DeadLetters
+	deadLetters.mu.Lock()
+	deadLetters.refresh()
+	deadLetters.mu.Unlock()
+}
+
+// Make due again the feeds whose letters were redriven while the fetcher
+// was not running, and those redriven by another process since
+func resetRedrivenFeeds(startup bool) {
+	var pids []datastore.PidType
+	if startup {
+		for _, pid := range feedStates.Failing(config.Fetcher.Feed.MaxFailures) {
+			if !deadLetters.HasFeed(pid) {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	pids = append(pids, deadLetters.Redriven()...)
+
+	for _, pid := range pids {
+		log.Printf("Feed of profile %s was redriven, making it due", pid)
+		feedStates.Reset(pid)
+	}
+}
+
+// Take a letter off the queue and retry its job. Feeds are made due
+// immediately, or from the command line by the running fetcher once it
+// sees the letter gone; images are queued when a dispatcher is running or
+// picked straight away otherwise.
+func redrive(ctx context.Context, id string, images *Dispatcher) (*DeadLetter, error) {
+	letter := deadLetters.Take(id)
+	if letter == nil {
+		return nil, fmt.Errorf("no dead letter with id %s", id)
+	}
+
+	switch letter.Kind {
+	case deadFeed:
+		feedStates.Reset(letter.Pid)
+	case deadImage:
+		job := ImageJob{Url: letter.Url, ItemId: letter.ItemId}
+		if images != nil {
+			if err := images.Submit(ctx, letter.Pid, job); err != nil {
+				deadLetters.Add(letter)
+				return nil, err
+			}
+		} else {
+			job.Do(context.Background())
+		}
+	}
+
+	log.Printf("Redriven %s job for %s", letter.Kind, letter.Url)
+	return letter, nil
+}
+
+// Command line handling for -deadletters and -redrive
+func listDeadLetters() {
+	for _, letter := range deadLetters.List() {
+		fmt.Printf("%s  %-5s  %s  %s\n", letter.Id, letter.Kind, time.Unix(letter.Added, 0).Format(time.RFC3339), letter.Url)
+		fmt.Printf("    %s\n", letter.Error)
+	}
+}
+
+// Serves GET /deadletters and POST /deadletters/{id}/redrive, the last for
+// admins only
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/deadletters"), "/")
+	if path == "" {
+		writeJson(w, deadLetters.List())
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[1] != "redrive" || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	letter, err := redrive(r.Context(), parts[0], imageDispatcher)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJson(w, letter)
+}
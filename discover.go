@@ -0,0 +1,158 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sites that items keep linking to but that no profile follows are worth
+// suggesting to users when they have a feed. Each checked link to such a
+// site that advertises a feed is counted, and once a site has been linked
+// to Threshold times it is added to the suggestions the application offers.
+//
+// In redis, Prefix+"links" is a sorted set counting links per host,
+// Prefix+"feed:"+host a hash of the url and title of the host's feed and
+// Prefix+"suggestions" a sorted set of the hosts to suggest scored by how
+// often they are linked to.
+type DiscoverConfig struct {
+	Addr      string `toml:"addr"` // host:port of the redis server, empty to disable
+	Prefix    string `toml:"prefix"`
+	Threshold int    `toml:"threshold"`
+}
+
+var (
+	discoverPool *redis.Pool
+
+	// Hosts of the feeds profiles already follow
+	followedMutex sync.RWMutex
+	followedHosts map[string]bool
+)
+
+var feedLinkTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+}
+
+func initDiscover() {
+	if config.Discover.Addr == "" {
+		return
+	}
+
+	discoverPool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.Discover.Addr)
+		},
+	}
+	log.Printf("Suggesting feeds in redis at %s", config.Discover.Addr)
+}
+
+// A host as it is compared for following, without any www. prefix
+func discoverHost(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// Note the hosts of the feeds the feed driven profiles follow
+func setFollowedHosts(profiles []*datastore.Profile) {
+	hosts := make(map[string]bool)
+	for _, p := range profiles {
+		hosts[discoverHost(feedStates.FeedUrl(p.Pid, p.FeedUrl))] = true
+		for _, u := range config.Feeds[string(p.Pid)].Urls {
+			hosts[discoverHost(u)] = true
+		}
+	}
+
+	followedMutex.Lock()
+	followedHosts = hosts
+	followedMutex.Unlock()
+
+	if discoverPool == nil {
+		return
+	}
+
+	// Sites that have since been followed are no longer suggestions
+	conn := discoverPool.Get()
+	defer conn.Close()
+	args := redis.Args{config.Discover.Prefix + "suggestions"}
+	for host := range hosts {
+		args = args.Add(host)
+	}
+	if _, err := conn.Do("ZREM", args...); err != nil {
+		log.Printf("Failed to clear followed suggestions: %s", err.Error())
+	}
+}
+
+func followed(host string) bool {
+	followedMutex.RLock()
+	defer followedMutex.RUnlock()
+	return followedHosts[host]
+}
+
+// The url and title of the first feed a page advertises
+func feedLink(page []byte, base string) (string, string) {
+	for _, attrs := range linkTags(page) {
+		if strings.ToLower(attrs["rel"]) != "alternate" || !feedLinkTypes[strings.ToLower(attrs["type"])] {
+			continue
+		}
+		if href := resolveHref(attrs["href"], base); href != "" {
+			return href, attrs["title"]
+		}
+	}
+	return "", ""
+}
+
+// Count a checked link towards suggesting its site's feed
+func recordDiscovery(ls *LinkStatus) {
+	if discoverPool == nil || ls.IsDead() || ls.Paywalled {
+		return
+	}
+
+	host := discoverHost(ls.FinalUrl)
+	if host == "" || followed(host) {
+		return
+	}
+	feed, title := feedLink(ls.Peek, ls.FinalUrl)
+	if feed == "" || followed(discoverHost(feed)) {
+		return
+	}
+
+	conn := discoverPool.Get()
+	defer conn.Close()
+
+	prefix := config.Discover.Prefix
+	links, err := redis.Int(conn.Do("ZINCRBY", prefix+"links", 1, host))
+	if err != nil {
+		log.Printf("Failed to count link to %s: %s", host, err.Error())
+		return
+	}
+
+	args := redis.Args{prefix + "feed:" + host}.Add("url", feed, "updated", time.Now().Unix())
+	if title != "" {
+		args = args.Add("title", title)
+	}
+	if _, err := conn.Do("HSET", args...); err != nil {
+		log.Printf("Failed to record feed of %s: %s", host, err.Error())
+		return
+	}
+
+	if links >= config.Discover.Threshold {
+		if links == config.Discover.Threshold {
+			log.Printf("Suggesting feed %s, linked to %d times", feed, links)
+			countMetric("discover.suggested", 1)
+		}
+		if _, err := conn.Do("ZADD", prefix+"suggestions", links, host); err != nil {
+			log.Printf("Failed to suggest feed of %s: %s", host, err.Error())
+		}
+	}
+}
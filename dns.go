@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How the fetcher finds and connects to hosts. Family is any, ipv4 or ipv6
+// and decides which addresses are tried first; with any, IPv6 addresses are
+// tried first when a host has them. When the first attempt has not connected
+// after FallbackDelay milliseconds an attempt on the other family is raced
+// against it (Happy Eyeballs, RFC 8305); a negative delay tries addresses
+// one at a time.
+//
+// With Cache, lookups are answered from memory for as long as the records'
+// TTL allows, clamped to between MinTtl and MaxTtl seconds. Concurrent
+// lookups of the same host share one query. When a lookup fails, addresses
+// that expired less than Stale seconds ago are used rather than failing the
+// fetch. Servers are the resolvers queried, defaulting to those in
+// /etc/resolv.conf. Hits, misses and stale answers are counted in the
+// dns.hits, dns.misses and dns.stale metrics.
+type DnsConfig struct {
+	Family        string   `toml:"family"`
+	FallbackDelay int      `toml:"fallbackdelay"`
+	Cache         bool     `toml:"cache"`
+	MinTtl        int      `toml:"minttl"`
+	MaxTtl        int      `toml:"maxttl"`
+	Stale         int      `toml:"stale"`
+	Servers       []string `toml:"servers"`
+}
+
+func validFamily(family string) bool {
+	return family == "any" || family == "ipv4" || family == "ipv6"
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// A lookup in progress, which later lookups of the same host wait for
+type dnsLookup struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+type DnsCache struct {
+	mu       sync.Mutex
+	entries  map[string]*dnsEntry
+	inflight map[string]*dnsLookup
+	servers  []string
+	swept    time.Time
+}
+
+var dnsCache = &DnsCache{
+	entries:  make(map[string]*dnsEntry),
+	inflight: make(map[string]*dnsLookup),
+}
+
+func initDnsCache() {
+	dnsCache.servers = config.Dns.Servers
+	if len(dnsCache.servers) == 0 {
+		if cc, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil {
+			for _, s := range cc.Servers {
+				dnsCache.servers = append(dnsCache.servers, net.JoinHostPort(s, cc.Port))
+			}
+		}
+	}
+	for i, s := range dnsCache.servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			dnsCache.servers[i] = net.JoinHostPort(s, "53")
+		}
+	}
+}
+
+func (dc *DnsCache) Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+
+	dc.mu.Lock()
+	dc.sweep(now)
+	entry, exists := dc.entries[host]
+	if exists && now.Before(entry.expires) {
+		dc.mu.Unlock()
+		countMetric("dns.hits", 1)
+		return entry.ips, nil
+	}
+
+	lookup, waiting := dc.inflight[host]
+	if !waiting {
+		lookup = &dnsLookup{done: make(chan struct{})}
+		dc.inflight[host] = lookup
+	}
+	dc.mu.Unlock()
+	countMetric("dns.misses", 1)
+
+	if waiting {
+		select {
+		case <-lookup.done:
+			return lookup.ips, lookup.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ips, ttl, err := dc.resolve(ctx, host)
+
+	stale := false
+	dc.mu.Lock()
+	if err != nil && exists && time.Since(entry.expires) < time.Duration(config.Dns.Stale)*time.Second {
+		// Better an address that was right a moment ago than no fetch
+		log.Printf("Using expired addresses for %s: %s", host, err.Error())
+		ips, err, stale = entry.ips, nil, true
+	} else if err == nil {
+		if ttl < config.Dns.MinTtl {
+			ttl = config.Dns.MinTtl
+		}
+		if config.Dns.MaxTtl > 0 && ttl > config.Dns.MaxTtl {
+			ttl = config.Dns.MaxTtl
+		}
+		dc.entries[host] = &dnsEntry{ips: ips, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	}
+	delete(dc.inflight, host)
+	dc.mu.Unlock()
+	if stale {
+		countMetric("dns.stale", 1)
+	}
+
+	lookup.ips, lookup.err = ips, err
+	close(lookup.done)
+	return ips, err
+}
+
+// Drop entries too old to be used even when stale, at most once a minute.
+// Must be called with the lock held.
+func (dc *DnsCache) sweep(now time.Time) {
+	if now.Sub(dc.swept) < time.Minute {
+		return
+	}
+	dc.swept = now
+
+	stale := time.Duration(config.Dns.Stale) * time.Second
+	for host, entry := range dc.entries {
+		if now.Sub(entry.expires) > stale {
+			delete(dc.entries, host)
+		}
+	}
+}
+
+// Query the resolvers for a host's addresses, returning the smallest TTL
+// among the records found
+func (dc *DnsCache) resolve(ctx context.Context, host string) ([]net.IP, int, error) {
+	if len(dc.servers) == 0 {
+		// Without known resolvers the record TTLs cannot be seen
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			ips[i] = a.IP
+		}
+		return ips, 0, nil
+	}
+
+	var ips []net.IP
+	ttl := -1
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		// Both families are looked up whatever the preference, the other
+		// is needed when a host has no addresses in the preferred one
+		answer, err := dc.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range answer {
+			var ip net.IP
+			switch r := rr.(type) {
+			case *dns.A:
+				ip = r.A
+			case *dns.AAAA:
+				ip = r.AAAA
+			default:
+				continue
+			}
+			ips = append(ips, ip)
+			if t := int(rr.Header().Ttl); ttl < 0 || t < ttl {
+				ttl = t
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+func (dc *DnsCache) query(ctx context.Context, host string, qtype uint16) ([]dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+	msg.RecursionDesired = true
+
+	client := &dns.Client{Timeout: 5 * time.Second}
+	var lastErr error
+	for _, server := range dc.servers {
+		reply, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("resolver %s answered %s for %s", server, dns.RcodeToString[reply.Rcode], host)
+			continue
+		}
+		return reply.Answer, nil
+	}
+	return nil, lastErr
+}
+
+// Order a host's addresses into those tried first and those raced against
+// them, by the preferred family
+func splitFamilies(ips []net.IP) ([]net.IP, []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	if config.Dns.Family == "ipv4" || len(v6) == 0 {
+		return v4, v6
+	}
+	return v6, v4
+}
+
+// Resolve a host through the cache when it is enabled
+func lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if config.Dns.Cache {
+		return dnsCache.Lookup(ctx, host)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+type dialResult struct {
+	conn    net.Conn
+	err     error
+	primary bool
+}
+
+// Dial a host by name, resolving it through the cache and connecting with
+// Happy Eyeballs
+func dialHost(ctx context.Context, dialer *net.Dialer, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if !isProxyHost(host) {
+		if err := checkAddresses(host, ips); err != nil {
+			return nil, err
+		}
+	}
+
+	primaries, fallbacks := splitFamilies(ips)
+	if len(fallbacks) == 0 || config.Dns.FallbackDelay < 0 {
+		return dialSerial(ctx, dialer, network, append(primaries, fallbacks...), port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	race := func(ips []net.IP, primary bool) {
+		conn, err := dialSerial(ctx, dialer, network, ips, port)
+		results <- dialResult{conn: conn, err: err, primary: primary}
+	}
+	go race(primaries, true)
+
+	fallback := time.NewTimer(time.Duration(config.Dns.FallbackDelay) * time.Millisecond)
+	defer fallback.Stop()
+
+	pending := 1
+	fallbackStarted := false
+	var firstErr error
+	for {
+		select {
+		case <-fallback.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks, false)
+			}
+
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close whichever attempt loses the race
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks, false)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func dialSerial(ctx context.Context, dialer *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses to dial")
+	}
+	return nil, lastErr
+}
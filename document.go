@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/placetime/datastore"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Items often link straight to documents, such as council agendas and
+// reports published as PDFs, which have no feature image to pick. Such a
+// link is downloaded instead and its title, author and creation date read
+// from the document. With a document plugin the first page is rendered as
+// the item's image and written to Path, from where the query API serves it
+// at /documents/; otherwise the item gets the placeholder image.
+type DocumentConfig struct {
+	Path string `toml:"path"`
+}
+
+// What is known of the document an item links to
+type ItemDocument struct {
+	Type    string `json:"type"`
+	Title   string `json:"title,omitempty"`
+	Author  string `json:"author,omitempty"`
+	Pages   int    `json:"pages,omitempty"`
+	Created int64  `json:"created,omitempty"`
+}
+
+var documentTypes = map[string]bool{
+	"application/pdf":    true,
+	"application/msword": true,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+	"application/vnd.oasis.opendocument.text":                                   true,
+}
+
+var (
+	pdfInfoPattern  = regexp.MustCompile(`/(Title|Author|CreationDate)\s*(\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>)`)
+	pdfPagePattern  = regexp.MustCompile(`/Type\s*/Page[^s]`)
+	pdfDatePattern  = regexp.MustCompile(`^D:(\d{4})(\d{2})?(\d{2})?(\d{2})?(\d{2})?(\d{2})?`)
+	xmpTitlePattern = regexp.MustCompile(`(?is)<dc:title>.*?<rdf:li[^>]*>(.*?)</rdf:li>`)
+)
+
+func isDocument(ls *LinkStatus) bool {
+	return ls != nil && documentTypes[ls.ContentType]
+}
+
+// Download a linked document and read what it says of itself, rendering
+// its first page when a document plugin is configured. Returns the url of
+// the rendered page and its image data, both empty when there is none.
+func inspectDocument(ctx context.Context, id datastore.ItemIdType, ls *LinkStatus) (*ItemDocument, string, []byte) {
+	doc := &ItemDocument{Type: ls.ContentType}
+	body, err := fetchImage(ctx, ls.FinalUrl)
+	if err != nil {
+		log.Printf("Image job failed to fetch document %s: %s", ls.FinalUrl, err.Error())
+		countMetric("document.errors", 1)
+		return doc, "", nil
+	}
+	if doc.Type == "application/pdf" {
+		readPdfInfo(body, doc)
+	}
+	countMetric("document.found", 1)
+
+	if documentPlugin == nil {
+		return doc, "", nil
+	}
+	reply, err := documentPlugin.Render(ctx, PluginRenderArgs{Url: ls.FinalUrl, Type: doc.Type, Body: body})
+	if err != nil {
+		log.Printf("Image job failed to render document %s: %s", ls.FinalUrl, err.Error())
+		countMetric("document.errors", 1)
+		return doc, "", nil
+	}
+	doc.Title = firstNonEmpty(doc.Title, reply.Title)
+	doc.Author = firstNonEmpty(doc.Author, reply.Author)
+	if reply.Pages > 0 {
+		doc.Pages = reply.Pages
+	}
+	if len(reply.Image) == 0 {
+		return doc, "", nil
+	}
+
+	name, err := writeDocumentImage(id, reply.Image)
+	if err != nil {
+		log.Printf("Image job failed to write rendered page of %s: %s", ls.FinalUrl, err.Error())
+		countMetric("document.errors", 1)
+		return doc, "", nil
+	}
+	countMetric("document.rendered", 1)
+	return doc, apiUrl("/documents/" + name), reply.Image
+}
+
+func writeDocumentImage(id datastore.ItemIdType, data []byte) (string, error) {
+	ext := ".png"
+	if http.DetectContentType(data) == "image/jpeg" {
+		ext = ".jpg"
+	}
+	name := string(id) + ext
+	filename := filepath.Join(config.Document.Path, name)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return "", err
+	}
+	return name, os.Rename(filename+".tmp", filename)
+}
+
+func registerDocuments(mux *http.ServeMux) {
+	mux.Handle("/documents/", http.StripPrefix("/documents/", http.FileServer(http.Dir(config.Document.Path))))
+}
+
+// Read the title, author, creation date and page count a PDF gives in its
+// document information dictionary or XMP metadata. Documents whose objects
+// are all compressed give nothing away without a full parser and are left
+// to the document plugin.
+func readPdfInfo(body []byte, doc *ItemDocument) {
+	for _, m := range pdfInfoPattern.FindAllSubmatch(body, -1) {
+		value := strings.TrimSpace(pdfString(m[2]))
+		switch string(m[1]) {
+		case "Title":
+			doc.Title = firstNonEmpty(doc.Title, value)
+		case "Author":
+			doc.Author = firstNonEmpty(doc.Author, value)
+		case "CreationDate":
+			if doc.Created == 0 {
+				doc.Created = pdfDate(value)
+			}
+		}
+	}
+	if doc.Title == "" {
+		if m := xmpTitlePattern.FindSubmatch(body); m != nil {
+			doc.Title = strings.TrimSpace(string(m[1]))
+		}
+	}
+	doc.Pages = len(pdfPagePattern.FindAll(body, -1))
+}
+
+// Decode a PDF literal or hex string, which is UTF-16 when it starts with a
+// byte order mark and otherwise taken as Latin-1
+func pdfString(s []byte) string {
+	var raw []byte
+	if s[0] == '<' {
+		raw, _ = hex.DecodeString(strings.Join(strings.Fields(string(s[1:len(s)-1])), ""))
+	} else {
+		raw = pdfUnescape(s[1 : len(s)-1])
+	}
+
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		units := make([]uint16, 0, len(raw)/2)
+		for i := 2; i+1 < len(raw); i += 2 {
+			units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func pdfUnescape(s []byte) []byte {
+	var out bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			out.WriteByte('\n')
+		case 'r':
+			out.WriteByte('\r')
+		case 't':
+			out.WriteByte('\t')
+		case 'b':
+			out.WriteByte('\b')
+		case 'f':
+			out.WriteByte('\f')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			end := i + 1
+			for end < len(s) && end < i+3 && s[end] >= '0' && s[end] <= '7' {
+				end++
+			}
+			n, _ := strconv.ParseUint(string(s[i:end]), 8, 8)
+			out.WriteByte(byte(n))
+			i = end - 1
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.Bytes()
+}
+
+// Unix time of a PDF date such as D:20240131120000Z, taken as UTC
+func pdfDate(s string) int64 {
+	m := pdfDatePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	parts := []int{0, 1, 1, 0, 0, 0}
+	for i := range parts {
+		if m[i+1] != "" {
+			parts[i], _ = strconv.Atoi(m[i+1])
+		}
+	}
+	return time.Date(parts[0], time.Month(parts[1]), parts[2], parts[3], parts[4], parts[5], 0, time.UTC).Unix()
+}
+
+// Whether an item's title says nothing more than where its document is,
+// so the document's own title is better
+func untitledDocument(title string, link string) bool {
+	title = strings.TrimSpace(title)
+	if title == "" || title == link {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(title))
+	return ext == ".pdf" || ext == ".doc" || ext == ".docx" || ext == ".odt" || ext == ".pptx"
+}
+
+func checkDocumentConfig() error {
+	if documentPlugin == nil {
+		return nil
+	}
+	if config.Document.Path == "" || config.Api.Listen == "" || config.Api.BaseUrl == "" {
+		return fmt.Errorf("rendering documents requires a document path and the query API listen address and base url")
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// The content codings the fetcher can decode. Some large publishers only
+// compress for clients that ask for brotli.
+const acceptEncoding = "br, gzip, deflate"
+
+// DecodingTransport asks for compressed responses and decodes them, so that
+// everything above it sees the decoded body. Go's transport only does this
+// for gzip and only while the caller sets no Accept-Encoding of its own.
+type DecodingTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t *DecodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A range applies to the encoded body, so resumed downloads ask for the
+	// body as it is
+	if req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil || req.Method == "HEAD" {
+		return resp, err
+	}
+
+	coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if coding == "" || coding == "identity" {
+		return resp, nil
+	}
+
+	wire := &wireCounter{r: resp.Body}
+	var decoded io.Reader
+	switch coding {
+	case "br":
+		decoded = brotli.NewReader(wire)
+	case "gzip", "x-gzip":
+		decoded = &lazyReader{open: func() (io.Reader, error) { return gzip.NewReader(wire) }}
+	case "deflate":
+		decoded = &lazyReader{open: func() (io.Reader, error) { return deflateReader(wire) }}
+	default:
+		// Not something we asked for, leave it to the caller
+		return resp, nil
+	}
+
+	resp.Body = &decodedBody{r: decoded, wire: wire, body: resp.Body, url: req.URL.Redacted(), coding: coding}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// Servers disagree about whether deflate means a zlib stream or raw deflate
+// data, so look at the header to tell
+func deflateReader(r io.Reader) (io.Reader, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	mr := io.MultiReader(strings.NewReader(string(header[:])), r)
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(mr)
+	}
+	return flate.NewReader(mr), nil
+}
+
+// Defers opening a decoder, which reads the stream header, until the body
+// is first read
+type lazyReader struct {
+	open func() (io.Reader, error)
+	r    io.Reader
+	err  error
+}
+
+func (lr *lazyReader) Read(p []byte) (int, error) {
+	if lr.r == nil && lr.err == nil {
+		lr.r, lr.err = lr.open()
+	}
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	return lr.r.Read(p)
+}
+
+type wireCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (wc *wireCounter) Read(p []byte) (int, error) {
+	n, err := wc.r.Read(p)
+	wc.n += int64(n)
+	return n, err
+}
+
+type decodedBody struct {
+	r       io.Reader
+	wire    *wireCounter
+	body    io.ReadCloser
+	url     string
+	coding  string
+	decoded int64
+	closed  int32
+}
+
+func (db *decodedBody) Read(p []byte) (int, error) {
+	n, err := db.r.Read(p)
+	db.decoded += int64(n)
+	return n, err
+}
+
+// Log what compression saved once the body is done with
+func (db *decodedBody) Close() error {
+	if atomic.CompareAndSwapInt32(&db.closed, 0, 1) {
+		log.Printf("Fetched %s with %s encoding, %d bytes on the wire and %d decoded", db.url, db.coding, db.wire.n, db.decoded)
+		countMetric("http.wirebytes", db.wire.n)
+		countMetric("http.decodedbytes", db.decoded)
+	}
+	return db.body.Close()
+}
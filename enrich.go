@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Ingestion stores items as soon as a feed is parsed. Everything slower,
+// such as picking images, is enrichment and runs from a separate queue on
+// its own workers so a backlog there cannot delay new items reaching
+// timelines. Enrichment jobs are queued either as high priority, for items
+// that have never been enriched, or low priority for maintenance work.
+type EnrichQueue struct {
+	High chan Job
+	Low  chan Job
+}
+
+func NewEnrichQueue() *EnrichQueue {
+	return &EnrichQueue{High: make(chan Job), Low: make(chan Job)}
+}
+
+func enrichWorker(ctx context.Context, wg *sync.WaitGroup, id int, q *EnrichQueue) {
+	defer wg.Done()
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Drain high priority work before considering anything else
+		select {
+		case job := <-q.High:
+			log.Printf("Enrichment worker %d processing job", id)
+			job.Do(ctx)
+			continue
+		default:
+		}
+
+		select {
+
+		case <-ctx.Done():
+			return
+
+		case job := <-q.High:
+			log.Printf("Enrichment worker %d processing job", id)
+			job.Do(ctx)
+
+		case job := <-q.Low:
+			log.Printf("Enrichment worker %d processing low priority job", id)
+			job.Do(ctx)
+		}
+	}
+}
+
+func pumpEnrichmentContinuous(ctx context.Context, images *Dispatcher, q *EnrichQueue) {
+	imageInterval := time.Duration(config.Fetcher.Image.Interval) * time.Second
+	log.Printf("Waiting %s seconds before fetching images", imageInterval)
+	imageTicker := time.NewTicker(imageInterval)
+
+	// A nil channel never fires, leaving the refresh pass disabled
+	var refreshTick <-chan time.Time
+	if config.Fetcher.Image.Refresh > 0 {
+		refreshInterval := time.Duration(config.Fetcher.Image.Refresh) * time.Second
+		log.Printf("Revalidating old images every %s", refreshInterval)
+		refreshTick = time.NewTicker(refreshInterval).C
+	}
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-imageTicker.C:
+			pumpImageJobs(ctx, images)
+
+		case <-refreshTick:
+			pumpImageRefreshJobs(ctx, q.Low)
+
+		}
+
+	}
+}
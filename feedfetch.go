@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"github.com/iand/feedparser"
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The ingest pipeline of each configured feed
+var feedPipelines = map[datastore.PidType]*ingest.Pipeline{}
+
+func feedPipeline(pid datastore.PidType) *ingest.Pipeline {
+	if p, exists := feedPipelines[pid]; exists {
+		return p
+	}
+	return &ingest.Pipeline{Normalize: config.Normalize}
+}
+
+// A feed as retrieved for a single RSS job
+type FetchedFeed struct {
+	Feed       *feedparser.Feed
+	Extensions ingest.FeedExtensions
+	Body       []byte
+	Header     http.Header
+	Fetched    int64
+	Snapshot   string
+	Attempts   int
+
+	// Identifies the content of the feed for spotting unchanged feeds that
+	// cannot be revalidated
+	Fingerprint string
+
+	// The server confirmed the copy fetched last time is still current,
+	// leaving Feed unset
+	NotModified bool
+
+	// Where the feed now lives when every redirect followed was permanent
+	MovedTo string
+
+	// The url each item merged in from another of the profile's feeds came
+	// from
+	Sources map[*feedparser.FeedItem]string
+}
+
+// The url of the feed an item came from
+func (ff *FetchedFeed) Source(item *feedparser.FeedItem, url string) string {
+	if source, exists := ff.Sources[item]; exists {
+		return source
+	}
+	return url
+}
+
+// Merge the items of the profile's further feeds into its main one. A feed
+// that fails is logged and left out rather than failing the whole fetch.
+// The further feeds are not revalidated, as only the main feed's
+// validators are kept.
+func (job RssJob) mergeFeeds(ctx context.Context, ff *FetchedFeed, urls []string) {
+	for _, url := range urls {
+		extra, err := RssJob{Url: url, Pid: job.Pid, ItemType: job.ItemType}.fetchFeed(ctx)
+		if err != nil {
+			log.Printf("RSS job failed to fetch merged feed %s: %s", redactedUrl(url), err.Error())
+			countMetric("feed.errors", 1)
+			continue
+		}
+		if extra.Feed == nil || len(extra.Feed.Items) == 0 {
+			continue
+		}
+		ff.appendItems(extra, url)
+	}
+}
+
+// Add the items of another feed, noting the url they came from
+func (ff *FetchedFeed) appendItems(extra *FetchedFeed, url string) {
+	if ff.Feed == nil {
+		ff.Feed = &feedparser.Feed{}
+		ff.Extensions = make(ingest.FeedExtensions)
+		ff.NotModified = false
+	}
+	if ff.Sources == nil {
+		ff.Sources = make(map[*feedparser.FeedItem]string)
+	}
+	for _, item := range extra.Feed.Items {
+		ff.Sources[item] = url
+	}
+	ff.Feed.Items = append(ff.Feed.Items, extra.Feed.Items...)
+	for key, ext := range extra.Extensions {
+		if _, exists := ff.Extensions[key]; !exists {
+			ff.Extensions[key] = ext
+		}
+	}
+}
+
+// A feed request answered with an error status
+// RetryAfter is when the server asked to be tried again, zero when it did
+// not say
+type FeedStatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Time
+}
+
+func (e *FeedStatusError) Error() string {
+	return "feed fetch returned " + e.Status
+}
+
+// The url a response was redirected to, when every redirect on the way was
+// permanent
+func permanentRedirect(resp *http.Response) string {
+	if resp.Request == nil || resp.Request.Response == nil {
+		return ""
+	}
+	for r := resp.Request; r.Response != nil; r = r.Response.Request {
+		if code := r.Response.StatusCode; code != http.StatusMovedPermanently && code != http.StatusPermanentRedirect {
+			return ""
+		}
+	}
+	return resp.Request.URL.String()
+}
+
+// Retrieve and parse the feed for a job, from a driver plugin if one claims
+// the feed's url, from disk for a file url and over http otherwise
+func (job RssJob) fetchFeed(ctx context.Context) (*FetchedFeed, error) {
+	if driver := driverPlugin(job.Url); driver != nil {
+		return driver.FetchFeed(job.Url)
+	}
+	if strings.HasPrefix(strings.ToLower(job.Url), "file:") {
+		return job.readFileFeed()
+	}
+
+	// Revalidate the copy from the last fetch rather than downloading the
+	// feed again
+	rec := feedStates.Get(job.Pid)
+	if job.Full || rec.Url != job.Url {
+		// Nothing to compare with
+		rec = FetchRecord{}
+	}
+	return job.sharedFetch(ctx, rec)
+}
+
+// The fetch stage ends once the body is read, parsing is a stage of its
+// own
+func (job RssJob) fetchHttpFeed(ctx context.Context, rec FetchRecord) (ff *FetchedFeed, err error) {
+	started := time.Now()
+	fetched := false
+	defer func() {
+		if !fetched {
+			stageDone(stageFetch, started, err)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", job.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	setFeedHeaders(req, job.Pid)
+	if err := setFeedAuth(req, job.Pid); err != nil {
+		return nil, err
+	}
+	req = withFeedProxy(req, job.Pid)
+	req = withFeedHedge(req, job.Pid)
+
+	if rec.ETag != "" {
+		req.Header.Set("If-None-Match", rec.ETag)
+	}
+	if rec.LastModified != "" {
+		req.Header.Set("If-Modified-Since", rec.LastModified)
+	}
+
+	client := feedClient(job.Pid)
+	resp, attempts, err := doWithRetry(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// A site refusing a request without its session cookie usually hands
+	// one out with the refusal, so try again with it
+	if resp.StatusCode == http.StatusForbidden && client.Jar != nil && len(resp.Cookies()) > 0 {
+		resp.Body.Close()
+		var more int
+		resp, more, err = doWithRetry(client, req)
+		if err != nil {
+			return nil, err
+		}
+		attempts += more
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		rejectedFeedAuth(job.Pid)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, &FeedStatusError{StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: retryAfter(resp)}
+	}
+
+	ff = &FetchedFeed{Header: resp.Header, Fetched: time.Now().Unix(), Attempts: attempts}
+	ff.MovedTo = permanentRedirect(resp)
+	if resp.StatusCode == http.StatusNotModified {
+		// Validators may be left out of a 304, keep the ones we sent
+		if ff.Header.Get("ETag") == "" {
+			ff.Header.Set("ETag", rec.ETag)
+		}
+		if ff.Header.Get("Last-Modified") == "" {
+			ff.Header.Set("Last-Modified", rec.LastModified)
+		}
+		ff.NotModified = true
+		ff.Fingerprint = rec.Fingerprint
+		return ff, nil
+	}
+	limit := int64(config.Fetcher.Feed.MaxBytes)
+	if err := checkContentLength(resp, limit); err != nil {
+		return nil, err
+	}
+	ff.Body, err = readLimited(throttledReader{countingReader{resp.Body}, feedBandwidth}, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not read feed: %s", err.Error())
+	}
+	fetched = true
+	stageDone(stageFetch, started, nil)
+	if isWebPage(ff.Body) {
+		return job.discoverFeed(ctx, ff.Body, resp.Request.URL.String())
+	}
+	return parseFetchedFeed(ff, rec, job.Url)
+}
+
+// Parse the body of a fetched feed unless it is the same as the copy last
+// fetched
+func parseFetchedFeed(ff *FetchedFeed, rec FetchRecord, feedUrl string) (*FetchedFeed, error) {
+	ff.Snapshot = fmt.Sprintf("%x", md5.Sum(ff.Body))
+
+	// Many feeds are rebuilt on every request, so come without validators
+	// or with new ones each time. Skip parsing one whose content is the
+	// same as last time.
+	ff.Fingerprint = ingest.Fingerprint(ff.Body)
+	if rec.Fingerprint != "" && ff.Fingerprint == rec.Fingerprint {
+		countMetric("feed.samefingerprint", 1)
+		ff.NotModified = true
+		return ff, nil
+	}
+
+	body, err := ingest.ToUTF8(ff.Body, ff.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(body, ff.Body) {
+		countMetric("feed.transcoded", 1)
+	}
+
+	started := time.Now()
+	parsed, err := ingest.Parse(body)
+	stageDone(stageParse, started, err)
+	if err != nil {
+		return nil, err
+	}
+	ff.Feed = parsed.Feed
+	ff.Extensions = parsed.Extensions
+	if ingest.IsJsonFeed(body) {
+		// Parser plugins only take XML feeds
+		countMetric("feed.jsonfeed", 1)
+		return ff, nil
+	}
+	shadowParse(feedUrl, body, ff.Feed)
+	return ff, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/iand/feedparser"
+	"github.com/placetime/datastore"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Query parameters that only track where a link was followed from
+var trackingParams = []string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content"}
+
+// A key under which urls differing only trivially compare equal: the
+// scheme, a leading www., default ports, fragments, a trailing slash,
+// tracking parameters and the order of the query are all ignored. Empty
+// when the url cannot be parsed.
+func feedUrlKey(rawurl string) string {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	q := u.Query()
+	for _, p := range trackingParams {
+		q.Del(p)
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var query []string
+	for _, k := range keys {
+		values := q[k]
+		sort.Strings(values)
+		for _, v := range values {
+			query = append(query, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	key := host + strings.TrimRight(u.EscapedPath(), "/")
+	if len(query) > 0 {
+		key += "?" + strings.Join(query, "&")
+	}
+	return key
+}
+
+// The key a profile's feed is shared under with other profiles following
+// the same feed, empty when the profile's feed settings change how it is
+// fetched and so it must be fetched on its own
+func sharedFeedKey(pid datastore.PidType, feedUrl string) string {
+	fc := config.Feeds[string(pid)]
+	if driverPlugin(feedUrl) != nil || len(fc.Headers) > 0 || fc.Proxy != "" || fc.Auth.String() != "none" ||
+		fc.Cookies || fc.Insecure || len(fc.Urls) > 0 {
+		return ""
+	}
+	return feedUrlKey(feedUrl)
+}
+
+// Fold jobs for the same feed into one, which fetches the feed once and
+// ingests it for each profile
+func shareFeedJobs(jobs []RssJob) []RssJob {
+	shared := make([]RssJob, 0, len(jobs))
+	leads := make(map[string]int)
+	for _, job := range jobs {
+		key := sharedFeedKey(job.Pid, job.Url)
+		if key == "" {
+			shared = append(shared, job)
+			continue
+		}
+
+		i, exists := leads[key]
+		if !exists {
+			leads[key] = len(shared)
+			shared = append(shared, job)
+			continue
+		}
+
+		lead := &shared[i]
+		log.Printf("Profile %s follows the same feed as %s, fetching it once", job.Pid, lead.Pid)
+		countMetric("feed.shared", 1)
+		// The lead's validators only stand for profiles that have ingested
+		// the same copy of the feed
+		if feedStates.Get(job.Pid).Fingerprint != feedStates.Get(lead.Pid).Fingerprint {
+			lead.Full = true
+		}
+		lead.Shared = append(lead.Shared, job)
+	}
+	return shared
+}
+
+// A copy of a fetched feed that can be run through another profile's
+// pipeline, which rewrites items in place
+func (ff *FetchedFeed) Copy() *FetchedFeed {
+	if ff == nil {
+		return nil
+	}
+
+	copied := *ff
+	if ff.Feed != nil {
+		feed := *ff.Feed
+		feed.Items = make([]*feedparser.FeedItem, len(ff.Feed.Items))
+		copied.Sources = nil
+		for i, item := range ff.Feed.Items {
+			itemCopy := *item
+			feed.Items[i] = &itemCopy
+			if source, exists := ff.Sources[item]; exists {
+				if copied.Sources == nil {
+					copied.Sources = make(map[*feedparser.FeedItem]string)
+				}
+				copied.Sources[&itemCopy] = source
+			}
+		}
+		copied.Feed = &feed
+	}
+	return &copied
+}
@@ -1,130 +1,361 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/iand/feedparser"
-	"github.com/iand/imgpick"
 	// "github.com/mjarco/bloom"
+	"github.com/iand/imgpick"
 	"github.com/placetime/datastore"
-	"io"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	runOnce = false
-	feedurl = ""
-	config  Config
+	runOnce  = false
+	feedurl  = ""
+	debugPid = ""
+	config   Config
+
+	// Set at build time with -ldflags "-X main.version=..."
+	version = "dev"
+
+	listDead  = false
+	redriveId = ""
+	minBatch  = 0
+	maxBatch  = 0
+
+	connectTimeout = 0
+	headerTimeout  = 0
+	totalTimeout   = 0
+	hostRate       = 0.0
+	userAgentFlag  = ""
+	proxyFlag      = ""
+	maxFeedBytes   = 0
+	maxImageBytes  = 0
+	allowHosts     = ""
+
+	ownedHosts = ""
+
+	reportWeeks = 8
+
+	pausePid    = ""
+	resumePid   = ""
+	pauseReason = ""
+
+	// The configuration file read, empty when running on the defaults
+	configFilename = ""
+
+	// The dispatcher for image jobs, once the fetcher is running
+	imageDispatcher *Dispatcher
 )
 
 func main() {
 	readConfig()
+	setupLogging()
+	initFetchClient()
 
 	if feedurl != "" {
-		debugFeed(feedurl)
+		debugFeed(feedurl, datastore.PidType(debugPid))
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "install-service":
+		installService()
+		return
+	case "remove-service":
+		removeService()
 		return
 	}
 
 	checkEnvironment()
+	loadFeedStates()
+	loadDeadLetters()
+	loadFeedHistory()
+	loadPausedProfiles()
+	loadOAuthTokens()
+	loadFeedCookies()
+
+	if pausePid != "" {
+		pausedProfiles.Pause(datastore.PidType(pausePid), pauseReason)
+		return
+	}
+
+	if resumePid != "" {
+		pausedProfiles.Resume(datastore.PidType(resumePid))
+		return
+	}
+
+	if flag.Arg(0) == "report" {
+		printReport(reportWeeks)
+		return
+	}
 	datastore.InitRedisStore(config.Datastore, config.Image.Path)
+	initSearch()
+	initPlaces()
+	initLeases()
+	initDiscover()
+	initSeenItems()
+	initImageReplicas()
 
-	log.Printf("Images will be written to: %s", config.Image.Path)
+	if flag.Arg(0) == "migrate-ids" {
+		migrateIds()
+		return
+	}
+
+	if flag.Arg(0) == "repair-replicas" {
+		repairReplicas()
+		return
+	}
+
+	if listDead {
+		listDeadLetters()
+		return
+	}
+
+	if redriveId != "" {
+		if _, err := redrive(context.Background(), redriveId, nil); err != nil {
+			log.Printf("Could not redrive: %s", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	log.Printf("Fetcher version %s", version)
+	resetRedrivenFeeds(true)
+
+	if activityPubEnabled() {
+		initActivityPub()
+	}
+
+	if config.Statsd.Addr != "" {
+		sink, err := NewStatsdSink(config.Statsd.Addr, config.Statsd.Prefix, config.Statsd.Tags)
+		if err != nil {
+			log.Printf("Could not connect to statsd at %s: %s", config.Statsd.Addr, err.Error())
+			os.Exit(1)
+		}
+		addMetricsSink(sink)
+		log.Printf("Sending metrics to statsd at %s", config.Statsd.Addr)
+	}
+
+	if config.StatsFile.Path != "" {
+		interval := time.Duration(config.StatsFile.Interval) * time.Second
+		addMetricsSink(NewStatsFileSink(config.StatsFile.Path, interval, config.StatsFile.Keep))
+		log.Printf("Writing metrics to %s every %s", config.StatsFile.Path, interval)
+	}
+	initSlos()
+
+	if imageProxyEnabled() {
+		log.Printf("Images will be served by the %s proxy at %s", config.Image.Proxy.Style, config.Image.Proxy.Url)
+	} else {
+		log.Printf("Images will be written to: %s", config.Image.Path)
+	}
 
 	const bufferLength = 0
 
-	quit := make(chan bool)
+	// Cancelled to stop the fetcher, which also cancels any work in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := handleStop(cancel)
+	var workers sync.WaitGroup
+	go flushFeedHistory(ctx)
+	go flushFeedStates(ctx)
 
 	jobs := make(chan Job, bufferLength)
+	enrich := NewEnrichQueue()
+	images := NewDispatcher(config.Fetcher.Enrich.PerFeed)
+	go images.Run(ctx, enrich.High)
+	imageDispatcher = images
 
 	if runOnce {
-		go worker(1, jobs, quit)
-		pumpOnce(jobs, quit)
+		workers.Add(2)
+		go worker(ctx, &workers, 1, jobs)
+		go enrichWorker(ctx, &workers, 1, enrich)
+		pumpOnce(ctx, jobs, images)
 	} else {
 		// Start workers
 		log.Printf("Using %d processor cores", runtime.NumCPU())
 		runtime.GOMAXPROCS(runtime.NumCPU())
 
+		if config.Api.Listen != "" {
+			go serveApi(config.Api.Listen)
+		}
+
 		log.Printf("Starting %d workers", config.Fetcher.Workers)
 		for w := 0; w < config.Fetcher.Workers; w++ {
-			go worker(w, jobs, quit)
+			workers.Add(1)
+			go worker(ctx, &workers, w, jobs)
+		}
+
+		log.Printf("Starting %d enrichment workers", config.Fetcher.Enrich.Workers)
+		for w := 0; w < config.Fetcher.Enrich.Workers; w++ {
+			workers.Add(1)
+			go enrichWorker(ctx, &workers, w, enrich)
 		}
-		pumpContinuous(jobs, quit)
+
+		go pumpEnrichmentContinuous(ctx, images, enrich)
+		go exportBacklog(ctx)
+		pumpContinuous(ctx, jobs)
 	}
 
-	close(quit)
+	cancel()
 	log.Printf("Stopping fetcher")
+	workers.Wait()
+	feedHistory.Flush()
+	feedStates.Flush()
+	stopped()
+}
+
+// Cancel the fetcher on an interrupt or SIGTERM, as sent by systemd and
+// launchd
+func stopOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		cancel()
+	}()
 }
 
-func debugFeed(url string) {
-	log.Printf("Debugging feed %s", url)
-	resp, err := http.Get(url)
-	log.Printf("Response: %s", resp.Status)
+// Run a feed through the ingest pipeline the daemon uses, with the feed
+// settings of the given profile, and print the results instead of storing
+// them
+func debugFeed(url string, pid datastore.PidType) {
+	log.Printf("Debugging feed %s", redactedUrl(url))
 
+	var ff *FetchedFeed
+	var err error
+	if url == "-" {
+		ff, err = readLocalFeed(os.Stdin, FetchRecord{}, url)
+	} else {
+		ff, err = RssJob{Url: url, Pid: pid, Full: true}.fetchFeed(context.Background())
+	}
 	if err != nil {
-		log.Printf("Fetch of feed got http error  %s", err.Error())
+		log.Printf("Fetch of feed failed: %s", err.Error())
 		return
 	}
 
-	defer resp.Body.Close()
-
-	feed, err := feedparser.NewFeed(resp.Body)
+	pipeline := feedPipeline(pid)
+	for _, fi := range ff.Feed.Items {
+		guid := fi.Id
+		item, keep, err := pipeline.Process(ff.Extensions, fi)
+		if err != nil {
+			fmt.Printf("  Script error: %s\n", err.Error())
+		}
+		if !keep {
+			fmt.Printf("--Item (%s) dropped by script\n", guid)
+			continue
+		}
 
-	for _, item := range feed.Items {
-		fmt.Printf("--Item (%s)\n", item.Id)
+		fmt.Printf("--Item (%s)\n", guid)
+		fmt.Printf("  Id:    %s\n", item.Id)
 		fmt.Printf("  Title: %s\n", item.Title)
 		fmt.Printf("  Link:  %s\n", item.Link)
 		fmt.Printf("  Image: %s\n", item.Image)
-
-		//		s.AddItem(item.Pid, time.Unix(item.Event, 0), item.Text, item.Link, item.Image, item.Id)
+		for _, m := range item.Media {
+			fmt.Printf("  Media: %s\n", m.Url)
+		}
+		if item.Event.Unix() != 0 {
+			fmt.Printf("  Event: %s\n", item.Event.Format(time.RFC3339))
+		}
+		if loc := item.Extensions.Location; loc != nil {
+			fmt.Printf("  Location: %f,%f\n", loc.Lat, loc.Lon)
+		}
+		if item.ContentText != "" {
+			fmt.Printf("  Content: %d characters\n", len([]rune(item.ContentText)))
+		}
+		if license := item.Extensions.License; license != "" {
+			fmt.Printf("  License: %s\n", license)
+		}
+		if len(item.Tags) > 0 {
+			fmt.Printf("  Tags:  %s\n", strings.Join(item.Tags, ", "))
+		}
 	}
 
 }
 
-type FetchRecord struct {
-	Url         string `json:"url"`
-	Count       int32  `json:"count"`
-	Interval    int64  `json:"interval"`
-	LastFetched int64  `json:"fetched"`
-	LastChanged int64  `json:"changed"`
-}
-
-func pumpContinuous(jobs chan<- Job, quit <-chan bool) {
-
-	feedInterval := time.Duration(config.Fetcher.Feed.Interval) * time.Second
-	imageInterval := time.Duration(config.Fetcher.Image.Interval) * time.Second
-
-	log.Printf("Waiting %s seconds before fetching feeds", feedInterval)
-	log.Printf("Waiting %s seconds before fetching images", imageInterval)
+func pumpContinuous(ctx context.Context, jobs chan<- Job) {
 
-	feedTicker := time.NewTicker(feedInterval)
-	imageTicker := time.NewTicker(imageInterval)
+	feedCheck := time.Duration(config.Fetcher.Feed.Check) * time.Second
+	log.Printf("Checking for due feeds every %s", feedCheck)
+	feedTicker := time.NewTicker(feedCheck)
 
 	for {
 
 		select {
-		case <-quit:
+		case <-ctx.Done():
 			return
 		case <-feedTicker.C:
-			pumpRssJobs(jobs)
-
-		case <-imageTicker.C:
-			pumpImageJobs(jobs)
+			pumpRssJobs(ctx, jobs, false, nil)
 
 		}
 
 	}
 }
 
-// Execute one cycle of fetching feeds and images
-func pumpOnce(jobs chan<- Job, quit <-chan bool) {
-	pumpRssJobs(jobs)
-	pumpImageJobs(jobs)
+// Execute one cycle of fetching feeds and images, giving up on whatever is
+// left once the cycle has taken Fetcher.Cycle seconds
+func pumpOnce(ctx context.Context, jobs chan<- Job, images *Dispatcher) {
+	if config.Fetcher.Cycle > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.Fetcher.Cycle)*time.Second)
+		defer cancel()
+	}
+
+	// Images are only looked for once every feed has been ingested, so
+	// the cycle's new items are picked in the same cycle
+	var feeds sync.WaitGroup
+	pumpRssJobs(ctx, jobs, true, &feeds)
+	if !waitCycle(ctx, feeds.Wait) {
+		return
+	}
+	pumpImageJobs(ctx, images)
+	waitCycle(ctx, images.Wait)
+}
+
+// Wait for a cycle's jobs to finish, returning false if the cycle was
+// stopped first
+func waitCycle(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		log.Printf("Cycle stopped with jobs outstanding: %s", ctx.Err().Error())
+		return false
+	}
+}
+
+// A job whose completion is waited for
+type trackedJob struct {
+	Job
+	done func()
 }
 
-func pumpRssJobs(jobs chan<- Job) {
+func (tj trackedJob) Do(ctx context.Context) {
+	defer tj.done()
+	tj.Job.Do(ctx)
+}
+
+// Queue a job for each feed that is due to be fetched, or for every feed if
+// force is true. Each job queued is added to pending, when given, and done
+// once it has run.
+func pumpRssJobs(ctx context.Context, jobs chan<- Job, force bool, pending *sync.WaitGroup) {
 	s := datastore.NewRedisStore()
 	defer s.Close()
 
@@ -132,42 +363,110 @@ func pumpRssJobs(jobs chan<- Job) {
 	if len(profiles) == 0 {
 		return
 	}
+	setFollowedHosts(profiles)
+
+	resetRedrivenFeeds(false)
+	if !force {
+		profiles = dueProfiles(profiles)
+	}
+
+	var queue []RssJob
 	for _, p := range profiles {
-		log.Printf("Pumping feed for profile %s", p.Pid)
-		jobs <- RssJob{Url: p.FeedUrl, Pid: p.Pid, ItemType: p.ItemType}
+		if budget.Exhausted() {
+			break
+		}
+		if !force && deadLetters.HasFeed(p.Pid) {
+			continue
+		}
+		if profilePaused(p.Pid) {
+			continue
+		}
+		url := feedStates.FeedUrl(p.Pid, p.FeedUrl)
+		if feedHostTripped(url) {
+			// Left due, so it is fetched once the host's breaker lets a
+			// trial through
+			countMetric("feed.breakeropen", 1)
+			continue
+		}
+		if !feedStates.Claim(p.Pid, url, force) {
+			continue
+		}
+		queue = append(queue, RssJob{Url: url, Pid: p.Pid, ItemType: p.ItemType})
+	}
+
+	for _, job := range shareFeedJobs(queue) {
+		log.Printf("Pumping feed for profile %s", job.Pid)
+		var queued Job = job
+		if pending != nil {
+			pending.Add(1)
+			queued = trackedJob{Job: job, done: pending.Done}
+		}
+		select {
+		case jobs <- queued:
+		case <-ctx.Done():
+			if pending != nil {
+				pending.Done()
+			}
+			return
+		}
 	}
+}
 
+func feedHostTripped(feedUrl string) bool {
+	u, err := url.Parse(feedUrl)
+	if err != nil {
+		return false
+	}
+	return breakers.Tripped(u.Hostname())
 }
 
-func pumpImageJobs(jobs chan<- Job) {
+func pumpImageJobs(ctx context.Context, d *Dispatcher) {
 	s := datastore.NewRedisStore()
 	defer s.Close()
 
+	leases.Reap(ctx, d)
+
 	for {
-		items, _ := s.GrabItemsNeedingImages(10)
+		if budget.Exhausted() || ctx.Err() != nil {
+			return
+		}
+		if d.WaitQueued(ctx, imageQueueHighWater()) != nil {
+			return
+		}
+		size := imageBatchSize(d.Queued())
+		items, _ := s.GrabItemsNeedingImages(size)
 		if len(items) == 0 {
 			return
 		}
+		countMetric("image.grabbed", int64(len(items)))
 		for _, item := range items {
-			jobs <- ImageJob{Url: item.Link, ItemId: item.Id}
+			if !leases.Acquire(item.Pid, item.Id, item.Link) {
+				continue
+			}
+			if d.Submit(ctx, item.Pid, ImageJob{Url: item.Link, ItemId: item.Id}) != nil {
+				leases.Release(item.Id)
+				return
+			}
 		}
 	}
 }
 
+// A unit of work for a worker. Do should give up promptly once ctx is done.
 type Job interface {
-	Do()
+	Do(ctx context.Context)
 }
 
-func worker(id int, jobs <-chan Job, quit <-chan bool) {
+func worker(ctx context.Context, wg *sync.WaitGroup, id int, jobs <-chan Job) {
+	defer wg.Done()
 	for {
 		select {
 
-		case <-quit:
+		case <-ctx.Done():
 			return
 
 		case job := <-jobs:
 			log.Printf("Worker %d processing job", id)
-			job.Do()
+			job.Do(ctx)
 		}
 	}
 }
@@ -176,39 +475,307 @@ type RssJob struct {
 	Url      string
 	Pid      datastore.PidType
 	ItemType string
+
+	// Fetch and parse the feed even if it is unchanged since last time
+	Full bool
+
+	// Jobs of other profiles following the same feed, which are given the
+	// feed this job fetches rather than fetching it themselves
+	Shared []RssJob
+
+	// Set when fetching a feed discovered from a web page, which is not
+	// searched for a further feed
+	discovered bool
 }
 
-func (job RssJob) Do() {
-	log.Printf("RSS job fetching feed at %s", job.Url)
-	resp, err := http.Get(job.Url)
-	defer resp.Body.Close()
+func (job RssJob) Do(parent context.Context) {
+	log.Printf("RSS job fetching feed at %s", redactedUrl(job.Url))
+	started := time.Now()
+	defer timeMetric("feed.duration", started)
+	countMetric("feed.fetches", 1)
+
+	ctx, cancel := context.WithTimeout(parent, time.Duration(config.Fetcher.Feed.Timeout)*time.Second)
+	defer cancel()
+
+	ff, err := job.fetchFeed(ctx)
+	if err != nil && parent.Err() != nil {
+		// Stopped rather than failed, the feed is fetched again next time
+		log.Printf("RSS job cancelled fetching feed: %s", err.Error())
+		return
+	}
+
+	copies := make([]*FetchedFeed, len(job.Shared))
+	for i := range job.Shared {
+		copies[i] = ff.Copy()
+	}
+	job.process(ctx, ff, err, started)
+	for i, shared := range job.Shared {
+		log.Printf("RSS job passing feed on to profile %s", shared.Pid)
+		shared.process(ctx, copies[i], err, started)
+	}
+}
 
+// Record the outcome of fetching the job's feed and ingest the items
+// fetched for the job's profile
+func (job RssJob) process(ctx context.Context, ff *FetchedFeed, err error, started time.Time) {
 	if err != nil {
+		var open *BreakerOpenError
+		if errors.As(err, &open) {
+			// The host is down, which says nothing about this feed
+			log.Printf("RSS job skipping feed: %s", err.Error())
+			countMetric("feed.breakeropen", 1)
+			return
+		}
+		status, _ := err.(*FeedStatusError)
+		if status != nil && status.StatusCode == http.StatusTooManyRequests && !status.RetryAfter.IsZero() {
+			// Being asked to slow down is not the feed failing
+			log.Printf("RSS job rate limited fetching feed, next fetch no earlier than %s", status.RetryAfter.Format(time.RFC3339))
+			countMetric("feed.ratelimited", 1)
+			feedStates.NotBefore(job.Pid, status.RetryAfter)
+			return
+		}
 		log.Printf("RSS job failed to fetch feed: %s", err.Error())
+		countMetric("feed.errors", 1)
+		feedHistory.Record(job.Pid, time.Since(started), 0, true)
+		failures, notFound := feedStates.Failed(job.Pid, status != nil && status.StatusCode == http.StatusNotFound)
+		if status != nil && !status.RetryAfter.IsZero() {
+			feedStates.NotBefore(job.Pid, status.RetryAfter)
+		}
+		switch {
+		case status != nil && status.StatusCode == http.StatusGone:
+			disableFeed(job.Pid, "feed gone (410)")
+		case notFound >= config.Fetcher.Feed.MaxNotFound:
+			disableFeed(job.Pid, fmt.Sprintf("feed not found (404) %d times in a row", notFound))
+		case failures >= config.Fetcher.Feed.MaxFailures:
+			deadLetters.AddFeed(job.Pid, job.Url, err, failures)
+		}
 		return
 	}
 
-	feed, err := feedparser.NewFeed(resp.Body)
-	if err != nil {
-		log.Printf("RSS job failed to parse feed: %s", err.Error())
+	if ff.Attempts > 1 {
+		log.Printf("RSS job fetched feed after %d attempts", ff.Attempts)
+	}
+
+	if ff.MovedTo != "" {
+		log.Printf("RSS job found feed of profile %s has moved permanently from %s to %s", job.Pid, redactedUrl(job.Url), redactedUrl(ff.MovedTo))
+		countMetric("feed.moved", 1)
+		feedStates.Moved(job.Pid, ff.MovedTo)
+	}
+
+	// Only a profile that has never been fetched has a history to fill in
+	if pages := feedBackfillPages(job.Pid); pages > 0 && !ff.NotModified && feedStates.Get(job.Pid).LastFetched == 0 {
+		job.backfill(ctx, ff, pages)
+	}
+
+	fc := config.Feeds[string(job.Pid)]
+	if len(fc.Urls) > 0 {
+		job.mergeFeeds(ctx, ff, fc.Urls)
+	}
+
+	if ff.NotModified {
+		log.Printf("RSS job found feed unchanged since last fetch")
+		countMetric("feed.notmodified", 1)
+		feedHistory.Record(job.Pid, time.Since(started), 0, false)
+		feedStates.Succeeded(job.Pid, ff.Header.Get("ETag"), ff.Header.Get("Last-Modified"), ff.Fingerprint, false)
 		return
 	}
+	feed := ff.Feed
 
 	s := datastore.NewRedisStore()
 	defer s.Close()
 
+	places := newPlaceStore()
+	if places != nil {
+		defer places.Close()
+	}
+
 	log.Printf("RSS job found %d items in feed", len(feed.Items))
 
-	for _, item := range feed.Items {
-		hasher := md5.New()
-		io.WriteString(hasher, item.Id)
-		id := fmt.Sprintf("%x", hasher.Sum(nil))
-		_, err := s.AddItem(job.Pid, time.Unix(0, 0), item.Title, item.Link, item.Image, datastore.ItemIdType(id), job.ItemType, 0)
+	pipeline := feedPipeline(job.Pid)
+	added := 0
+
+	// Notifications are sent once the whole feed is in, so a large poll
+	// can be batched
+	var notifications []WebhookItem
+	var published []*ItemMeta
+
+	items := feed.Items
+	if policy := trustPolicy(job.Pid); policy.MaxItems > 0 && len(items) > policy.MaxItems {
+		log.Printf("RSS job limiting feed to %d items", policy.MaxItems)
+		items = items[:policy.MaxItems]
+	}
+
+	// Items the profile's feeds have in common are only ingested once
+	processed := make(map[datastore.ItemIdType]bool)
+
+	for _, fi := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		source := ff.Source(fi, job.Url)
+		item, keep, err := pipeline.Process(ff.Extensions, fi)
+		if err != nil {
+			log.Printf("RSS job script failed on item %s: %s", fi.Id, err.Error())
+			countMetric("script.errors", 1)
+		}
+		if !keep {
+			countMetric("script.dropped", 1)
+			continue
+		}
+
+		id := item.Id
+		ext := item.Extensions
+		if processed[id] {
+			continue
+		}
+		processed[id] = true
+
+		dedupStarted := time.Now()
+		isNew := seenItems.IsNew(s, id)
+		repeated := false
+		if isNew && fc.TitleWindow > 0 {
+			if key := ingest.TitleKey(item.Title); key != "" && feedStates.SeenTitle(job.Pid, key, fc.TitleWindow) {
+				repeated = true
+			}
+		}
+		stageDone(stageDedup, dedupStarted, nil)
+		if repeated {
+			log.Printf("RSS job dropping item %s repeating a recent title", id)
+			countMetric("feed.repeatedtitle", 1)
+			continue
+		}
+
+		location := ext.Location
+		placeName := ext.PlaceName
+
+		ann := &Annotation{}
+		if isNew && config.Annotate.Url != "" && trustPolicy(job.Pid).Annotate {
+			ar := AnnotationRequest{
+				Pid:      string(job.Pid),
+				Id:       string(id),
+				Title:    item.Title,
+				Link:     item.Link,
+				Image:    item.Image,
+				Location: location,
+			}
+			if !item.When.IsZero() {
+				ar.Published = item.When.Unix()
+			}
+			enrichStarted := time.Now()
+			a, err := annotateItem(ar)
+			stageDone(stageEnrich, enrichStarted, err)
+			if err != nil {
+				log.Printf("RSS job failed to annotate item %s: %s", id, err.Error())
+				countMetric("annotate.errors", 1)
+			} else {
+				ann = a
+				if ann.Location != nil {
+					location = ann.Location
+					placeName = ""
+				}
+				if ann.Place != "" {
+					placeName = ann.Place
+				}
+			}
+		}
+
+		outside := location != nil && fc.Geofence.Enabled() && !fc.Geofence.Contains(location)
+		if outside && fc.Geofence.Action != "downrank" {
+			log.Printf("RSS job dropping item %s located outside the geofence", id)
+			countMetric("feed.geofenced", 1)
+			continue
+		}
+
+		storeStarted := time.Now()
+		_, err = s.AddItem(job.Pid, item.Event, item.Title, item.Link, item.Image, id, job.ItemType, 0)
+		stageDone(stageStore, storeStarted, err)
 		if err != nil {
 			log.Printf("RSS job failed to add item from feed: %s", err.Error())
+			countMetric("feed.errors", 1)
+			continue
+		}
+		seenItems.Add(id)
+
+		if isNew {
+			var recorded *ItemMeta
+			err = updateItemMeta(id, func(meta *ItemMeta) {
+				meta.Pid = job.Pid
+				meta.Guid = item.FeedItem.Id
+				meta.Title = item.Title
+				meta.Link = item.Link
+				meta.Image = item.Image
+				meta.Media = proxiedMedia(item.Media)
+				meta.License = itemLicense(job.Pid, ext)
+				meta.Content = item.Content
+				meta.ContentText = item.ContentText
+				meta.Added = time.Now().Unix()
+				meta.Location = location
+				if location != nil {
+					meta.Geohash = ingest.Geohash(location, 12)
+				}
+				meta.Tags = append(item.Tags, ann.Tags...)
+				if ann.Score != nil {
+					meta.Score = *ann.Score
+				}
+				if !item.When.IsZero() {
+					meta.Published = item.When.Unix()
+				}
+				if !ext.HappensAt.IsZero() {
+					meta.HappensAt = ext.HappensAt.Unix()
+				}
+				meta.Outside = outside
+				meta.Rank = rankItem(meta)
+				meta.Provenance = &Provenance{
+					Source:   "rss",
+					Feed:     source,
+					Fetched:  ff.Fetched,
+					Snapshot: ff.Snapshot,
+					Version:  version,
+				}
+				recorded = meta
+			})
+			if err != nil {
+				log.Printf("RSS job failed to write metadata for item %s: %s", id, err.Error())
+			} else {
+				added++
+				published = append(published, recorded)
+				indexItem(recorded)
+				recordPlace(places, recorded, placeName)
+				routeToVirtualProfiles(s, recorded, job.ItemType, item.Event)
+			}
+
+			wi := WebhookItem{
+				Pid:     job.Pid,
+				Id:      id,
+				Title:   item.Title,
+				Link:    item.Link,
+				Image:   item.Image,
+				Added:   time.Now().Unix(),
+				License: itemLicense(job.Pid, ext),
+			}
+			notifications = append(notifications, wi)
 		}
 	}
 
+	clusterItems(published)
+	notifyNewItems(job.Pid, notifications, published)
+
+	countMetric("feed.items", int64(added))
+	if ctx.Err() != nil {
+		// Without the validators the next fetch reads the whole feed and
+		// picks up the items not reached
+		log.Printf("RSS job stopped after %d new items: %s", added, ctx.Err().Error())
+		countMetric("feed.interrupted", 1)
+		feedHistory.Record(job.Pid, time.Since(started), added, true)
+		return
+	}
+	feedHistory.Record(job.Pid, time.Since(started), added, false)
+	feedStates.Succeeded(job.Pid, ff.Header.Get("ETag"), ff.Header.Get("Last-Modified"), ff.Fingerprint, added > 0)
+
+	if added > 0 {
+		go pingHub(job.Pid)
+	}
+
 }
 
 type ImageJob struct {
@@ -216,13 +783,131 @@ type ImageJob struct {
 	ItemId datastore.ItemIdType
 }
 
-func (job ImageJob) Do() {
-	log.Printf("Looking for a feature image for %s", job.Url)
+func (job ImageJob) Do(ctx context.Context) {
+	defer timeMetric("image.duration", time.Now())
+	defer leases.Release(job.ItemId)
+	countMetric("image.jobs", 1)
 
-	data, err := imgpick.DetectMedia(job.Url, true)
+	if meta, err := readItemMeta(job.ItemId); err == nil && meta.SourcePid() != "" {
+		if config.Feeds[string(meta.SourcePid())].NoImages {
+			countMetric("image.disabled", 1)
+			log.Printf("Image job not scraping %s, images are disabled for profile %s", job.Url, meta.SourcePid())
+			return
+		}
+		if !trustPolicy(meta.SourcePid()).Scrape {
+			log.Printf("Image job not scraping %s, profile %s is not trusted to scrape", job.Url, meta.SourcePid())
+			return
+		}
+	}
+
+	if config.Fetcher.Image.Robots != "ignore" && !robotsAllowed(job.Url) {
+		countMetric("image.disallowed", 1)
+		err := updateItemMeta(job.ItemId, func(meta *ItemMeta) {
+			meta.Disallowed = true
+		})
+		if err != nil {
+			log.Printf("Image job failed to write metadata for item %s: %s", job.ItemId, err.Error())
+		}
+		if config.Fetcher.Image.Robots == "obey" {
+			log.Printf("Image job skipping %s, disallowed by robots.txt", job.Url)
+			return
+		}
+	}
+
+	log.Printf("Checking link %s", job.Url)
+
+	// The page images are picked from, which may be an archived copy or a
+	// lighter variant
+	pageUrl := job.Url
+	alternate := false
+
+	ls, err := checkLink(ctx, job.Url)
+	if err != nil {
+		log.Printf("Image job failed to check link %s: %s", job.Url, err.Error())
+	} else {
+		err = updateItemMeta(job.ItemId, func(meta *ItemMeta) {
+			meta.FinalUrl = ls.FinalUrl
+			meta.Canonical = ls.Canonical
+			meta.Redirects = ls.Redirects
+			meta.Status = ls.Status
+			meta.Paywalled = ls.Paywalled
+			meta.Checked = time.Now().Unix()
+			if meta.License == "" {
+				meta.License = ls.License
+			}
+		})
+		if err != nil {
+			log.Printf("Image job failed to write metadata for item %s: %s", job.ItemId, err.Error())
+		}
+
+		recordDiscovery(ls)
+
+		if ls.IsGone() && config.Wayback.Enabled {
+			pageUrl = archivedPage(job.ItemId, job.Url)
+		}
+
+		if ls.IsDead() && pageUrl == job.Url {
+			log.Printf("Image job skipping dead link %s (status %d)", job.Url, ls.Status)
+			return
+		}
+
+		if ls.Paywalled {
+			log.Printf("Image job skipping paywalled link %s", job.Url)
+			return
+		}
+
+		if ls.Alternate != "" && config.Fetcher.Image.Alternate {
+			log.Printf("Image job trying lighter variant %s", ls.Alternate)
+			pageUrl = ls.Alternate
+			alternate = true
+		}
+	}
+
+	log.Printf("Looking for a feature image for %s", pageUrl)
+
+	// Picking and inspecting share one deadline so a pathological page
+	// cannot hold on to the worker
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Fetcher.Image.Timeout)*time.Second)
+	defer cancel()
+
+	budget.AddRequest()
+	started := time.Now()
+	var data *imgpick.MediaData
+	var video *PageVideo
+	var doc *ItemDocument
+	var rendered []byte
+	if isDocument(ls) {
+		// There is no page to pick from, only the document
+		log.Printf("Image job inspecting document %s", job.Url)
+		var image string
+		doc, image, rendered = inspectDocument(ctx, job.ItemId, ls)
+		if image == "" {
+			image = placeholderImage(job.Url)
+		}
+		data, err = &imgpick.MediaData{BestImage: image, MediaType: "document"}, nil
+	} else if video = linkVideo(ctx, ls); video != nil && video.Poster != "" {
+		log.Printf("Image job using poster of video on %s", job.Url)
+		countMetric("image.videoposters", 1)
+		data, err = &imgpick.MediaData{BestImage: video.Poster, MediaType: "video"}, nil
+	} else {
+		data, err = detectMedia(ctx, pageUrl)
+		if alternate && ctx.Err() == nil && (err != nil || data.BestImage == "") {
+			// The variant had nothing to offer, fall back to the page itself
+			countMetric("image.alternate.misses", 1)
+			data, err = detectMedia(ctx, job.Url)
+		}
+	}
+	budget.AddImageTime(time.Since(started))
+	stageDone(stageImage, started, err)
 
 	if err != nil {
 		log.Printf("Image job failed to pick an image: %s", err.Error())
+		countMetric("image.errors", 1)
+		// Timeouts and open breakers say nothing about the page itself
+		var open *BreakerOpenError
+		if !errors.As(err, &open) && ctx.Err() == nil {
+			deadLetters.AddImage(job.ItemId, job.Url, err)
+		}
 		return
 	}
 
@@ -235,13 +920,118 @@ func (job ImageJob) Do() {
 		return
 	}
 
-	item.Image = data.BestImage
-	item.Media = data.MediaType
+	picked := data.BestImage
+	source := picked
+	var imageData []byte
+	if picked != "" && imageProxyEnabled() {
+		// The proxy fetches and crops the image itself
+		if picked, err = imageProxyUrl(source); err != nil {
+			log.Printf("Image job failed to build proxy url for %s: %s", source, err.Error())
+			return
+		}
+	} else if picked != "" && rendered != nil {
+		// Rendered here, there is nothing to fetch
+		imageData = rendered
+	} else if picked != "" {
+		if imageData, err = fetchImage(ctx, picked); err != nil {
+			log.Printf("Image job failed to fetch image %s: %s", picked, err.Error())
+		} else if err = checkImageQuality(imageData); err != nil {
+			log.Printf("Image job rejected image %s: %s", picked, err.Error())
+			countMetric("image.rejected", 1)
+			picked = placeholderImage(job.Url)
+			imageData = nil
+		}
+	}
+
+	var alt string
+	if picked != "" && (picked == source || imageProxyEnabled()) {
+		alt = imageAltText(ls, source, item.Text)
+	}
 
-	err = s.UpdateItem(item)
+	storeStarted := time.Now()
+	item, err = updateItem(s, job.ItemId, func(item *datastore.Item) {
+		item.Image = picked
+		item.Media = data.MediaType
+		if doc != nil && doc.Title != "" && untitledDocument(item.Text, item.Link) {
+			log.Printf("Image job titling item %s from its document", job.ItemId)
+			item.Text = doc.Title
+		}
+		// A link edited since the job started was not the one checked
+		if ls != nil && item.Link == job.Url {
+			if link := rewrittenLink(ls); link != "" && link != item.Link {
+				log.Printf("Image job rewriting link %s to %s", item.Link, link)
+				item.Link = link
+			}
+		}
+	})
+	stageDone(stageStore, storeStarted, err)
 	if err != nil {
 		log.Printf("Image job failed to update item %s in datastore: %s", job.ItemId, err.Error())
+		countMetric("image.errors", 1)
 		return
 	}
+	countMetric("image.updated", 1)
+	replicateItemImages(job.ItemId)
+
+	var hash string
+	if imageData != nil {
+		hash = hashImage(imageData)
+	}
+
+	err = updateItemMeta(job.ItemId, func(meta *ItemMeta) {
+		meta.Image = item.Image
+		meta.Link = item.Link
+		meta.ImageAlt = alt
+		meta.Video = video
+		meta.Document = doc
+		if doc != nil {
+			meta.Title = item.Text
+		}
+		if imageProxyEnabled() && source != "" {
+			meta.ImageSource = source
+			meta.ImageCrop = imageProxyCrop()
+		}
+		// A re-picked image has nothing new to compare
+		if hash != meta.ImageHash {
+			meta.ImageHash = hash
+			meta.RepeatedImage = hash != "" && meta.Pid != "" && feedStates.SeenImage(meta.Pid, hash)
+			if meta.RepeatedImage {
+				log.Printf("Image job found item %s repeats a recent image of profile %s", job.ItemId, meta.Pid)
+				countMetric("image.repeated", 1)
+			}
+		}
+		meta.Rank = rankItem(meta)
+	})
+	if err != nil {
+		log.Printf("Image job failed to write metadata for item %s: %s", job.ItemId, err.Error())
+	}
+
+}
+
+// Look up an archived copy of a missing page, falling back to the page
+// itself when there is none
+func archivedPage(id datastore.ItemIdType, link string) string {
+	var near time.Time
+	if meta, err := readItemMeta(id); err == nil && meta.Published != 0 {
+		near = time.Unix(meta.Published, 0)
+	}
 
+	snapshot, err := waybackSnapshot(link, near)
+	if err != nil {
+		log.Printf("Image job failed to look up archived copy of %s: %s", link, err.Error())
+		return link
+	}
+	if snapshot == "" {
+		return link
+	}
+
+	log.Printf("Image job picking from archived copy %s", snapshot)
+	countMetric("image.archived", 1)
+	err = updateItemMeta(id, func(meta *ItemMeta) {
+		meta.ArchiveUrl = snapshot
+	})
+	if err != nil {
+		log.Printf("Image job failed to write metadata for item %s: %s", id, err.Error())
+	}
+	return snapshot
 }
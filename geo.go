@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const earthRadiusKm = 6371.0
+
+// Great circle distance between two points
+func distanceKm(a *GeoPoint, b *GeoPoint) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLon := (b.Lon - a.Lon) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// A geofence limits a profile to items located within an area, given either
+// as a bounding box or as a centre and radius in kilometres:
+//
+//	[feeds."brightonlocal".geofence]
+//	center = [-0.14, 50.82]
+//	radius = 15.0
+//	action = "downrank"
+//
+// Coordinates are longitude first, as in GeoJSON and virtual profiles: the
+// centre is [lon, lat] and the bbox [minlon, minlat, maxlon, maxlat]. Items
+// outside the area are dropped, or with the downrank action kept but
+// flagged. Items with no known location are always kept.
+type GeofenceConfig struct {
+	Bbox   []float64 `toml:"bbox"`
+	Center []float64 `toml:"center"`
+	Radius float64   `toml:"radius"`
+	Action string    `toml:"action"`
+}
+
+func (gf GeofenceConfig) Enabled() bool {
+	return len(gf.Bbox) == 4 || (len(gf.Center) == 2 && gf.Radius > 0)
+}
+
+func (gf GeofenceConfig) Contains(p *GeoPoint) bool {
+	if len(gf.Bbox) == 4 && !inBbox(p, gf.Bbox) {
+		return false
+	}
+	if len(gf.Center) == 2 && gf.Radius > 0 && distanceKm(&GeoPoint{Lat: gf.Center[1], Lon: gf.Center[0]}, p) > gf.Radius {
+		return false
+	}
+	return true
+}
+
+func (gf GeofenceConfig) validate() error {
+	if err := checkBbox(gf.Bbox); err != nil {
+		return err
+	}
+	if len(gf.Center) == 0 {
+		if gf.Radius != 0 {
+			return fmt.Errorf("radius needs a center")
+		}
+		return nil
+	}
+	if len(gf.Center) != 2 || gf.Center[0] < -180 || gf.Center[0] > 180 || gf.Center[1] < -90 || gf.Center[1] > 90 {
+		return fmt.Errorf("center must be lon, lat")
+	}
+	if gf.Radius <= 0 {
+		return fmt.Errorf("center needs a radius greater than zero")
+	}
+	return nil
+}
+
+// An empty bbox, or minlon, minlat, maxlon, maxlat with each min below its
+// max
+func checkBbox(bbox []float64) error {
+	if len(bbox) == 0 {
+		return nil
+	}
+	if len(bbox) != 4 || bbox[0] >= bbox[2] || bbox[1] >= bbox[3] {
+		return fmt.Errorf("bbox must be minlon, minlat, maxlon, maxlat")
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"log"
+	"math"
+	"sort"
+)
+
+// Items with a location are also filed in the search index under the
+// geohash of their location at each of the configured precisions, so
+// finding items near a point reads a handful of sorted sets rather than
+// every item.
+func geoBucketKey(hash string) string {
+	return config.Search.Prefix + "geo:" + hash
+}
+
+func geoBuckets(p *GeoPoint) []string {
+	hashes := make([]string, 0, len(config.Search.GeoPrecisions))
+	for _, precision := range config.Search.GeoPrecisions {
+		hashes = append(hashes, ingest.Geohash(p, precision))
+	}
+	return hashes
+}
+
+func bucketItem(conn redis.Conn, meta *ItemMeta) {
+	if meta.Location == nil {
+		return
+	}
+	for _, hash := range geoBuckets(meta.Location) {
+		if _, err := conn.Do("ZADD", geoBucketKey(hash), meta.Added, string(meta.Id)); err != nil {
+			log.Printf("Could not bucket item %s: %s", meta.Id, err.Error())
+			return
+		}
+	}
+}
+
+func unbucketItem(conn redis.Conn, meta *ItemMeta) {
+	if meta.Location == nil {
+		return
+	}
+	for _, hash := range geoBuckets(meta.Location) {
+		if _, err := conn.Do("ZREM", geoBucketKey(hash), string(meta.Id)); err != nil {
+			log.Printf("Could not unbucket item %s: %s", meta.Id, err.Error())
+			return
+		}
+	}
+}
+
+// The width and height in kilometres of the geohash cell holding p
+func geohashCellKm(p *GeoPoint, precision int) (float64, float64) {
+	bbox := ingest.GeohashBbox(ingest.Geohash(p, precision))
+	kmPerDegree := math.Pi / 180 * earthRadiusKm
+	return (bbox[2] - bbox[0]) * kmPerDegree * math.Cos(p.Lat*math.Pi/180), (bbox[3] - bbox[1]) * kmPerDegree
+}
+
+// The buckets to read for items within radius kilometres of p: the cell
+// holding p and the eight around it, at the finest precision whose cells
+// are at least radius across
+func nearbyBuckets(p *GeoPoint, radius float64) []string {
+	precisions := append([]int(nil), config.Search.GeoPrecisions...)
+	sort.Sort(sort.Reverse(sort.IntSlice(precisions)))
+
+	precision := precisions[len(precisions)-1]
+	for _, pr := range precisions {
+		if w, h := geohashCellKm(p, pr); w >= radius && h >= radius {
+			precision = pr
+			break
+		}
+	}
+
+	return geohashNeighbourhood(p, precision)
+}
+
+// The geohash cell holding p and the eight around it
+func geohashNeighbourhood(p *GeoPoint, precision int) []string {
+	bbox := ingest.GeohashBbox(ingest.Geohash(p, precision))
+	dLon, dLat := bbox[2]-bbox[0], bbox[3]-bbox[1]
+	seen := make(map[string]bool)
+	hashes := make([]string, 0, 9)
+	for _, y := range []float64{-1, 0, 1} {
+		for _, x := range []float64{-1, 0, 1} {
+			lat := math.Max(-90, math.Min(90, p.Lat+y*dLat))
+			lon := math.Mod(p.Lon+x*dLon+540, 360) - 180
+			hash := ingest.Geohash(&GeoPoint{Lat: lat, Lon: lon}, precision)
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	return hashes
+}
+
+// Find up to limit ids of items in the buckets around p, newest first.
+// The buckets cover more than the radius, so callers check the distance of
+// each item.
+func nearbyItems(p *GeoPoint, radius float64, limit int) ([]datastore.ItemIdType, error) {
+	hashes := nearbyBuckets(p, radius)
+
+	conn := searchPool.Get()
+	defer conn.Close()
+
+	key := config.Search.Prefix + "near:" + fmt.Sprintf("%v", hashes)
+	args := redis.Args{key, len(hashes)}
+	for _, hash := range hashes {
+		args = args.Add(geoBucketKey(hash))
+	}
+	args = args.Add("AGGREGATE", "MAX")
+	if _, err := conn.Do("ZUNIONSTORE", args...); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Do("EXPIRE", key, searchResultTtl); err != nil {
+		return nil, err
+	}
+
+	members, err := redis.Strings(conn.Do("ZREVRANGE", key, 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]datastore.ItemIdType, len(members))
+	for i, m := range members {
+		ids[i] = datastore.ItemIdType(m)
+	}
+	return ids, nil
+}
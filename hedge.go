@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"github.com/placetime/datastore"
+	"io"
+	"net/http"
+	"time"
+)
+
+type hedgeKey struct{}
+
+// How long to wait on a profile's feed before sending a second request for
+// it, zero for never
+func feedHedgeDelay(pid datastore.PidType) time.Duration {
+	ms := config.Feeds[string(pid)].Hedge
+	if ms == 0 {
+		ms = config.Fetcher.Feed.Hedge
+	}
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Hedge the request for a profile's feed when it is slow to answer
+func withFeedHedge(req *http.Request, pid datastore.PidType) *http.Request {
+	delay := feedHedgeDelay(pid)
+	if delay == 0 {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), hedgeKey{}, delay))
+}
+
+type hedgeResult struct {
+	resp  *http.Response
+	err   error
+	index int
+}
+
+// Cancels the request a response won for once its body is done with
+type hedgedBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *hedgedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Send a request, and when it has not been answered once its hedge delay
+// has passed send it again and take whichever answers first. The other is
+// cancelled. Requests without a delay are sent once.
+func doHedged(client *http.Client, req *http.Request) (*http.Response, error) {
+	delay, _ := req.Context().Value(hedgeKey{}).(time.Duration)
+	if delay <= 0 {
+		return client.Do(req)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := client.Do(req.Clone(ctx))
+			results <- hedgeResult{resp: resp, err: err, index: index}
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	hedged := false
+	for {
+		select {
+		case <-timer.C:
+			if !hedged {
+				countMetric("feed.hedged", 1)
+				budget.AddRequest()
+				send()
+				hedged = true
+				pending++
+			}
+
+		case res := <-results:
+			pending--
+			if res.err != nil && pending > 0 {
+				// The other request may yet succeed
+				continue
+			}
+			for i, cancel := range cancels {
+				if i != res.index {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+
+			if res.err != nil {
+				cancels[res.index]()
+				return nil, res.err
+			}
+			if res.index > 0 {
+				countMetric("feed.hedgewins", 1)
+			}
+			res.resp.Body = &hedgedBody{ReadCloser: res.resp.Body, cancel: cancels[res.index]}
+			return res.resp, nil
+		}
+	}
+}
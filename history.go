@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/placetime/datastore"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const historyDayLayout = "2006-01-02"
+
+// How often fetches recorded in memory are written to the history file
+const historyFlushInterval = time.Minute
+
+// Daily aggregates of each feed's fetches, kept for Keep days so that
+// sources decaying over months show up in reports. Latency is the total
+// milliseconds spent fetching, averaged when reported.
+type HistoryConfig struct {
+	Path string `toml:"path"`
+	Keep int    `toml:"keep"`
+}
+
+type DailyStats struct {
+	Fetches int   `json:"fetches"`
+	Errors  int   `json:"errors,omitempty"`
+	Items   int   `json:"items,omitempty"`
+	Latency int64 `json:"latency"`
+}
+
+func (d *DailyStats) add(o *DailyStats) {
+	d.Fetches += o.Fetches
+	d.Errors += o.Errors
+	d.Items += o.Items
+	d.Latency += o.Latency
+}
+
+type FeedHistory struct {
+	mu       sync.Mutex
+	filename string
+	days     map[string]map[datastore.PidType]*DailyStats
+
+	// Fetches have been recorded since the file was last written
+	dirty bool
+}
+
+var feedHistory = &FeedHistory{days: make(map[string]map[datastore.PidType]*DailyStats)}
+
+func loadFeedHistory() {
+	feedHistory.filename = config.History.Path
+	if feedHistory.filename == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(feedHistory.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Printf("Could not read fetch history %s: %s", feedHistory.filename, err.Error())
+		os.Exit(1)
+	}
+	if err := json.Unmarshal(data, &feedHistory.days); err != nil {
+		log.Printf("Could not read fetch history %s: %s", feedHistory.filename, err.Error())
+		os.Exit(1)
+	}
+}
+
+// Write the history file if fetches have been recorded since it was last
+// written
+func (fh *FeedHistory) Flush() {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.dirty {
+		fh.save()
+	}
+}
+
+// Flush the history periodically until the fetcher stops, then a last time
+func flushFeedHistory(ctx context.Context) {
+	ticker := time.NewTicker(historyFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			feedHistory.Flush()
+		}
+	}
+}
+
+// Must be called with the lock held
+func (fh *FeedHistory) save() {
+	if fh.filename == "" {
+		return
+	}
+
+	data, err := json.Marshal(fh.days)
+	if err == nil {
+		if err = ioutil.WriteFile(fh.filename+".tmp", data, 0644); err == nil {
+			err = os.Rename(fh.filename+".tmp", fh.filename)
+		}
+	}
+	if err != nil {
+		// Tried again with the next flush
+		log.Printf("Could not write fetch history %s: %s", fh.filename, err.Error())
+		return
+	}
+	fh.dirty = false
+}
+
+// Add one fetch of a feed to today's aggregate, written out with the next
+// flush
+func (fh *FeedHistory) Record(pid datastore.PidType, latency time.Duration, items int, failed bool) {
+	if fh.filename == "" {
+		return
+	}
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	now := time.Now()
+	day := now.Format(historyDayLayout)
+	feeds, exists := fh.days[day]
+	if !exists {
+		feeds = make(map[datastore.PidType]*DailyStats)
+		fh.days[day] = feeds
+
+		// A new day is a good time to forget the oldest
+		cutoff := now.AddDate(0, 0, -config.History.Keep).Format(historyDayLayout)
+		for d := range fh.days {
+			if d < cutoff {
+				delete(fh.days, d)
+			}
+		}
+	}
+
+	stats, exists := feeds[pid]
+	if !exists {
+		stats = &DailyStats{}
+		feeds[pid] = stats
+	}
+	stats.Fetches++
+	stats.Items += items
+	stats.Latency += int64(latency / time.Millisecond)
+	if failed {
+		stats.Errors++
+	}
+	fh.dirty = true
+}
+
+// Aggregates for each feed over the week ending on the given day
+func (fh *FeedHistory) week(end time.Time) map[datastore.PidType]*DailyStats {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	totals := make(map[datastore.PidType]*DailyStats)
+	for i := 0; i < 7; i++ {
+		for pid, stats := range fh.days[end.AddDate(0, 0, -i).Format(historyDayLayout)] {
+			total, exists := totals[pid]
+			if !exists {
+				total = &DailyStats{}
+				totals[pid] = total
+			}
+			total.add(stats)
+		}
+	}
+	return totals
+}
+
+// Print a weekly trend summary of every feed over the given number of
+// weeks, oldest first, flagging feeds whose latest week has fallen to less
+// than half their earlier item rate or whose error rate has climbed.
+func printReport(weeks int) {
+	today := time.Now()
+	summaries := make([]map[datastore.PidType]*DailyStats, weeks)
+	pids := make(map[datastore.PidType]bool)
+	for w := 0; w < weeks; w++ {
+		summaries[weeks-1-w] = feedHistory.week(today.AddDate(0, 0, -7*w))
+		for pid := range summaries[weeks-1-w] {
+			pids[pid] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(pids))
+	for pid := range pids {
+		sorted = append(sorted, string(pid))
+	}
+	sort.Strings(sorted)
+
+	for _, pid := range sorted {
+		fmt.Printf("%s\n", pid)
+
+		var earlier DailyStats
+		var latest *DailyStats
+		for w, summary := range summaries {
+			stats := summary[datastore.PidType(pid)]
+			if stats == nil {
+				stats = &DailyStats{}
+			}
+			start := today.AddDate(0, 0, -7*(weeks-w)+1).Format(historyDayLayout)
+			fmt.Printf("    %s  %7.1f items/day  %5.1f%% errors  %6dms\n", start, float64(stats.Items)/7, errorRate(stats), averageLatency(stats))
+
+			if w == len(summaries)-1 {
+				latest = stats
+			} else {
+				earlier.add(stats)
+			}
+		}
+
+		if weeks < 2 || earlier.Fetches == 0 {
+			continue
+		}
+		earlierRate := float64(earlier.Items) / float64(weeks-1)
+		if float64(latest.Items) < earlierRate/2 {
+			fmt.Printf("    decaying: %d items this week against an average of %.1f a week\n", latest.Items, earlierRate)
+		}
+		if errorRate(latest) > errorRate(&earlier)+25 {
+			fmt.Printf("    failing: %.1f%% errors this week against %.1f%% before\n", errorRate(latest), errorRate(&earlier))
+		}
+	}
+}
+
+func errorRate(stats *DailyStats) float64 {
+	if stats.Fetches == 0 {
+		return 0
+	}
+	return 100 * float64(stats.Errors) / float64(stats.Fetches)
+}
+
+func averageLatency(stats *DailyStats) int64 {
+	if stats.Fetches == 0 {
+		return 0
+	}
+	return stats.Latency / int64(stats.Fetches)
+}
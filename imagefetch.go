@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// How many times an interrupted image download is resumed
+const maxImageResumes = 3
+
+// Download a picked image so that it can be inspected. If the connection
+// drops part way through and the server supports range requests, the
+// download carries on from where it stopped rather than starting again.
+func fetchImage(ctx context.Context, url string) ([]byte, error) {
+	v, err := sharedLinkFetch(&imageFlights, url, func() (interface{}, error) {
+		return downloadImage(ctx, url)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func downloadImage(ctx context.Context, url string) ([]byte, error) {
+	var buf bytes.Buffer
+	var validator string
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", buf.Len()))
+			// Only resume if the image has not changed in the meantime
+			req.Header.Set("If-Range", validator)
+		}
+
+		budget.AddRequest()
+		resp, err := fetchClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case buf.Len() > 0 && resp.StatusCode == http.StatusPartialContent:
+			// Appending to what we already have, so long as the server
+			// carries on from where the last response stopped
+			if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != int64(buf.Len()) {
+				resp.Body.Close()
+				if ctx.Err() != nil || attempt >= maxImageResumes {
+					return nil, fmt.Errorf("image fetch resumed at the wrong offset, Content-Range %q", resp.Header.Get("Content-Range"))
+				}
+				log.Printf("Image download of %s resumed at the wrong offset, starting again: Content-Range %q", url, resp.Header.Get("Content-Range"))
+				buf.Reset()
+				validator = ""
+				continue
+			}
+		case resp.StatusCode == http.StatusOK:
+			// A full response, either first time or because the server
+			// would not resume
+			buf.Reset()
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("image fetch returned %s", resp.Status)
+		}
+
+		if err := checkContentLength(resp, int64(config.Fetcher.Image.MaxBytes-buf.Len())); err != nil {
+			resp.Body.Close()
+			return nil, &TooLargeError{Limit: int64(config.Fetcher.Image.MaxBytes)}
+		}
+
+		resumable := resp.StatusCode == http.StatusPartialContent || strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes")
+		if v := resp.Header.Get("ETag"); v != "" && !strings.HasPrefix(v, "W/") {
+			validator = v
+		} else if resp.StatusCode == http.StatusOK {
+			validator = resp.Header.Get("Last-Modified")
+		}
+
+		remaining := int64(config.Fetcher.Image.MaxBytes + 1 - buf.Len())
+		_, err = io.Copy(&buf, io.LimitReader(throttledReader{countingReader{resp.Body}, imageBandwidth}, remaining))
+		resp.Body.Close()
+
+		if buf.Len() > config.Fetcher.Image.MaxBytes {
+			return nil, &TooLargeError{Limit: int64(config.Fetcher.Image.MaxBytes)}
+		}
+		if err == nil {
+			return buf.Bytes(), nil
+		}
+
+		if ctx.Err() != nil || !resumable || validator == "" || attempt >= maxImageResumes {
+			return nil, err
+		}
+		log.Printf("Image download of %s interrupted after %d bytes, resuming: %s", url, buf.Len(), err.Error())
+		countMetric("image.resumes", 1)
+	}
+}
+
+// The first byte position of a Content-Range such as "bytes 100-199/200"
+func contentRangeStart(header string) (int64, bool) {
+	header = strings.TrimSpace(header)
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, false
+	}
+	spec := header[len("bytes "):]
+	dash := strings.IndexByte(spec, '-')
+	if dash <= 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
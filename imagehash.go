@@ -0,0 +1,15 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+)
+
+// How many of a profile's most recent image hashes are compared against
+const recentImageWindow = 5
+
+// Publishers that lack artwork often serve one share image under many urls
+// so images are compared by a hash of their content rather than their url
+func hashImage(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
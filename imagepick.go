@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"github.com/iand/imgpick"
+	"log"
+	"net/url"
+)
+
+type pickResult struct {
+	data *imgpick.MediaData
+	err  error
+}
+
+// Run imgpick under the context's deadline. imgpick cannot be interrupted so
+// on timeout the pick is abandoned and left to finish in the background;
+// the worker is released to carry on with other jobs.
+func detectMedia(ctx context.Context, link string) (*imgpick.MediaData, error) {
+	// Skip hosts whose breaker is open. The trial request is left for the
+	// default client's transport to claim, which records how it went.
+	if u, err := url.Parse(link); err == nil {
+		if err := breakers.Check(u.Hostname()); err != nil {
+			countMetric("breaker.rejected", 1)
+			return nil, err
+		}
+	}
+
+	if imagePlugin != nil {
+		return imagePlugin.Pick(ctx, link)
+	}
+
+	done := make(chan pickResult, 1)
+	go func() {
+		data, err := imgpick.DetectMedia(link, true)
+		done <- pickResult{data: data, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-ctx.Done():
+		log.Printf("Image pick for %s abandoned: %s", link, ctx.Err().Error())
+		countMetric("image.timeouts", 1)
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// Installations that already run an image proxy can have the fetcher only
+// choose the source image. Items then carry a proxy url that crops and
+// resizes the source on request, and nothing is downloaded locally. Style
+// is imgproxy or thumbor. Key and Salt sign urls; imgproxy expects both
+// hex encoded, thumbor uses Key as is. Without a key urls are unsigned.
+type ImageProxyConfig struct {
+	Url     string `toml:"url"` // base url of the proxy, empty to disable
+	Style   string `toml:"style"`
+	Key     string `toml:"key"`
+	Salt    string `toml:"salt"`
+	Width   int    `toml:"width"`
+	Height  int    `toml:"height"`
+	Resize  string `toml:"resize"`  // imgproxy resizing type, e.g. fill or fit
+	Gravity string `toml:"gravity"` // imgproxy gravity, sm for smart cropping
+}
+
+func imageProxyEnabled() bool {
+	return config.Image.Proxy.Url != ""
+}
+
+// The crop applied by the proxy, recorded with the item so urls can be
+// rebuilt if the proxy moves
+func imageProxyCrop() string {
+	return imageProxyCropSize(config.Image.Proxy.Width, config.Image.Proxy.Height)
+}
+
+// The crop of a gallery image, which keeps the image's own aspect when the
+// feed gives its size rather than cutting every image to the same frame
+func imageProxyMediaCrop(width int, height int) string {
+	pc := config.Image.Proxy
+	if width <= 0 || height <= 0 {
+		return imageProxyCrop()
+	}
+	return imageProxyCropSize(pc.Width, pc.Width*height/width)
+}
+
+func imageProxyCropSize(width int, height int) string {
+	pc := config.Image.Proxy
+	if pc.Style == "thumbor" {
+		return fmt.Sprintf("%dx%d/smart", width, height)
+	}
+	return fmt.Sprintf("rs:%s:%d:%d/g:%s", pc.Resize, width, height, pc.Gravity)
+}
+
+func imageProxyUrl(source string) (string, error) {
+	return imageProxyCropUrl(source, imageProxyCrop())
+}
+
+func imageProxyCropUrl(source string, crop string) (string, error) {
+	pc := config.Image.Proxy
+	base := strings.TrimRight(pc.Url, "/")
+
+	if pc.Style == "thumbor" {
+		path := crop + "/" + url.QueryEscape(source)
+		signature := "unsafe"
+		if pc.Key != "" {
+			mac := hmac.New(sha1.New, []byte(pc.Key))
+			mac.Write([]byte(path))
+			signature = base64.URLEncoding.EncodeToString(mac.Sum(nil))
+		}
+		return base + "/" + signature + "/" + path, nil
+	}
+
+	path := "/" + crop + "/" + base64.RawURLEncoding.EncodeToString([]byte(source))
+	signature := "insecure"
+	if pc.Key != "" {
+		key, err := hex.DecodeString(pc.Key)
+		if err != nil {
+			return "", fmt.Errorf("invalid image proxy key: %s", err.Error())
+		}
+		salt, err := hex.DecodeString(pc.Salt)
+		if err != nil {
+			return "", fmt.Errorf("invalid image proxy salt: %s", err.Error())
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(salt)
+		mac.Write([]byte(path))
+		signature = base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return base + "/" + signature + path, nil
+}
+
+// The media of an item as recorded with it, served through the proxy with
+// each image's own crop when images are proxied
+func proxiedMedia(media []ingest.MediaEntry) []ingest.MediaEntry {
+	if !imageProxyEnabled() {
+		return media
+	}
+
+	proxied := make([]ingest.MediaEntry, 0, len(media))
+	for _, m := range media {
+		crop := imageProxyMediaCrop(m.Width, m.Height)
+		u, err := imageProxyCropUrl(m.Url, crop)
+		if err != nil {
+			log.Printf("Could not build proxy url for %s: %s", m.Url, err.Error())
+			continue
+		}
+		m.Source = m.Url
+		m.Crop = crop
+		m.Url = u
+		proxied = append(proxied, m)
+	}
+	return proxied
+}
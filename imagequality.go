@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/url"
+)
+
+// Number of pixels sampled along each axis when testing for flat images
+const flatnessSamples = 32
+
+// Images with more pixels than this are rejected before decoding so that a
+// small file cannot expand into an enormous bitmap
+const maxDecodedPixels = 40 * 1000 * 1000
+
+// Check a picked image against the configured quality thresholds, returning
+// the reason it was rejected
+func checkImageQuality(data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("could not decode image: %s", err.Error())
+	}
+	if cfg.Width*cfg.Height > maxDecodedPixels {
+		return fmt.Errorf("image is too large to inspect (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("could not decode image: %s", err.Error())
+	}
+
+	q := config.Image.Quality
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	if w < q.MinWidth || h < q.MinHeight {
+		return fmt.Errorf("image is too small (%dx%d)", w, h)
+	}
+
+	aspect := float64(w) / float64(h)
+	if (q.MinAspect > 0 && aspect < q.MinAspect) || (q.MaxAspect > 0 && aspect > q.MaxAspect) {
+		return fmt.Errorf("image aspect ratio %.2f is out of bounds", aspect)
+	}
+
+	if q.MaxFlatness > 0 && flatness(img) > q.MaxFlatness {
+		return fmt.Errorf("image is mostly one color")
+	}
+
+	return nil
+}
+
+// Estimate the fraction of an image covered by its most common color by
+// sampling a grid of pixels. Colors are quantized so that compression noise
+// does not hide a flat background.
+func flatness(img image.Image) float64 {
+	b := img.Bounds()
+	counts := make(map[uint32]int)
+	total := 0
+
+	for y := 0; y < flatnessSamples; y++ {
+		for x := 0; x < flatnessSamples; x++ {
+			px := b.Min.X + x*b.Dx()/flatnessSamples
+			py := b.Min.Y + y*b.Dy()/flatnessSamples
+			r, g, bl, a := img.At(px, py).RGBA()
+			key := (r>>12)<<12 | (g>>12)<<8 | (bl>>12)<<4 | a>>12
+			counts[key]++
+			total++
+		}
+	}
+
+	most := 0
+	for _, c := range counts {
+		if c > most {
+			most = c
+		}
+	}
+	return float64(most) / float64(total)
+}
+
+// The image used when nothing acceptable could be picked for a link
+func placeholderImage(link string) string {
+	if config.Image.Placeholder != "" {
+		return config.Image.Placeholder
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + "/favicon.ico"
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/sync/singleflight"
+	"log"
+)
+
+// The same url is often fetched by more than one worker at once, when a
+// feed is followed by several profiles with their own settings, when a
+// slow cycle overlaps the next or when one link is shared by items of
+// different profiles. Concurrent fetches of the same normalized url share
+// the one request in flight and its response rather than each making
+// their own. A feed is only shared by callers that would send the same
+// request, so by profiles whose settings leave it fetched alike and that
+// hold the same validators and fingerprint for it. Each caller is given
+// its own copy of the feed, as pipelines rewrite items in place. The
+// fetch runs with the context of the caller that started it, so it is
+// cancelled for all of them together.
+var (
+	feedFlights  singleflight.Group
+	linkFlights  singleflight.Group
+	imageFlights singleflight.Group
+)
+
+func (job RssJob) sharedFetch(ctx context.Context, rec FetchRecord) (*FetchedFeed, error) {
+	key := sharedFeedKey(job.Pid, job.Url)
+	if key == "" {
+		return job.fetchHttpFeed(ctx, rec)
+	}
+	key += " " + rec.ETag + " " + rec.LastModified + " " + rec.Fingerprint
+
+	v, err, shared := feedFlights.Do(key, func() (interface{}, error) {
+		return job.fetchHttpFeed(ctx, rec)
+	})
+	if shared {
+		log.Printf("Feed %s for profile %s shared a fetch already in flight", redactedUrl(job.Url), job.Pid)
+		countMetric("feed.inflight", 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(*FetchedFeed).Copy(), nil
+}
+
+// Link checks and image downloads are read but never changed by their
+// callers, so the one result is handed to all of them
+func sharedLinkFetch(group *singleflight.Group, url string, fetch func() (interface{}, error)) (interface{}, error) {
+	key := feedUrlKey(url)
+	if key == "" {
+		key = url
+	}
+
+	v, err, shared := group.Do(key, fetch)
+	if shared {
+		countMetric("fetch.inflight", 1)
+	}
+	return v, err
+}
@@ -0,0 +1,62 @@
+package ingest
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/text/encoding/htmlindex"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Feeds written in a legacy charset such as windows-1251 or iso-8859-1 are
+// transcoded to UTF-8 before parsing, so their titles come through intact.
+// The charset named by the XML declaration describes the document as
+// written and is preferred. The one in the Content-Type of the response is
+// only used when the declaration names none and the body is not already
+// valid UTF-8, as servers often add a default charset of their own that
+// does not match the file.
+
+var xmlDeclEncoding = regexp.MustCompile(`^(\s*<\?xml\s[^>]*?encoding\s*=\s*)("[^"]*"|'[^']*')`)
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// The charset of a feed body, lower cased, empty when it is UTF-8 or
+// neither the body nor the content type says
+func FeedCharset(body []byte, contentType string) string {
+	if bytes.HasPrefix(body, utf8BOM) {
+		return ""
+	}
+
+	charset := ""
+	if m := xmlDeclEncoding.FindSubmatch(body); m != nil {
+		charset = strings.Trim(string(m[2]), `"'`)
+	} else if _, params, err := mime.ParseMediaType(contentType); err == nil && !utf8.Valid(body) {
+		charset = params["charset"]
+	}
+
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset == "utf-8" || charset == "utf8" || charset == "us-ascii" {
+		return ""
+	}
+	return charset
+}
+
+// A feed body as UTF-8, with its XML declaration saying so
+func ToUTF8(body []byte, contentType string) ([]byte, error) {
+	charset := FeedCharset(body, contentType)
+	if charset == "" {
+		return body, nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s feed: %s", charset, err.Error())
+	}
+	return xmlDeclEncoding.ReplaceAll(decoded, []byte(`${1}"UTF-8"`)), nil
+}
@@ -0,0 +1,144 @@
+package ingest
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// The full content of an entry, from RSS content:encoded, Atom content or
+// a JSON Feed item's content, is kept alongside its title. It is cleaned
+// to a small set of formatting elements so it can be shown as it is, with
+// scripts, styles, embeds and forms dropped together with their contents,
+// every other element reduced to its text, only plain attributes kept and
+// links and images resolved against the item's link. The plain text of
+// the content is kept as well for consumers that cannot show markup. Both
+// are cut short when longer than maxContentBytes.
+
+const maxContentBytes = 64 * 1024
+
+var (
+	droppedElements = regexp.MustCompile(`(?is)<(script|style|iframe|object|embed|form|noscript|svg|template)\b.*?</(script|style|iframe|object|embed|form|noscript|svg|template)\s*>`)
+	htmlComments    = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlTag         = regexp.MustCompile(`(?s)<(/?)([a-zA-Z][a-zA-Z0-9]*)\b([^>]*)>`)
+	contentAttr     = regexp.MustCompile(`(?is)([a-z-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	blockBreak      = regexp.MustCompile(`(?i)</?(p|div|br|li|h[1-6]|blockquote|pre|figure|figcaption|tr|ul|ol)\b[^>]*>`)
+)
+
+// The elements kept in cleaned content, with the attributes kept on each
+var contentElements = map[string][]string{
+	"p": nil, "br": nil, "hr": nil, "em": nil, "strong": nil, "b": nil, "i": nil, "u": nil, "s": nil,
+	"sub": nil, "sup": nil, "small": nil, "mark": nil, "q": nil, "cite": nil, "abbr": {"title"},
+	"ul": nil, "ol": nil, "li": nil, "dl": nil, "dt": nil, "dd": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"blockquote": nil, "pre": nil, "code": nil,
+	"figure": nil, "figcaption": nil,
+	"table": nil, "thead": nil, "tbody": nil, "tr": nil, "th": nil, "td": nil,
+	"a":   {"href", "title"},
+	"img": {"src", "alt", "title", "width", "height"},
+}
+
+var voidElements = map[string]bool{"br": true, "hr": true, "img": true}
+
+// Clean an entry's content, returning it as safe markup and as plain text
+func CleanContent(content string, base string) (string, string) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return "", ""
+	}
+	content = droppedElements.ReplaceAllString(content, "")
+	content = htmlComments.ReplaceAllString(content, "")
+
+	baseUrl, _ := url.Parse(base)
+	cleaned := htmlTag.ReplaceAllStringFunc(content, func(tag string) string {
+		m := htmlTag.FindStringSubmatch(tag)
+		name := strings.ToLower(m[2])
+		allowed, kept := contentElements[name]
+		if !kept {
+			return ""
+		}
+		if m[1] == "/" {
+			if voidElements[name] {
+				return ""
+			}
+			return "</" + name + ">"
+		}
+
+		out := "<" + name
+		for _, am := range contentAttr.FindAllStringSubmatch(m[3], -1) {
+			attr := strings.ToLower(am[1])
+			if !keptAttr(allowed, attr) {
+				continue
+			}
+			value := html.UnescapeString(strings.Trim(am[2], `"'`))
+			if attr == "href" || attr == "src" {
+				if value = contentUrl(value, baseUrl); value == "" {
+					continue
+				}
+			}
+			out += " " + attr + `="` + html.EscapeString(value) + `"`
+		}
+		if name == "img" && !strings.Contains(out, ` src="`) {
+			return ""
+		}
+		return out + ">"
+	})
+	cleaned = strings.TrimSpace(cleaned)
+
+	// Markup breaks become paragraph breaks, line breaks in the source are
+	// only spaces
+	text := blockBreak.ReplaceAllString(content, "\x00")
+	text = html.UnescapeString(htmlTags.ReplaceAllString(text, " "))
+	var paragraphs []string
+	for _, p := range strings.Split(text, "\x00") {
+		if p = normalizeSpace(p); p != "" {
+			paragraphs = append(paragraphs, p)
+		}
+	}
+	text = strings.Join(paragraphs, "\n\n")
+
+	return truncateContent(cleaned), truncateContent(text)
+}
+
+func keptAttr(allowed []string, attr string) bool {
+	for _, a := range allowed {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// A link or image url resolved against the item, empty unless it is http
+// or https
+func contentUrl(href string, base *url.URL) string {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
+
+// Cut content short at a rune boundary. Markup cut short may leave
+// elements open, which browsers close for themselves.
+func truncateContent(s string) string {
+	if len(s) <= maxContentBytes {
+		return s
+	}
+	cut := s[:maxContentBytes]
+	for !utf8.ValidString(cut) {
+		cut = cut[:len(cut)-1]
+	}
+	if i := strings.LastIndex(cut, "<"); i > strings.LastIndex(cut, ">") {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
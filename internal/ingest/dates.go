@@ -0,0 +1,121 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/iand/feedparser"
+	"strings"
+	"time"
+)
+
+// Which of an item's times places it on the timeline. With none the event
+// time is left unset for the datastore to decide.
+const (
+	EventNone      = "none"
+	EventPublished = "published"
+	EventHappens   = "happens"
+)
+
+func ValidEvent(event string) bool {
+	switch event {
+	case "", EventNone, EventPublished, EventHappens:
+		return true
+	}
+	return false
+}
+
+// Layouts tried in turn when parsing dates found in feeds, covering the
+// variations of RFC 3339 and RFC 822 seen in the wild
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"20060102T150405Z",
+	"20060102T150405",
+	"2006-01-02",
+	"20060102",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05",
+	"Monday, 2-Jan-06 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006",
+}
+
+// Zone abbreviations that turn up in RFC 822 dates. Go gives any other
+// abbreviation an offset of zero, so they are replaced with their offsets
+// before parsing.
+var zoneOffsets = map[string]string{
+	"UT":   "+0000",
+	"UTC":  "+0000",
+	"GMT":  "+0000",
+	"Z":    "+0000",
+	"EST":  "-0500",
+	"EDT":  "-0400",
+	"CST":  "-0600",
+	"CDT":  "-0500",
+	"MST":  "-0700",
+	"MDT":  "-0600",
+	"PST":  "-0800",
+	"PDT":  "-0700",
+	"BST":  "+0100",
+	"IST":  "+0530",
+	"CET":  "+0100",
+	"CEST": "+0200",
+	"EET":  "+0200",
+	"EEST": "+0300",
+	"JST":  "+0900",
+	"AEST": "+1000",
+	"AEDT": "+1100",
+}
+
+// Parse a date from a feed. Dates that give no zone are taken to be in loc,
+// or UTC when loc is nil.
+func ParseDate(s string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	s = strings.Join(strings.Fields(s), " ")
+	if i := strings.LastIndexByte(s, ' '); i != -1 {
+		if offset, exists := zoneOffsets[strings.ToUpper(s[i+1:])]; exists {
+			s = s[:i+1] + offset
+		}
+	}
+
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised date %q", s)
+}
+
+// The same wall clock time in loc, for feeds that label their local times
+// with the wrong zone
+func InLocation(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// Choose the event time for an item. Items without a happens-at time fall
+// back to their published time.
+func EventTime(event string, item *feedparser.FeedItem, ext *ItemExtensions) time.Time {
+	switch event {
+	case EventHappens:
+		if !ext.HappensAt.IsZero() {
+			return ext.HappensAt
+		}
+		fallthrough
+	case EventPublished:
+		if !item.When.IsZero() {
+			return item.When
+		}
+	}
+	return time.Unix(0, 0)
+}
@@ -0,0 +1,68 @@
+package ingest
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/iand/feedparser"
+	"github.com/placetime/datastore"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Dedup strategies decide which parts of a feed item identify it. Items
+// that produce the same key map to the same item id and so replace each
+// other rather than appearing twice.
+const (
+	DedupGuid     = "guid"
+	DedupGuidDate = "guiddate"
+	DedupContent  = "content"
+	DedupLink     = "link"
+)
+
+func ValidDedupStrategy(strategy string) bool {
+	switch strategy {
+	case "", DedupGuid, DedupGuidDate, DedupContent, DedupLink:
+		return true
+	}
+	return false
+}
+
+// Work out the id of a feed item under a dedup strategy. For the guiddate
+// strategy, dates are compared at the granularity of the dedup window in
+// seconds so that small changes within the window are ignored.
+func ItemId(strategy string, window int, item *feedparser.FeedItem) datastore.ItemIdType {
+	var key string
+	switch strategy {
+	case DedupGuidDate:
+		ts := item.When.Unix()
+		if window > 0 {
+			ts -= ts % int64(window)
+		}
+		key = item.Id + "\n" + strconv.FormatInt(ts, 10)
+	case DedupContent:
+		key = item.Title + "\n" + item.Link + "\n" + item.Description
+	case DedupLink:
+		key = item.Link
+	default:
+		key = item.Id
+	}
+
+	hasher := md5.New()
+	io.WriteString(hasher, key)
+	return datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+// A key for an item's title that ignores case, punctuation and spacing, so
+// that reposts of the same headline can be recognised. Empty for a title
+// with no words.
+func TitleKey(title string) string {
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(words, " "))))
+}
@@ -0,0 +1,233 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/iand/feedparser"
+	"html"
+	"strings"
+	"time"
+)
+
+// ItemExtensions holds the values of feed extension elements that
+// feedparser does not understand, so the body is scanned for them
+// separately. The item's dates are kept as written so they can be parsed
+// in the feed's timezone. License is the url of the license the item is
+// published under, taken from the item or failing that the feed. Content
+// is the item's full content as markup, not yet cleaned.
+type ItemExtensions struct {
+	Location  *GeoPoint
+	PlaceName string
+	HappensAt time.Time
+	Media     []MediaEntry
+	License   string
+	Content   string
+
+	PublishedText string
+	HappensText   string
+}
+
+// Extensions found in a feed body, keyed by item guid and by link
+type FeedExtensions map[string]*ItemExtensions
+
+// The extension elements of an RSS item or Atom entry. Locations use the
+// GeoRSS simple and W3C geo vocabularies, event times use the RSS event
+// module and xCal, media use Media RSS and enclosures, licenses use the
+// Creative Commons RSS module and Atom license links, full content uses
+// the RSS content module and Atom content.
+type extensionEntry struct {
+	Guid  string `xml:"guid"`
+	Id    string `xml:"id"`
+	Point string `xml:"http://www.georss.org/georss point"`
+	Lat   string `xml:"http://www.w3.org/2003/01/geo/wgs84_pos# lat"`
+	Long  string `xml:"http://www.w3.org/2003/01/geo/wgs84_pos# long"`
+
+	FeatureName string `xml:"http://www.georss.org/georss featurename"`
+
+	EventStart string `xml:"http://purl.org/rss/1.0/modules/event/ startdate"`
+	XCalStart  string `xml:"urn:ietf:params:xml:ns:xcal dtstart"`
+
+	PubDate   string `xml:"pubDate"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+	DcDate    string `xml:"http://purl.org/dc/elements/1.1/ date"`
+
+	MediaContent []mediaContent `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaGroups  []struct {
+		Content []mediaContent `xml:"http://search.yahoo.com/mrss/ content"`
+	} `xml:"http://search.yahoo.com/mrss/ group"`
+	Enclosures []struct {
+		Url  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"enclosure"`
+
+	CcLicense string `xml:"http://backend.userland.com/creativeCommonsRssModule license"`
+
+	Encoded     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	AtomContent struct {
+		Type  string `xml:"type,attr"`
+		Text  string `xml:",chardata"`
+		Inner string `xml:",innerxml"`
+	} `xml:"http://www.w3.org/2005/Atom content"`
+
+	// RSS links are element text, Atom links are href attributes
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+		Type string `xml:"type,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"link"`
+}
+
+func ExtractExtensions(body []byte) FeedExtensions {
+	extensions := make(FeedExtensions)
+	type keyedEntry struct {
+		ext  *ItemExtensions
+		keys []string
+	}
+	var entries []keyedEntry
+	var feedLicense string
+
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if license := licenseElement(start, dec); license != "" {
+			// Outside any item, so the license of the whole feed
+			if feedLicense == "" {
+				feedLicense = license
+			}
+			continue
+		}
+		if start.Name.Local != "item" && start.Name.Local != "entry" {
+			continue
+		}
+
+		var entry extensionEntry
+		if err := dec.DecodeElement(&entry, &start); err != nil {
+			continue
+		}
+
+		ext := &ItemExtensions{
+			Location:      entry.location(),
+			PlaceName:     strings.TrimSpace(entry.FeatureName),
+			PublishedText: firstNonEmpty(entry.PubDate, entry.Published, entry.DcDate, entry.Updated),
+			HappensText:   firstNonEmpty(entry.EventStart, entry.XCalStart),
+			Media:         entry.media(),
+			License:       strings.TrimSpace(entry.CcLicense),
+			Content:       entry.content(),
+		}
+
+		keys := []string{entry.Guid, entry.Id}
+		for _, l := range entry.Links {
+			switch strings.ToLower(l.Rel) {
+			case "enclosure":
+				continue
+			case "license":
+				if ext.License == "" {
+					ext.License = strings.TrimSpace(l.Href)
+				}
+				continue
+			}
+			keys = append(keys, l.Href, strings.TrimSpace(l.Text))
+		}
+		entries = append(entries, keyedEntry{ext: ext, keys: keys})
+	}
+
+	for _, e := range entries {
+		ext := e.ext
+		if ext.License == "" {
+			ext.License = feedLicense
+		}
+		if ext.Location == nil && ext.PublishedText == "" && ext.HappensText == "" && len(ext.Media) == 0 && ext.License == "" && ext.Content == "" {
+			continue
+		}
+		for _, key := range e.keys {
+			if key != "" {
+				extensions[key] = ext
+			}
+		}
+	}
+
+	return extensions
+}
+
+// The license url given by a feed level element, either a Creative Commons
+// RSS module license or an Atom link with rel license
+func licenseElement(start xml.StartElement, dec *xml.Decoder) string {
+	switch {
+	case start.Name.Space == "http://backend.userland.com/creativeCommonsRssModule" && start.Name.Local == "license":
+		var license string
+		dec.DecodeElement(&license, &start)
+		return strings.TrimSpace(license)
+	case start.Name.Local == "link":
+		var rel, href string
+		for _, a := range start.Attr {
+			switch a.Name.Local {
+			case "rel":
+				rel = strings.ToLower(strings.TrimSpace(a.Value))
+			case "href":
+				href = strings.TrimSpace(a.Value)
+			}
+		}
+		if rel == "license" {
+			return href
+		}
+	}
+	return ""
+}
+
+// The full content of an entry as markup. Atom content is text to be
+// escaped, escaped html or inline xhtml as its type says.
+func (e extensionEntry) content() string {
+	if strings.TrimSpace(e.Encoded) != "" {
+		return e.Encoded
+	}
+	switch strings.ToLower(e.AtomContent.Type) {
+	case "html", "text/html":
+		return e.AtomContent.Text
+	case "xhtml":
+		return e.AtomContent.Inner
+	case "", "text":
+		return html.EscapeString(e.AtomContent.Text)
+	}
+	// Other media types are content the item links to, not markup
+	return ""
+}
+
+func (e extensionEntry) location() *GeoPoint {
+	if fields := strings.Fields(e.Point); len(fields) == 2 {
+		return ParsePoint(fields[0], fields[1])
+	}
+	if e.Lat != "" && e.Long != "" {
+		return ParsePoint(e.Lat, e.Long)
+	}
+	return nil
+}
+
+// Find the extensions for an item, which are empty if the feed had none
+func (fe FeedExtensions) Lookup(item *feedparser.FeedItem) *ItemExtensions {
+	if ext, exists := fe[item.Id]; exists {
+		return ext
+	}
+	if ext, exists := fe[item.Link]; exists {
+		return ext
+	}
+	return &ItemExtensions{}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
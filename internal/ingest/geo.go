@@ -0,0 +1,82 @@
+package ingest
+
+import (
+	"strconv"
+	"strings"
+)
+
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func ParsePoint(lat string, lon string) *GeoPoint {
+	la, err1 := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	lo, err2 := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if err1 != nil || err2 != nil || la < -90 || la > 90 || lo < -180 || lo > 180 {
+		return nil
+	}
+	return &GeoPoint{Lat: la, Lon: lo}
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Encode a point as a geohash of the given number of characters
+func Geohash(p *GeoPoint, precision int) string {
+	lat := [2]float64{-90, 90}
+	lon := [2]float64{-180, 180}
+
+	hash := make([]byte, 0, precision)
+	even := true
+	bit, ch := 0, 0
+	for len(hash) < precision {
+		r, v := &lat, p.Lat
+		if even {
+			r, v = &lon, p.Lon
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// The cell a geohash covers as minlon, minlat, maxlon, maxlat, or nil for
+// an invalid geohash
+func GeohashBbox(hash string) []float64 {
+	lat := [2]float64{-90, 90}
+	lon := [2]float64{-180, 180}
+
+	even := true
+	for _, c := range hash {
+		ch := strings.IndexRune(geohashAlphabet, c)
+		if ch == -1 {
+			return nil
+		}
+		for mask := 16; mask > 0; mask >>= 1 {
+			r := &lat
+			if even {
+				r = &lon
+			}
+			mid := (r[0] + r[1]) / 2
+			if ch&mask != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return []float64{lon[0], lat[0], lon[1], lat[1]}
+}
@@ -0,0 +1,161 @@
+// Package ingest is the feed ingest pipeline shared by the fetcher daemon
+// and its debug commands. A feed body is parsed, then each item is
+// normalized by the feed's transforms and script, given an id under the
+// feed's dedup strategy and enriched with the feed extensions found for it.
+// Anything needing the datastore or the network, such as annotation, is
+// left to the caller so that the pipeline gives identical results wherever
+// it runs.
+package ingest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/iand/feedparser"
+	"github.com/placetime/datastore"
+	"regexp"
+	"time"
+)
+
+// A parsed feed together with the extension elements feedparser ignores
+type Feed struct {
+	*feedparser.Feed
+	Extensions FeedExtensions
+}
+
+// Parse an RSS, Atom or JSON Feed body, going by its content rather than
+// its content type
+func Parse(body []byte) (*Feed, error) {
+	if IsJsonFeed(body) {
+		return parseJsonFeed(body)
+	}
+	feed, err := feedparser.NewFeed(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse feed: %s", err.Error())
+	}
+	return &Feed{Feed: feed, Extensions: ExtractExtensions(body)}, nil
+}
+
+// Elements of a feed's header that change on every build of the feed
+// without its items changing
+var volatileElements = regexp.MustCompile(`(?is)<(lastBuildDate|updated|pubDate|generator)\b[^>]*>.*?</(lastBuildDate|updated|pubDate|generator)>`)
+
+// Fingerprint a feed body, ignoring whitespace between elements and the
+// build times in its header, so that a feed rebuilt with the same items
+// fingerprints the same
+func Fingerprint(body []byte) string {
+	header, items := body, []byte(nil)
+	if i := bytes.Index(body, []byte("<item")); i != -1 {
+		header, items = body[:i], body[i:]
+	} else if i := bytes.Index(body, []byte("<entry")); i != -1 {
+		header, items = body[:i], body[i:]
+	}
+
+	h := md5.New()
+	h.Write(bytes.Join(bytes.Fields(volatileElements.ReplaceAll(header, nil)), []byte(" ")))
+	h.Write(bytes.Join(bytes.Fields(items), []byte(" ")))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// A Script can rewrite an item in place, returning the tags it assigned and
+// whether the item should be kept
+type Script interface {
+	Apply(item *feedparser.FeedItem) ([]string, bool, error)
+}
+
+// The ingest settings of one feed. The zero Pipeline keeps items as they
+// are, identified by guid and placed on the timeline by the datastore.
+// Dates without a zone are taken to be in Location, or UTC when it is nil.
+// With ForceLocation every date is read as a wall clock time in Location
+// whatever zone it gives. Titles are tidied by Normalize once the item's id
+// is settled, so changing it does not change any ids.
+type Pipeline struct {
+	Transforms    []Transform
+	Script        Script
+	Dedup         string
+	DedupWindow   int
+	Event         string
+	Location      *time.Location
+	ForceLocation bool
+	Normalize     NormalizeConfig
+}
+
+// An item that has passed through the pipeline. Media holds the item's
+// images in feed order, the first of which is the item's image when the
+// feed gave no other. Content is the item's full content cleaned for
+// display and ContentText the same as plain text.
+type Item struct {
+	*feedparser.FeedItem
+	Id          datastore.ItemIdType
+	Tags        []string
+	Extensions  *ItemExtensions
+	Event       time.Time
+	Media       []MediaEntry
+	Content     string
+	ContentText string
+}
+
+// Run one item through the pipeline, updating it in place. Returns whether
+// the item should be kept. A failing script leaves the item kept and
+// unchanged by the script, with the failure returned alongside it.
+func (p *Pipeline) Process(extensions FeedExtensions, item *feedparser.FeedItem) (*Item, bool, error) {
+	ApplyTransforms(p.Transforms, item)
+
+	var tags []string
+	var err error
+	if p.Script != nil {
+		var keep bool
+		tags, keep, err = p.Script.Apply(item)
+		if !keep {
+			return nil, false, err
+		}
+	}
+
+	ext := extensions.Lookup(item)
+	p.parseDates(item, ext)
+
+	id := ItemId(p.Dedup, p.DedupWindow, item)
+	p.Normalize.Apply(item)
+
+	media := append([]MediaEntry(nil), ext.Media...)
+	if item.Image == "" && len(media) > 0 {
+		item.Image = media[0].Url
+	}
+	content, contentText := CleanContent(ext.Content, item.Link)
+
+	return &Item{
+		FeedItem:    item,
+		Id:          id,
+		Tags:        tags,
+		Extensions:  ext,
+		Event:       EventTime(p.Event, item, ext),
+		Media:       media,
+		Content:     content,
+		ContentText: contentText,
+	}, true, err
+}
+
+// Parse the item's dates from the feed as written, keeping the date
+// feedparser found when the text is not understood
+func (p *Pipeline) parseDates(item *feedparser.FeedItem, ext *ItemExtensions) {
+	parse := func(s string) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+		t, err := ParseDate(s, p.Location)
+		if err != nil {
+			return time.Time{}
+		}
+		if p.ForceLocation && p.Location != nil {
+			t = InLocation(t, p.Location)
+		}
+		return t
+	}
+
+	if t := parse(ext.PublishedText); !t.IsZero() {
+		item.When = t
+	} else if p.ForceLocation && p.Location != nil && !item.When.IsZero() {
+		item.When = InLocation(item.When, p.Location)
+	}
+	ext.HappensAt = parse(ext.HappensText)
+}
@@ -0,0 +1,154 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/iand/feedparser"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A JSON Feed, version 1 or 1.1, as described at jsonfeed.org. Its items
+// are mapped onto the same feedparser items as RSS and Atom, with the
+// item's image and image attachments as its media and its dates kept as
+// written for the pipeline to parse. Many of the blogs publishing JSON
+// Feed post short notes without titles, which are titled from the start
+// of their text.
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url"`
+	Description string         `json:"description"`
+	Icon        string         `json:"icon"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	Id            json.RawMessage `json:"id"`
+	Url           string          `json:"url"`
+	ExternalUrl   string          `json:"external_url"`
+	Title         string          `json:"title"`
+	ContentHtml   string          `json:"content_html"`
+	ContentText   string          `json:"content_text"`
+	Summary       string          `json:"summary"`
+	Image         string          `json:"image"`
+	BannerImage   string          `json:"banner_image"`
+	DatePublished string          `json:"date_published"`
+	DateModified  string          `json:"date_modified"`
+	Attachments   []struct {
+		Url      string `json:"url"`
+		MimeType string `json:"mime_type"`
+		Title    string `json:"title"`
+	} `json:"attachments"`
+}
+
+// The longest title made from the text of an untitled item
+const maxDerivedTitle = 80
+
+var htmlTags = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// Whether a feed body is a JSON Feed rather than XML
+func IsJsonFeed(body []byte) bool {
+	body = bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	if len(body) == 0 || body[0] != '{' {
+		return false
+	}
+	var head struct {
+		Version string `json:"version"`
+	}
+	return json.Unmarshal(body, &head) == nil && strings.Contains(head.Version, "jsonfeed.org/version/")
+}
+
+func parseJsonFeed(body []byte) (*Feed, error) {
+	var jf jsonFeed
+	if err := json.Unmarshal(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")), &jf); err != nil {
+		return nil, fmt.Errorf("could not parse json feed: %s", err.Error())
+	}
+
+	feed := &feedparser.Feed{
+		Title:       strings.TrimSpace(jf.Title),
+		Link:        jf.HomePageUrl,
+		Description: jf.Description,
+		Image:       jf.Icon,
+	}
+	extensions := make(FeedExtensions)
+	for _, ji := range jf.Items {
+		item := &feedparser.FeedItem{
+			Id:          jsonFeedId(ji.Id),
+			Title:       strings.TrimSpace(html.UnescapeString(ji.Title)),
+			Link:        firstNonEmpty(ji.Url, ji.ExternalUrl),
+			Description: firstNonEmpty(ji.ContentHtml, ji.ContentText, ji.Summary),
+			Image:       firstNonEmpty(ji.Image, ji.BannerImage),
+		}
+		if item.Id == "" {
+			item.Id = item.Link
+		}
+		if item.Title == "" {
+			item.Title = derivedTitle(firstNonEmpty(ji.Summary, ji.ContentText, ji.ContentHtml))
+		}
+		published := firstNonEmpty(ji.DatePublished, ji.DateModified)
+		if t, err := time.Parse(time.RFC3339, published); err == nil {
+			item.When = t
+		}
+		feed.Items = append(feed.Items, item)
+
+		ext := &ItemExtensions{PublishedText: published, Content: ji.ContentHtml}
+		if ext.Content == "" {
+			ext.Content = html.EscapeString(ji.ContentText)
+		}
+		seen := make(map[string]bool)
+		for _, url := range []string{ji.Image, ji.BannerImage} {
+			if url = strings.TrimSpace(url); url != "" && !seen[url] {
+				seen[url] = true
+				ext.Media = append(ext.Media, MediaEntry{Url: url})
+			}
+		}
+		for _, a := range ji.Attachments {
+			url := strings.TrimSpace(a.Url)
+			if url == "" || seen[url] || len(ext.Media) >= maxMediaEntries || !isImageMedia("", a.MimeType, url) {
+				continue
+			}
+			seen[url] = true
+			ext.Media = append(ext.Media, MediaEntry{Url: url, Type: a.MimeType, Caption: strings.TrimSpace(a.Title)})
+		}
+		for _, key := range []string{item.Id, item.Link} {
+			if key != "" {
+				extensions[key] = ext
+			}
+		}
+	}
+	return &Feed{Feed: feed, Extensions: extensions}, nil
+}
+
+// Item ids should be strings but some feeds give numbers
+func jsonFeedId(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return strings.TrimSpace(s)
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// A title from the start of an untitled item's text, cut at a word
+func derivedTitle(text string) string {
+	text = normalizeSpace(html.UnescapeString(htmlTags.ReplaceAllString(text, " ")))
+	if len([]rune(text)) <= maxDerivedTitle {
+		return text
+	}
+	cut := string([]rune(text)[:maxDerivedTitle])
+	if i := strings.LastIndex(cut, " "); i > maxDerivedTitle/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:") + "…"
+}
+
+func jsonFeedNextPage(body []byte) string {
+	var head struct {
+		NextUrl string `json:"next_url"`
+	}
+	json.Unmarshal(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")), &head)
+	return strings.TrimSpace(head.NextUrl)
+}
@@ -0,0 +1,103 @@
+package ingest
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The images of an item, in the order the feed gives them. Photo essays and
+// event galleries carry several, as Media RSS content, directly or in
+// groups, or as RSS enclosures and Atom enclosure links. Width and Height
+// are as the feed states them, zero when not given. Source and Crop are
+// set by the fetcher when images are served by a proxy, which then serves
+// Url.
+type MediaEntry struct {
+	Url     string `json:"url"`
+	Type    string `json:"type,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	Credit  string `json:"credit,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Crop    string `json:"crop,omitempty"`
+}
+
+// The most media entries kept for one item
+const maxMediaEntries = 20
+
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".avif": true,
+}
+
+type mediaContent struct {
+	Url         string `xml:"url,attr"`
+	Type        string `xml:"type,attr"`
+	Medium      string `xml:"medium,attr"`
+	Width       string `xml:"width,attr"`
+	Height      string `xml:"height,attr"`
+	Title       string `xml:"http://search.yahoo.com/mrss/ title"`
+	Description string `xml:"http://search.yahoo.com/mrss/ description"`
+	Credit      string `xml:"http://search.yahoo.com/mrss/ credit"`
+}
+
+// Whether a media element is an image, going by its medium, its type or
+// failing both the extension of its url
+func isImageMedia(medium string, mediaType string, url string) bool {
+	switch {
+	case medium != "":
+		return strings.ToLower(medium) == "image"
+	case mediaType != "":
+		return strings.HasPrefix(strings.ToLower(mediaType), "image/")
+	}
+	ext := path.Ext(strings.SplitN(url, "?", 2)[0])
+	return imageExtensions[strings.ToLower(ext)]
+}
+
+func (e extensionEntry) media() []MediaEntry {
+	var media []MediaEntry
+	seen := make(map[string]bool)
+	add := func(entry MediaEntry) {
+		entry.Url = strings.TrimSpace(entry.Url)
+		if entry.Url == "" || seen[entry.Url] || len(media) >= maxMediaEntries {
+			return
+		}
+		seen[entry.Url] = true
+		media = append(media, entry)
+	}
+	addContent := func(mc mediaContent) {
+		if !isImageMedia(mc.Medium, mc.Type, mc.Url) {
+			return
+		}
+		width, _ := strconv.Atoi(mc.Width)
+		height, _ := strconv.Atoi(mc.Height)
+		add(MediaEntry{
+			Url:     mc.Url,
+			Type:    mc.Type,
+			Width:   width,
+			Height:  height,
+			Caption: firstNonEmpty(mc.Description, mc.Title),
+			Credit:  strings.TrimSpace(mc.Credit),
+		})
+	}
+
+	for _, mc := range e.MediaContent {
+		addContent(mc)
+	}
+	for _, g := range e.MediaGroups {
+		for _, mc := range g.Content {
+			addContent(mc)
+		}
+	}
+	for _, enc := range e.Enclosures {
+		if isImageMedia("", enc.Type, enc.Url) {
+			add(MediaEntry{Url: enc.Url, Type: enc.Type})
+		}
+	}
+	for _, l := range e.Links {
+		if strings.ToLower(l.Rel) == "enclosure" && isImageMedia("", l.Type, l.Href) {
+			add(MediaEntry{Url: l.Href, Type: l.Type})
+		}
+	}
+	return media
+}
@@ -0,0 +1,128 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/iand/feedparser"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Tidies the titles of ingested items so timelines read consistently
+// whatever a publisher's house style. Whitespace folds non-breaking and
+// other odd spaces into plain ones and collapses runs of them. Quotes
+// straightens curly quotes. Punctuation reduces runs such as "!!!" or
+// "?!?!" to a single mark of each kind. Shouting recases titles written
+// entirely in capitals, as "sentence" or "title" case.
+type NormalizeConfig struct {
+	Whitespace  bool   `toml:"whitespace"`
+	Quotes      bool   `toml:"quotes"`
+	Punctuation bool   `toml:"punctuation"`
+	Shouting    string `toml:"shouting"`
+}
+
+// Titles with fewer letters than this are left in capitals, they are more
+// likely acronyms than shouting
+const minShoutingLetters = 8
+
+var (
+	quoteReplacer = strings.NewReplacer(
+		"‘", "'", "’", "'", "‚", "'", "‛", "'",
+		"“", `"`, "”", `"`, "„", `"`, "‟", `"`,
+	)
+	repeatedMarks = regexp.MustCompile(`[!?]{2,}`)
+	repeatedDots  = regexp.MustCompile(`\.{4,}`)
+	repeatedComma = regexp.MustCompile(`,{2,}`)
+)
+
+func (nc NormalizeConfig) Validate() error {
+	switch nc.Shouting {
+	case "", "sentence", "title":
+		return nil
+	}
+	return fmt.Errorf("unknown shouting style %q", nc.Shouting)
+}
+
+func (nc NormalizeConfig) Apply(item *feedparser.FeedItem) {
+	title := item.Title
+	if nc.Whitespace {
+		title = normalizeSpace(title)
+	}
+	if nc.Quotes {
+		title = quoteReplacer.Replace(title)
+	}
+	if nc.Punctuation {
+		title = normalizePunctuation(title)
+	}
+	if nc.Shouting != "" && isShouting(title) {
+		title = recase(title, nc.Shouting == "title")
+	}
+	item.Title = title
+}
+
+func normalizeSpace(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\u200b' || r == '\u200c' || r == '\u200d' || r == '\ufeff':
+			// Zero width characters are dropped altogether
+			return -1
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func normalizePunctuation(s string) string {
+	s = repeatedMarks.ReplaceAllStringFunc(s, func(marks string) string {
+		// Keep one of each mark in the order they first appear, so "?!?!"
+		// becomes "?!"
+		var kept strings.Builder
+		for _, r := range marks {
+			if !strings.ContainsRune(kept.String(), r) {
+				kept.WriteRune(r)
+			}
+		}
+		return kept.String()
+	})
+	s = repeatedDots.ReplaceAllString(s, "...")
+	return repeatedComma.ReplaceAllString(s, ",")
+}
+
+// Whether a title is written entirely in capitals
+func isShouting(s string) bool {
+	letters := 0
+	for _, r := range s {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsUpper(r) {
+			letters++
+		}
+	}
+	return letters >= minShoutingLetters
+}
+
+// Lower case a title, capitalizing the start of each sentence or with
+// titleCase the start of each word
+func recase(s string, titleCase bool) string {
+	runes := []rune(strings.ToLower(s))
+	capitalize := true
+	for i, r := range runes {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if capitalize {
+				runes[i] = unicode.ToUpper(r)
+				capitalize = false
+			}
+		case r == '.' || r == '!' || r == '?' || r == ':':
+			capitalize = true
+		case unicode.IsSpace(r) || r == '-' || r == '/':
+			if titleCase {
+				capitalize = true
+			}
+		}
+	}
+	return string(runes)
+}
@@ -0,0 +1,56 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+// The link to the next older page of a feed split across pages as RFC 5005
+// describes, empty for a complete feed or its oldest page. An archived feed
+// links its previous archive document with prev-archive and a paged feed
+// its next page with next. Links within items are not the feed's own and
+// are skipped. A JSON Feed links its next page with next_url.
+func OlderPage(body []byte) string {
+	if IsJsonFeed(body) {
+		return jsonFeedNextPage(body)
+	}
+
+	var next, prevArchive string
+
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "item", "entry":
+			dec.Skip()
+		case "link":
+			var rel, href string
+			for _, a := range start.Attr {
+				switch a.Name.Local {
+				case "rel":
+					rel = strings.ToLower(strings.TrimSpace(a.Value))
+				case "href":
+					href = strings.TrimSpace(a.Value)
+				}
+			}
+			switch {
+			case rel == "prev-archive" && prevArchive == "":
+				prevArchive = href
+			case rel == "next" && next == "":
+				next = href
+			}
+		}
+	}
+
+	return firstNonEmpty(prevArchive, next)
+}
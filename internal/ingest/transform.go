@@ -0,0 +1,53 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/iand/feedparser"
+	"regexp"
+)
+
+// A transform rewrites one field of each item ingested from a feed, e.g.
+//
+//	[[feeds."bbcnews".transform]]
+//	field = "title"
+//	pattern = "^\\[Sponsored\\]\\s*"
+//	replace = ""
+type TransformConfig struct {
+	Field   string `toml:"field"`
+	Pattern string `toml:"pattern"`
+	Replace string `toml:"replace"`
+}
+
+type Transform struct {
+	Field   string
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+func CompileTransforms(tcs []TransformConfig) ([]Transform, error) {
+	transforms := make([]Transform, 0, len(tcs))
+	for _, tc := range tcs {
+		if tc.Field != "title" && tc.Field != "link" {
+			return nil, fmt.Errorf("unknown transform field %q", tc.Field)
+		}
+
+		re, err := regexp.Compile(tc.Pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		transforms = append(transforms, Transform{Field: tc.Field, Pattern: re, Replace: tc.Replace})
+	}
+	return transforms, nil
+}
+
+func ApplyTransforms(transforms []Transform, item *feedparser.FeedItem) {
+	for _, t := range transforms {
+		switch t.Field {
+		case "title":
+			item.Title = t.Pattern.ReplaceAllString(item.Title, t.Replace)
+		case "link":
+			item.Link = t.Pattern.ReplaceAllString(item.Link, t.Replace)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/placetime/datastore"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The API answers item queries from an index held in memory of each item's
+// profile, time added, tags and location, so a request only reads the
+// metadata of the items on the page it returns rather than the whole
+// metadata directory. The index is built from the directory once when the
+// API starts and kept up to date as metadata is written. Items are also
+// indexed by profile, so the timeline of one profile is found without
+// looking at the others.
+type ItemIndex struct {
+	mu      sync.RWMutex
+	started bool
+	items   map[datastore.ItemIdType]*ItemMeta
+	byPid   map[datastore.PidType]map[datastore.ItemIdType]*ItemMeta
+}
+
+var itemIndex = &ItemIndex{}
+
+// The fields of an item's metadata that queries filter on
+func indexEntry(meta *ItemMeta) *ItemMeta {
+	return &ItemMeta{Id: meta.Id, Pid: meta.Pid, Added: meta.Added, Tags: meta.Tags, Location: meta.Location}
+}
+
+// Start indexing written metadata and read in what is already on disk
+func (ix *ItemIndex) Load() {
+	ix.mu.Lock()
+	ix.started = true
+	ix.items = make(map[datastore.ItemIdType]*ItemMeta)
+	ix.byPid = make(map[datastore.PidType]map[datastore.ItemIdType]*ItemMeta)
+	ix.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(config.Meta.Path)
+	if err != nil {
+		log.Printf("Could not index item metadata: %s", err.Error())
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		meta, err := readItemMeta(datastore.ItemIdType(strings.TrimSuffix(name, ".json")))
+		if err != nil {
+			continue
+		}
+
+		ix.mu.Lock()
+		// Anything written while loading is newer than what was read
+		if _, exists := ix.items[meta.Id]; !exists {
+			ix.put(meta)
+		}
+		ix.mu.Unlock()
+	}
+
+	ix.mu.Lock()
+	count := len(ix.items)
+	ix.mu.Unlock()
+	log.Printf("Indexed %d items", count)
+}
+
+// Index metadata as it is written
+func (ix *ItemIndex) Put(meta *ItemMeta) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.started {
+		ix.put(meta)
+	}
+}
+
+// Must be called with the lock held
+func (ix *ItemIndex) put(meta *ItemMeta) {
+	if old, exists := ix.items[meta.Id]; exists {
+		delete(ix.byPid[old.Pid], meta.Id)
+	}
+	if meta.MigratedTo != "" {
+		// Only the item it moved to is listed
+		delete(ix.items, meta.Id)
+		return
+	}
+
+	entry := indexEntry(meta)
+	ix.items[meta.Id] = entry
+	if ix.byPid[entry.Pid] == nil {
+		ix.byPid[entry.Pid] = make(map[datastore.ItemIdType]*ItemMeta)
+	}
+	ix.byPid[entry.Pid][entry.Id] = entry
+}
+
+// The ids of the items matching a query, newest first, skipping the first
+// offset of them and returning at most limit
+func (ix *ItemIndex) Query(q *ItemQuery, offset int, limit int) []datastore.ItemIdType {
+	ix.mu.RLock()
+	candidates := ix.items
+	if q.Pid != "" {
+		candidates = ix.byPid[q.Pid]
+	}
+	matches := make([]*ItemMeta, 0)
+	for _, entry := range candidates {
+		if q.Matches(entry) {
+			matches = append(matches, entry)
+		}
+	}
+	ix.mu.RUnlock()
+
+	sort.Sort(sort.Reverse(byAdded(matches)))
+	if offset >= len(matches) {
+		return nil
+	}
+	matches = matches[offset:]
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	ids := make([]datastore.ItemIdType, len(matches))
+	for i, entry := range matches {
+		ids[i] = entry.Id
+	}
+	return ids
+}
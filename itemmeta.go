@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ItemMeta holds information the fetcher learns about an item that has no
+// place in the datastore item record. One JSON file is written per item in
+// the metadata directory so the frontend can read it directly.
+type ItemMeta struct {
+	Id         datastore.ItemIdType `json:"id"`
+	Pid        datastore.PidType    `json:"pid,omitempty"`
+	Via        datastore.PidType    `json:"via,omitempty"`
+	Guid       string               `json:"guid,omitempty"`
+	Title      string               `json:"title,omitempty"`
+	Link       string               `json:"link,omitempty"`
+	Image      string               `json:"image,omitempty"`
+	Added      int64                `json:"added,omitempty"`
+	Published  int64                `json:"published,omitempty"`
+	HappensAt  int64                `json:"happensat,omitempty"`
+	Tags       []string             `json:"tags,omitempty"`
+	Score      float64              `json:"score,omitempty"`
+	Rank       float64              `json:"rank,omitempty"`
+	Location   *GeoPoint            `json:"location,omitempty"`
+	Geohash    string               `json:"geohash,omitempty"`
+	Cluster    string               `json:"cluster,omitempty"`
+	Outside    bool                 `json:"outside,omitempty"`
+	FinalUrl   string               `json:"finalurl,omitempty"`
+	Canonical  string               `json:"canonical,omitempty"`
+	Redirects  []string             `json:"redirects,omitempty"`
+	Status     int                  `json:"status,omitempty"`
+	Paywalled  bool                 `json:"paywalled,omitempty"`
+	Disallowed bool                 `json:"disallowed,omitempty"`
+	Checked    int64                `json:"checked,omitempty"`
+	License    string               `json:"license,omitempty"`
+
+	// An archived copy of the page, used when the page itself is gone
+	ArchiveUrl string `json:"archiveurl,omitempty"`
+
+	ImageChecked  int64  `json:"imagechecked,omitempty"`
+	ImageModified string `json:"imagemodified,omitempty"`
+	ImageHash     string `json:"imagehash,omitempty"`
+	ImageAlt      string `json:"imagealt,omitempty"`
+	RepeatedImage bool   `json:"repeatedimage,omitempty"`
+
+	// The picked image and crop when images are served by a proxy
+	ImageSource string `json:"imagesource,omitempty"`
+	ImageCrop   string `json:"imagecrop,omitempty"`
+
+	// All of the item's images in the order the feed gave them
+	Media []MediaEntry `json:"media,omitempty"`
+
+	// The item's full content from its feed, as cleaned markup and as text
+	Content     string `json:"content,omitempty"`
+	ContentText string `json:"contenttext,omitempty"`
+
+	// The video that is the main media of the item's page
+	Video *PageVideo `json:"video,omitempty"`
+
+	// The document the item links to, when it links to one
+	Document *ItemDocument `json:"document,omitempty"`
+
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// Set once migrate-ids has moved the item to a new id
+	MigratedTo datastore.ItemIdType `json:"migratedto,omitempty"`
+}
+
+// Provenance records how an item came to be ingested so that data quality
+// problems can be traced to a particular fetch and fetcher build
+type Provenance struct {
+	Source   string `json:"source"`
+	Feed     string `json:"feed"`
+	Fetched  int64  `json:"fetched"`
+	Snapshot string `json:"snapshot"`
+	Version  string `json:"version"`
+}
+
+type GeoPoint = ingest.GeoPoint
+
+type MediaEntry = ingest.MediaEntry
+
+var itemMetaMutex sync.Mutex
+
+// The profile whose feed the item came from, which for items routed into a
+// virtual profile is not the profile that holds the item
+func (meta *ItemMeta) SourcePid() datastore.PidType {
+	if meta.Via != "" {
+		return meta.Via
+	}
+	return meta.Pid
+}
+
+func itemMetaFilename(id datastore.ItemIdType) string {
+	return filepath.Join(config.Meta.Path, string(id)+".json")
+}
+
+// Read the metadata for an item, returning an empty record if none has been
+// written yet
+func readItemMeta(id datastore.ItemIdType) (*ItemMeta, error) {
+	meta := &ItemMeta{Id: id}
+
+	data, err := ioutil.ReadFile(itemMetaFilename(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func writeItemMeta(meta *ItemMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial record
+	filename := itemMetaFilename(meta.Id)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	itemIndex.Put(meta)
+	return nil
+}
+
+// Read the metadata for every item that has been recorded
+func allItemMeta() ([]*ItemMeta, error) {
+	entries, err := ioutil.ReadDir(config.Meta.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	metas := make([]*ItemMeta, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		meta, err := readItemMeta(datastore.ItemIdType(strings.TrimSuffix(name, ".json")))
+		if err != nil || meta.MigratedTo != "" {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// Apply fn to the stored metadata for an item and write the result back
+func updateItemMeta(id datastore.ItemIdType, fn func(*ItemMeta)) error {
+	itemMetaMutex.Lock()
+	defer itemMetaMutex.Unlock()
+
+	meta, err := readItemMeta(id)
+	if err != nil {
+		return err
+	}
+	fn(meta)
+	return writeItemMeta(meta)
+}
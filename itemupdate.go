@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"github.com/placetime/datastore"
+	"reflect"
+	"time"
+)
+
+// How many times a conflicting item update is tried before giving up
+const itemUpdateAttempts = 3
+
+type ItemConflictError struct {
+	Id       datastore.ItemIdType
+	Attempts int
+}
+
+func (e *ItemConflictError) Error() string {
+	return fmt.Sprintf("item %s changed during each of %d attempts to update it", e.Id, e.Attempts)
+}
+
+// Apply fn to a fresh copy of an item and write it back, so the fields fn
+// sets are the only ones the fetcher writes. The datastore keeps no version
+// of an item to compare and swap on, so the item as read stands in for one:
+// it is read again just before writing and when it has changed, say by an
+// edit in the web app, the update starts over from the new copy. Returns the
+// item as written.
+func updateItem(s *datastore.RedisStore, id datastore.ItemIdType, fn func(*datastore.Item)) (*datastore.Item, error) {
+	for attempt := 1; ; attempt++ {
+		item, err := s.Item(id)
+		if err != nil {
+			return nil, err
+		}
+
+		read := *item
+		fn(item)
+		if reflect.DeepEqual(*item, read) {
+			return item, nil
+		}
+
+		current, err := s.Item(id)
+		if err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(*current, read) {
+			return item, s.UpdateItem(item)
+		}
+
+		countMetric("item.conflicts", 1)
+		if attempt == itemUpdateAttempts {
+			return nil, &ItemConflictError{Id: id, Attempts: attempt}
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+}
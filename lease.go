@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"log"
+	"sync"
+	"time"
+)
+
+// Items grabbed for image picking are leased for Ttl seconds in redis and
+// the lease renewed while the item waits in the queue and is worked on. A
+// fetcher that dies stops renewing, and once its leases expire any fetcher
+// grabbing images puts the items back in its queue. Items another fetcher
+// holds a lease on are skipped rather than picked twice.
+type LeaseConfig struct {
+	Addr   string `toml:"addr"` // host:port of the redis server, empty to disable
+	Prefix string `toml:"prefix"`
+	Ttl    int    `toml:"ttl"`
+}
+
+// What is needed to queue a leased item again
+type leasedJob struct {
+	Pid datastore.PidType `json:"pid"`
+	Url string            `json:"url"`
+}
+
+type LeaseSet struct {
+	mu   sync.Mutex
+	pool *redis.Pool
+	held map[datastore.ItemIdType]bool
+}
+
+var leases = &LeaseSet{held: make(map[datastore.ItemIdType]bool)}
+
+func initLeases() {
+	if config.Leases.Addr == "" {
+		return
+	}
+
+	leases.pool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.Leases.Addr)
+		},
+	}
+	log.Printf("Leasing grabbed items in redis at %s", config.Leases.Addr)
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(config.Leases.Ttl) * time.Second / 3)
+			leases.renew()
+		}
+	}()
+}
+
+func (ls *LeaseSet) expiryKey() string {
+	return config.Leases.Prefix + "expiry"
+}
+
+func (ls *LeaseSet) jobsKey() string {
+	return config.Leases.Prefix + "jobs"
+}
+
+func (ls *LeaseSet) expiry() int64 {
+	return time.Now().Unix() + int64(config.Leases.Ttl)
+}
+
+// Take the lease on an item, reporting whether it is ours to work on. When
+// leases are disabled or redis cannot be reached every item is.
+func (ls *LeaseSet) Acquire(pid datastore.PidType, id datastore.ItemIdType, url string) bool {
+	if ls.pool == nil {
+		return true
+	}
+
+	job, err := json.Marshal(leasedJob{Pid: pid, Url: url})
+	if err != nil {
+		return true
+	}
+
+	conn := ls.pool.Get()
+	defer conn.Close()
+
+	added, err := redis.Int(conn.Do("ZADD", ls.expiryKey(), "NX", ls.expiry(), string(id)))
+	if err != nil {
+		log.Printf("Failed to lease item %s: %s", id, err.Error())
+		return true
+	}
+	if added == 0 {
+		countMetric("lease.held", 1)
+		return false
+	}
+
+	if _, err := conn.Do("HSET", ls.jobsKey(), string(id), string(job)); err != nil {
+		log.Printf("Failed to record leased item %s: %s", id, err.Error())
+	}
+
+	ls.mu.Lock()
+	ls.held[id] = true
+	ls.mu.Unlock()
+	return true
+}
+
+// Give up the lease on an item once it has been dealt with
+func (ls *LeaseSet) Release(id datastore.ItemIdType) {
+	ls.mu.Lock()
+	held := ls.held[id]
+	delete(ls.held, id)
+	ls.mu.Unlock()
+	if !held {
+		return
+	}
+
+	conn := ls.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("ZREM", ls.expiryKey(), string(id)); err != nil {
+		log.Printf("Failed to release lease on item %s: %s", id, err.Error())
+	}
+	conn.Do("HDEL", ls.jobsKey(), string(id))
+}
+
+// Push back the expiry of every lease this fetcher holds
+func (ls *LeaseSet) renew() {
+	ls.mu.Lock()
+	ids := make([]datastore.ItemIdType, 0, len(ls.held))
+	for id := range ls.held {
+		ids = append(ids, id)
+	}
+	ls.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	conn := ls.pool.Get()
+	defer conn.Close()
+
+	expiry := ls.expiry()
+	for _, id := range ids {
+		if _, err := conn.Do("ZADD", ls.expiryKey(), "XX", expiry, string(id)); err != nil {
+			log.Printf("Failed to renew lease on item %s: %s", id, err.Error())
+			return
+		}
+	}
+}
+
+// Queue again the items whose leases have expired. Removing the lease
+// decides which fetcher gets each item when several reap at once.
+func (ls *LeaseSet) Reap(ctx context.Context, d *Dispatcher) {
+	if ls.pool == nil {
+		return
+	}
+
+	conn := ls.pool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", ls.expiryKey(), "-inf", time.Now().Unix()))
+	if err != nil {
+		log.Printf("Failed to read expired leases: %s", err.Error())
+		return
+	}
+
+	for _, id := range ids {
+		removed, err := redis.Int(conn.Do("ZREM", ls.expiryKey(), id))
+		if err != nil || removed == 0 {
+			continue
+		}
+
+		data, err := redis.Bytes(conn.Do("HGET", ls.jobsKey(), id))
+		conn.Do("HDEL", ls.jobsKey(), id)
+		var job leasedJob
+		if err == nil {
+			err = json.Unmarshal(data, &job)
+		}
+		if err != nil {
+			log.Printf("Failed to read expired lease on item %s", id)
+			continue
+		}
+
+		log.Printf("Lease on item %s expired, queueing it again", id)
+		countMetric("lease.reaped", 1)
+		itemId := datastore.ItemIdType(id)
+		if ls.Acquire(job.Pid, itemId, job.Url) {
+			if d.Submit(ctx, job.Pid, ImageJob{Url: job.Url, ItemId: itemId}) != nil {
+				ls.Release(itemId)
+				return
+			}
+		}
+	}
+}
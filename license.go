@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"regexp"
+	"strings"
+)
+
+// Items record the license they are published under so that whatever
+// re-displays or re-syndicates them can honour it. The license is the url
+// of its deed, taken from the item in its feed, from the feed as a whole,
+// from the source's license setting or failing all of those from a license
+// link in the start of the item's page, as the Creative Commons badge
+// markup gives.
+var licenseAnchorPattern = regexp.MustCompile(`(?is)<a\s[^>]*\blicense\b[^>]*>`)
+
+// The license of an item as its feed or source gives it
+func itemLicense(pid datastore.PidType, ext *ingest.ItemExtensions) string {
+	if ext.License != "" {
+		return ext.License
+	}
+	return config.Feeds[string(pid)].License
+}
+
+// The license a page declares for itself
+func pageLicense(page []byte, base string) string {
+	for _, attrs := range linkTags(page) {
+		if hasRel(attrs["rel"], "license") {
+			if href := resolveHref(attrs["href"], base); href != "" {
+				return href
+			}
+		}
+	}
+	for _, tag := range licenseAnchorPattern.FindAll(page, -1) {
+		attrs := tagAttrs(tag)
+		if hasRel(attrs["rel"], "license") {
+			if href := resolveHref(attrs["href"], base); href != "" {
+				return href
+			}
+		}
+	}
+	return ""
+}
+
+// Whether a space separated rel attribute includes a link type
+func hasRel(rel string, linkType string) bool {
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		if r == linkType {
+			return true
+		}
+	}
+	return false
+}
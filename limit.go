@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Feeds and images are read up to a size limit, so a broken or hostile
+// server cannot run the fetcher out of memory
+type TooLargeError struct {
+	Limit int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("response is larger than %d bytes", e.Limit)
+}
+
+// Read all of r, failing once more than limit bytes have been read
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if int64(len(data)) > limit {
+		return nil, &TooLargeError{Limit: limit}
+	}
+	return data, err
+}
+
+// Fail early when a response declares a body over the limit
+func checkContentLength(resp *http.Response, limit int64) error {
+	if resp.ContentLength > limit {
+		return &TooLargeError{Limit: limit}
+	}
+	return nil
+}
+
+// A body that fails with a TooLargeError once more than its limit is read
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	limit     int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.remaining < 0 {
+		return 0, &TooLargeError{Limit: lb.limit}
+	}
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.body.Read(p)
+	lb.remaining -= int64(n)
+	if lb.remaining < 0 {
+		return n, &TooLargeError{Limit: lb.limit}
+	}
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	return lb.body.Close()
+}
+
+// LimitTransport caps the size of the bodies of its responses
+type LimitTransport struct {
+	Transport http.RoundTripper
+	Limit     int64
+}
+
+func (t *LimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil || t.Limit <= 0 {
+		return resp, err
+	}
+	if err := checkContentLength(resp, t.Limit); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Body = &limitedBody{body: resp.Body, remaining: t.Limit, limit: t.Limit}
+	return resp, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// How much of a page is examined when looking for interstitials
+const linkCheckPeekBytes = 64 * 1024
+
+// Fragments of markup or hostnames that commonly indicate a paywall or a
+// cookie consent wall rather than the article itself
+var (
+	interstitialHosts = []string{
+		"consent.google.",
+		"consent.yahoo.",
+		"consent.youtube.",
+		"guce.",
+		"myprivacy.",
+		"paywall.",
+	}
+
+	interstitialMarkers = [][]byte{
+		[]byte("piano.io"),
+		[]byte("tinypass"),
+		[]byte("subscriber-only"),
+		[]byte("subscribers only"),
+		[]byte("meteredcontent"),
+		[]byte("ispartofpaywall"),
+		[]byte("\"isaccessibleforfree\":false"),
+		[]byte("\"isaccessibleforfree\": false"),
+		[]byte("cookie-wall"),
+		[]byte("cookiewall"),
+		[]byte("consent-wall"),
+	}
+)
+
+// The most redirects recorded for a link
+const maxRedirectChain = 10
+
+type LinkStatus struct {
+	FinalUrl    string
+	Status      int
+	Paywalled   bool
+	Alternate   string
+	Canonical   string
+	ContentType string
+	License     string
+
+	// Every url visited on the way to FinalUrl, starting with the link
+	Redirects []string
+
+	// The start of the page's markup
+	Peek []byte
+}
+
+// Visit a link, following any redirects, and report where it ended up
+func checkLink(ctx context.Context, url string) (*LinkStatus, error) {
+	v, err := sharedLinkFetch(&linkFlights, url, func() (interface{}, error) {
+		return fetchLinkStatus(ctx, url)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*LinkStatus), nil
+}
+
+func fetchLinkStatus(ctx context.Context, url string) (*LinkStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	budget.AddRequest()
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ls := &LinkStatus{
+		FinalUrl:  resp.Request.URL.String(),
+		Status:    resp.StatusCode,
+		Redirects: redirectChain(resp),
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		ls.ContentType = mediaType
+	}
+
+	if isInterstitialHost(resp.Request.URL.Host) {
+		ls.Paywalled = true
+	} else if !ls.IsDead() {
+		peek, err := ioutil.ReadAll(io.LimitReader(throttledReader{countingReader{resp.Body}, imageBandwidth}, linkCheckPeekBytes))
+		if err != nil {
+			return nil, err
+		}
+		ls.Peek = peek
+		ls.Paywalled = hasInterstitialMarker(peek)
+		ls.Alternate = alternatePage(peek, ls.FinalUrl)
+		ls.Canonical = canonicalPage(peek, ls.FinalUrl)
+		ls.License = pageLicense(peek, ls.FinalUrl)
+	}
+
+	return ls, nil
+}
+
+// Walk back from the final response through the responses that redirected
+// to it
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil; {
+		chain = append([]string{req.URL.String()}, chain...)
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+
+	if len(chain) <= 1 {
+		return nil
+	}
+	if len(chain) > maxRedirectChain {
+		chain = append(chain[:maxRedirectChain-1], chain[len(chain)-1])
+	}
+	return chain
+}
+
+// The canonical url a page declares for itself
+func canonicalPage(page []byte, base string) string {
+	for _, attrs := range linkTags(page) {
+		if strings.ToLower(attrs["rel"]) == "canonical" {
+			return resolveHref(attrs["href"], base)
+		}
+	}
+	return ""
+}
+
+// The link an item should have in place of the one from its feed, skipping
+// redirectors and tracking intermediaries, or empty to leave it alone
+func rewrittenLink(ls *LinkStatus) string {
+	if ls.IsDead() || ls.Paywalled {
+		return ""
+	}
+
+	switch config.Links.Rewrite {
+	case "canonical":
+		return firstNonEmpty(ls.Canonical, ls.FinalUrl)
+	case "final":
+		return ls.FinalUrl
+	}
+	return ""
+}
+
+// A link is considered dead if the server reports that the page is missing
+// or otherwise refuses to serve it
+func (ls *LinkStatus) IsDead() bool {
+	return ls.Status >= 400
+}
+
+func isInterstitialHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, prefix := range interstitialHosts {
+		if strings.HasPrefix(host, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasInterstitialMarker(page []byte) bool {
+	page = bytes.ToLower(page)
+	for _, marker := range interstitialMarkers {
+		if bytes.Contains(page, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Feeds generated locally by other jobs can be given as file:// urls and
+// are read straight from disk. As profiles' feed urls come from users, only
+// files within the Files directory of the feed configuration may be read
+// and file urls are refused when it is not set. The -debugfeed command also
+// takes "-" to read a feed from stdin.
+
+type LocalFeedError struct {
+	Url    string
+	Reason string
+}
+
+func (e *LocalFeedError) Error() string {
+	return fmt.Sprintf("cannot read %s: %s", e.Url, e.Reason)
+}
+
+// The path of a file url, once it is known to be within the feed directory
+func localFeedPath(rawurl string) (string, error) {
+	if config.Fetcher.Feed.Files == "" {
+		return "", &LocalFeedError{Url: rawurl, Reason: "file feeds are not enabled"}
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", &LocalFeedError{Url: rawurl, Reason: "only local files can be read"}
+	}
+
+	root, err := filepath.EvalSymlinks(config.Fetcher.Feed.Files)
+	if err != nil {
+		return "", err
+	}
+	// Links are followed before checking, so none can lead out of the
+	// directory
+	path, err := filepath.EvalSymlinks(filepath.Clean(fileUrlPath(u)))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &LocalFeedError{Url: rawurl, Reason: "outside the feed directory"}
+	}
+	return path, nil
+}
+
+func (job RssJob) readFileFeed() (*FetchedFeed, error) {
+	path, err := localFeedPath(job.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rec := feedStates.Get(job.Pid)
+	if job.Full || rec.Url != job.Url {
+		rec = FetchRecord{}
+	}
+	return readLocalFeed(f, rec, job.Url)
+}
+
+func readLocalFeed(r io.Reader, rec FetchRecord, feedUrl string) (*FetchedFeed, error) {
+	body, err := readLimited(r, int64(config.Fetcher.Feed.MaxBytes))
+	if err != nil {
+		return nil, fmt.Errorf("could not read feed: %s", err.Error())
+	}
+
+	ff := &FetchedFeed{Header: http.Header{}, Fetched: time.Now().Unix(), Attempts: 1, Body: body}
+	return parseFetchedFeed(ff, rec, feedUrl)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog severities, also used by journald
+const (
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+)
+
+// The fetcher logs free-form messages so the priority of each line is
+// inferred from its wording
+func logPriority(msg string) int {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "could not"), strings.Contains(lower, "failed"):
+		return priorityErr
+	case strings.Contains(lower, "rejected"), strings.Contains(lower, "skipping"), strings.Contains(lower, "invalid"):
+		return priorityWarning
+	default:
+		return priorityInfo
+	}
+}
+
+// Direct the standard logger to the configured target
+func setupLogging() {
+	var w io.Writer
+	var err error
+
+	switch config.Log.Target {
+	case "", "stderr":
+		return
+	case "syslog":
+		w, err = NewSyslogWriter(config.Log.Syslog, config.Log.Facility, config.Log.Tag)
+	case "journald":
+		w, err = NewJournaldWriter(config.Log.Tag)
+	case "eventlog":
+		w, err = NewEventLogWriter(config.Log.Tag)
+	default:
+		err = fmt.Errorf("unknown log target %s", config.Log.Target)
+	}
+
+	if err != nil {
+		log.Printf("Could not set up logging: %s", err.Error())
+		os.Exit(1)
+	}
+
+	// Every target timestamps entries itself
+	log.SetFlags(0)
+	log.SetOutput(w)
+}
+
+// SyslogWriter formats each log line as an RFC 5424 message
+type SyslogWriter struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	facility int
+	tag      string
+	hostname string
+	seq      int
+}
+
+// Connect to a syslog server given as udp://host:port, tcp://host:port or
+// unix:///dev/log
+func NewSyslogWriter(addr string, facility int, tag string) (*SyslogWriter, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "udp", "tcp":
+		conn, err = net.Dial(u.Scheme, u.Host)
+	case "unix":
+		conn, err = net.Dial("unixgram", u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported syslog address %s", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	return &SyslogWriter{conn: conn, facility: facility, tag: tag, hostname: hostname}, nil
+}
+
+func (sw *SyslogWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	msg := strings.TrimRight(string(p), "\n")
+	sw.seq++
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - [meta sequenceId=\"%d\"] %s",
+		sw.facility*8+logPriority(msg),
+		time.Now().Format(time.RFC3339Nano),
+		sw.hostname,
+		sw.tag,
+		os.Getpid(),
+		sw.seq,
+		msg)
+
+	// Stream transports need explicit framing, RFC 6587 octet counting
+	if _, ok := sw.conn.(*net.TCPConn); ok {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	if _, err := sw.conn.Write([]byte(line)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// JournaldWriter sends each log line to journald using its native protocol
+type JournaldWriter struct {
+	conn net.Conn
+	tag  string
+}
+
+func NewJournaldWriter(tag string) (*JournaldWriter, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &JournaldWriter{conn: conn, tag: tag}, nil
+}
+
+func (jw *JournaldWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "PRIORITY", fmt.Sprintf("%d", logPriority(msg)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", jw.tag)
+	writeJournalField(&buf, "MESSAGE", msg)
+
+	if _, err := jw.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Values containing newlines must use the length prefixed binary form
+func writeJournalField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	n := uint64(len(value))
+	for i := 0; i < 8; i++ {
+		buf.WriteByte(byte(n >> (8 * uint(i))))
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+)
+
+// A MetricsSink receives the counters, gauges and timers recorded by the
+// fetcher
+type MetricsSink interface {
+	Count(name string, value int64)
+	Gauge(name string, value int64)
+	Timing(name string, d time.Duration)
+}
+
+var metricsSinks []MetricsSink
+
+func addMetricsSink(sink MetricsSink) {
+	metricsSinks = append(metricsSinks, sink)
+}
+
+func countMetric(name string, value int64) {
+	for _, sink := range metricsSinks {
+		sink.Count(name, value)
+	}
+}
+
+func gaugeMetric(name string, value int64) {
+	for _, sink := range metricsSinks {
+		sink.Gauge(name, value)
+	}
+}
+
+func timeMetric(name string, start time.Time) {
+	d := time.Since(start)
+	for _, sink := range metricsSinks {
+		sink.Timing(name, d)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iand/feedparser"
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The migrate-ids command moves items to the ids given by their feed's
+// current dedup settings, for use after changing a feed's strategy. Each
+// item whose id changes is added to the datastore under its new id, its
+// metadata, images, search terms and virtual profile copies are moved
+// across, and the old metadata is marked as migrated so it is no longer
+// served. The datastore has no way to remove the old record, which is left
+// in place.
+//
+// Items are migrated in id order and the last one done is recorded in a
+// progress file next to the fetcher state, so an interrupted migration
+// resumes where it stopped. Every step can safely be repeated.
+type MigrateProgress struct {
+	Last     datastore.ItemIdType `json:"last"`
+	Migrated int                  `json:"migrated"`
+	Skipped  int                  `json:"skipped"`
+}
+
+func migrateProgressFilename() string {
+	return config.Fetcher.State + ".migrate"
+}
+
+func readMigrateProgress() *MigrateProgress {
+	progress := &MigrateProgress{}
+	data, err := ioutil.ReadFile(migrateProgressFilename())
+	if err != nil {
+		return progress
+	}
+	if err := json.Unmarshal(data, progress); err != nil {
+		log.Printf("Ignoring unreadable migration progress %s: %s", migrateProgressFilename(), err.Error())
+		return &MigrateProgress{}
+	}
+	return progress
+}
+
+func writeMigrateProgress(progress *MigrateProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	filename := migrateProgressFilename()
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// Rebuild enough of the original feed item to recompute its id, or return
+// nil when the metadata lacks what the strategy needs
+func migrateFeedItem(meta *ItemMeta, strategy string) *feedparser.FeedItem {
+	item := &feedparser.FeedItem{Id: meta.Guid, Title: meta.Title, Link: meta.Link}
+	if meta.Published != 0 {
+		item.When = time.Unix(meta.Published, 0)
+	}
+
+	switch strategy {
+	case ingest.DedupContent:
+		// Descriptions are not kept
+		return nil
+	case ingest.DedupLink:
+		if meta.Link == "" {
+			return nil
+		}
+	default:
+		if meta.Guid == "" {
+			return nil
+		}
+	}
+	return item
+}
+
+func migrateIds() {
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	itemTypes := make(map[datastore.PidType]string)
+	profiles, err := s.FeedDrivenProfiles()
+	if err != nil {
+		log.Printf("Could not read profiles: %s", err.Error())
+		os.Exit(1)
+	}
+	for _, p := range profiles {
+		itemTypes[p.Pid] = p.ItemType
+	}
+
+	metas, err := allItemMeta()
+	if err != nil {
+		log.Printf("Could not read item metadata: %s", err.Error())
+		os.Exit(1)
+	}
+	sort.Sort(byId(metas))
+
+	progress := readMigrateProgress()
+	if progress.Last != "" {
+		log.Printf("Resuming migration after item %s", progress.Last)
+	}
+
+	for _, meta := range metas {
+		if meta.Id <= progress.Last {
+			continue
+		}
+		// Virtual copies move with their original
+		if meta.Via != "" || meta.Pid == "" {
+			continue
+		}
+
+		fc := config.Feeds[string(meta.Pid)]
+		if item := migrateFeedItem(meta, fc.Dedup); item == nil {
+			log.Printf("Cannot recompute the id of item %s under the %s strategy", meta.Id, fc.Dedup)
+			progress.Skipped++
+		} else if newId := ingest.ItemId(fc.Dedup, fc.DedupWindow, item); newId != meta.Id {
+			if err := migrateItem(s, meta, newId, itemTypes[meta.Pid]); err != nil {
+				log.Printf("Could not migrate item %s: %s", meta.Id, err.Error())
+				os.Exit(1)
+			}
+			progress.Migrated++
+		}
+
+		progress.Last = meta.Id
+		if err := writeMigrateProgress(progress); err != nil {
+			log.Printf("Could not record migration progress: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	log.Printf("Migrated %d items, skipped %d", progress.Migrated, progress.Skipped)
+	os.Remove(migrateProgressFilename())
+}
+
+func migrateItem(s *datastore.RedisStore, meta *ItemMeta, newId datastore.ItemIdType, itemType string) error {
+	log.Printf("Migrating item %s to %s", meta.Id, newId)
+
+	if err := migrateRecord(s, meta, newId, meta.Pid, itemType); err != nil {
+		return err
+	}
+
+	for name := range config.Virtual {
+		oldVid := virtualItemId(name, meta.Id)
+		vmeta, err := readItemMeta(oldVid)
+		if err != nil {
+			return err
+		}
+		if vmeta.Added == 0 || vmeta.MigratedTo != "" {
+			continue
+		}
+		if err := migrateRecord(s, vmeta, virtualItemId(name, newId), datastore.PidType(name), itemType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move one item record and everything that refers to it to a new id. The
+// old metadata is marked last, so a record is only treated as done once
+// everything else has moved.
+func migrateRecord(s *datastore.RedisStore, meta *ItemMeta, newId datastore.ItemIdType, pid datastore.PidType, itemType string) error {
+	item, err := s.Item(meta.Id)
+	if err != nil {
+		return fmt.Errorf("could not read item: %s", err.Error())
+	}
+
+	if _, err := s.AddItem(pid, time.Unix(item.Event, 0), item.Text, item.Link, item.Image, newId, itemType, 0); err != nil {
+		return fmt.Errorf("could not add item: %s", err.Error())
+	}
+
+	moved := *meta
+	moved.Id = newId
+	moved.MigratedTo = ""
+	if err := writeItemMeta(&moved); err != nil {
+		return fmt.Errorf("could not write metadata: %s", err.Error())
+	}
+
+	if !imageProxyEnabled() {
+		files, _ := filepath.Glob(filepath.Join(config.Image.Path, string(meta.Id)+".*"))
+		for _, old := range files {
+			renamed := filepath.Join(config.Image.Path, string(newId)+filepath.Ext(old))
+			if err := os.Rename(old, renamed); err != nil {
+				return fmt.Errorf("could not rename image %s: %s", old, err.Error())
+			}
+		}
+	}
+
+	unindexItem(meta)
+	indexItem(&moved)
+
+	return updateItemMeta(meta.Id, func(old *ItemMeta) {
+		old.MigratedTo = newId
+	})
+}
+
+type byId []*ItemMeta
+
+func (b byId) Len() int           { return len(b) }
+func (b byId) Less(i, j int) bool { return b[i].Id < b[j].Id }
+func (b byId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
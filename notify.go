@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"github.com/placetime/datastore"
+	"log"
+	"time"
+)
+
+// A poll that adds more than Batch items, as after a backfill or outage,
+// is announced downstream as a single batched event rather than one event
+// per item. Zero sends every item individually.
+type NotifyConfig struct {
+	Batch int `toml:"batch"`
+}
+
+// Payload sent in place of individual items when a poll is batched
+type WebhookBatch struct {
+	Pid   datastore.PidType `json:"pid"`
+	Count int               `json:"count"`
+	Items []WebhookItem     `json:"items"`
+	Added int64             `json:"added"`
+}
+
+// The most items listed in a batched ActivityPub note
+const maxBatchNoteItems = 10
+
+// Tell webhooks, sink plugins and followers about the items added by one
+// poll of a profile
+func notifyNewItems(pid datastore.PidType, items []WebhookItem, metas []*ItemMeta) {
+	if config.Notify.Batch == 0 || len(items) <= config.Notify.Batch {
+		for _, wi := range items {
+			notifyWebhook(wi)
+			notifySinkPlugins(wi)
+		}
+		for _, meta := range metas {
+			go publishItem(meta)
+		}
+		return
+	}
+
+	log.Printf("Batching notifications for %d new items of profile %s", len(items), pid)
+	countMetric("notify.batched", 1)
+
+	batch := WebhookBatch{
+		Pid:   pid,
+		Count: len(items),
+		Items: items,
+		Added: time.Now().Unix(),
+	}
+	notifyWebhookBatch(batch)
+	notifySinkPluginsBatch(batch)
+	go publishBatch(pid, metas)
+}
+
+func batchTitle(count int) string {
+	return fmt.Sprintf("%d new items", count)
+}
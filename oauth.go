@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are renewed this long before they expire, so a token is not sent
+// just as it runs out
+const tokenExpiryMargin = time.Minute
+
+// An access token obtained with the OAuth2 client credentials grant
+type OAuthToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Expires     int64  `json:"expires,omitempty"`
+}
+
+func (t *OAuthToken) valid() bool {
+	return t.AccessToken != "" && (t.Expires == 0 || time.Now().Add(tokenExpiryMargin).Unix() < t.Expires)
+}
+
+// TokenStore obtains tokens for feed sources and caches them until they
+// expire. The cache is kept in a file only the fetcher can read so that a
+// restart does not ask every source for a new token. Fetches needing the
+// same new token share the one request for it, which holds up no other
+// source's fetches.
+type TokenStore struct {
+	mu       sync.Mutex
+	filename string
+	tokens   map[string]*OAuthToken
+	flights  singleflight.Group
+}
+
+var oauthTokens = &TokenStore{tokens: make(map[string]*OAuthToken)}
+
+func loadOAuthTokens() {
+	oauthTokens.filename = config.Fetcher.Tokens
+	if oauthTokens.filename == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(oauthTokens.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not read token cache %s: %s", oauthTokens.filename, err.Error())
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &oauthTokens.tokens); err != nil {
+		log.Printf("Could not read token cache %s, starting a new one: %s", oauthTokens.filename, err.Error())
+		oauthTokens.tokens = make(map[string]*OAuthToken)
+	}
+}
+
+// Must be called with the lock held
+func (ts *TokenStore) save() {
+	if ts.filename == "" {
+		return
+	}
+
+	data, err := json.Marshal(ts.tokens)
+	if err == nil {
+		if err = ioutil.WriteFile(ts.filename+".tmp", data, 0600); err == nil {
+			err = os.Rename(ts.filename+".tmp", ts.filename)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not write token cache %s: %s", ts.filename, err.Error())
+	}
+}
+
+// Sources sharing a client and scopes share its tokens
+func tokenKey(auth FeedAuthConfig) string {
+	return auth.TokenUrl + " " + auth.ClientId + " " + strings.Join(auth.Scopes, " ")
+}
+
+// The current token for a source, obtaining a new one when there is none
+// or it has expired
+func (ts *TokenStore) Token(ctx context.Context, auth FeedAuthConfig) (*OAuthToken, error) {
+	key := tokenKey(auth)
+	ts.mu.Lock()
+	t, exists := ts.tokens[key]
+	ts.mu.Unlock()
+	if exists && t.valid() {
+		return t, nil
+	}
+
+	v, err, _ := ts.flights.Do(key, func() (interface{}, error) {
+		t, err := requestToken(ctx, auth)
+		if err != nil {
+			return nil, err
+		}
+		ts.mu.Lock()
+		ts.tokens[key] = t
+		ts.save()
+		ts.mu.Unlock()
+		return t, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*OAuthToken), nil
+}
+
+// Forget the token for a source the source has rejected
+func (ts *TokenStore) Invalidate(auth FeedAuthConfig) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	delete(ts.tokens, tokenKey(auth))
+	ts.save()
+}
+
+func requestToken(ctx context.Context, auth FeedAuthConfig) (*OAuthToken, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", auth.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(auth.ClientId), url.QueryEscape(auth.ClientSecret))
+
+	countMetric("oauth.requests", 1)
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request to %s returned %s", auth.TokenUrl, resp.Status)
+	}
+
+	var tr struct {
+		OAuthToken
+		ExpiresIn int64 `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("could not read token from %s: %s", auth.TokenUrl, err.Error())
+	}
+	if tr.AccessToken == "" {
+		return nil, fmt.Errorf("token response from %s has no access token", auth.TokenUrl)
+	}
+
+	t := tr.OAuthToken
+	if tr.ExpiresIn > 0 {
+		t.Expires = time.Now().Unix() + tr.ExpiresIn
+	}
+	return &t, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/placetime/datastore"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profiles can be paused so the scheduler skips their feeds without the
+// profile being deleted, for example during a publisher outage or while a
+// user has muted a source. A feed can be paused permanently in its config
+// or at runtime from the command line or query API. Runtime pauses are kept
+// in a JSON file that is re-read whenever it changes, so the command line
+// can pause a profile while the fetcher is running.
+type PausedProfile struct {
+	Since  int64  `json:"since"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type PauseStore struct {
+	mu       sync.Mutex
+	filename string
+	modified time.Time
+	paused   map[datastore.PidType]*PausedProfile
+}
+
+var pausedProfiles = &PauseStore{paused: make(map[datastore.PidType]*PausedProfile)}
+
+func loadPausedProfiles() {
+	pausedProfiles.filename = config.Fetcher.Paused
+	pausedProfiles.mu.Lock()
+	pausedProfiles.refresh()
+	pausedProfiles.mu.Unlock()
+}
+
+// Must be called with the lock held
+func (ps *PauseStore) refresh() {
+	if ps.filename == "" {
+		return
+	}
+
+	fi, err := os.Stat(ps.filename)
+	if err != nil || !fi.ModTime().After(ps.modified) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(ps.filename)
+	if err != nil {
+		log.Printf("Could not read paused profiles %s: %s", ps.filename, err.Error())
+		return
+	}
+
+	paused := make(map[datastore.PidType]*PausedProfile)
+	if err := json.Unmarshal(data, &paused); err != nil {
+		log.Printf("Could not read paused profiles %s: %s", ps.filename, err.Error())
+		return
+	}
+	ps.paused = paused
+	ps.modified = fi.ModTime()
+}
+
+// Must be called with the lock held
+func (ps *PauseStore) save() {
+	if ps.filename == "" {
+		return
+	}
+
+	data, err := json.Marshal(ps.paused)
+	if err == nil {
+		if err = ioutil.WriteFile(ps.filename+".tmp", data, 0644); err == nil {
+			err = os.Rename(ps.filename+".tmp", ps.filename)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not write paused profiles %s: %s", ps.filename, err.Error())
+		return
+	}
+	if fi, err := os.Stat(ps.filename); err == nil {
+		ps.modified = fi.ModTime()
+	}
+}
+
+func (ps *PauseStore) Pause(pid datastore.PidType, reason string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.refresh()
+
+	ps.paused[pid] = &PausedProfile{Since: time.Now().Unix(), Reason: reason}
+	ps.save()
+	log.Printf("Paused profile %s", pid)
+}
+
+func (ps *PauseStore) Resume(pid datastore.PidType) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.refresh()
+
+	delete(ps.paused, pid)
+	ps.save()
+	log.Printf("Resumed profile %s", pid)
+}
+
+func (ps *PauseStore) List() map[datastore.PidType]*PausedProfile {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.refresh()
+
+	list := make(map[datastore.PidType]*PausedProfile, len(ps.paused))
+	for pid, p := range ps.paused {
+		list[pid] = p
+	}
+	return list
+}
+
+// Pause a profile whose feed is dead. Its failures are cleared so that once
+// resumed it gets a fresh start.
+func disableFeed(pid datastore.PidType, reason string) {
+	log.Printf("Disabling feed of profile %s: %s", pid, reason)
+	countMetric("feed.disabled", 1)
+	pausedProfiles.Pause(pid, reason)
+	feedStates.Reset(pid)
+}
+
+func profilePaused(pid datastore.PidType) bool {
+	if config.Feeds[string(pid)].Paused {
+		return true
+	}
+
+	pausedProfiles.mu.Lock()
+	defer pausedProfiles.mu.Unlock()
+	pausedProfiles.refresh()
+
+	_, paused := pausedProfiles.paused[pid]
+	return paused
+}
+
+// Serves GET /paused, POST /paused/{pid}?reason= and DELETE /paused/{pid},
+// the last two for admins only
+func handlePaused(w http.ResponseWriter, r *http.Request) {
+	pid := datastore.PidType(strings.Trim(strings.TrimPrefix(r.URL.Path, "/paused"), "/"))
+	if pid == "" {
+		writeJson(w, pausedProfiles.List())
+		return
+	}
+	if (r.Method == "POST" || r.Method == "DELETE") && !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		pausedProfiles.Pause(pid, r.FormValue("reason"))
+	case "DELETE":
+		pausedProfiles.Resume(pid)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, pausedProfiles.List())
+}
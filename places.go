@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"github.com/placetime/placetime-fetcher/internal/ingest"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Items with a location are also filed under a place so the application
+// can build per-place timelines. A place is the geohash cell of Precision
+// characters the item falls in and is named from the item's annotation or
+// GeoRSS feature name where it has one.
+type PlacesConfig struct {
+	Addr      string `toml:"addr"` // host:port of the redis server, empty to disable
+	Prefix    string `toml:"prefix"`
+	Precision int    `toml:"precision"`
+}
+
+// A place entity, identified by its geohash. Bbox is minlon, minlat,
+// maxlon, maxlat.
+type Place struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`
+	Geohash string    `json:"geohash"`
+	Bbox    []float64 `json:"bbox"`
+	Updated int64     `json:"updated"`
+}
+
+// PlaceStore keeps place entities and the items found at each, alongside
+// the datastore's item store
+type PlaceStore interface {
+	// Create or update a place. An empty name leaves any existing name.
+	UpsertPlace(place *Place) error
+	// File an item under a place, ordered by when it was added
+	AddPlaceItem(placeId string, id datastore.ItemIdType, added int64) error
+	Close()
+}
+
+var placesPool *redis.Pool
+
+func initPlaces() {
+	if config.Places.Addr == "" {
+		return
+	}
+
+	placesPool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.Places.Addr)
+		},
+	}
+	log.Printf("Maintaining places in redis at %s", config.Places.Addr)
+}
+
+// A place store for the current goroutine, nil when places are disabled
+func newPlaceStore() PlaceStore {
+	if placesPool == nil {
+		return nil
+	}
+	return &RedisPlaceStore{conn: placesPool.Get(), prefix: config.Places.Prefix}
+}
+
+// RedisPlaceStore keeps each place as a hash and the items at it as a
+// sorted set scored by the time they were added
+type RedisPlaceStore struct {
+	conn   redis.Conn
+	prefix string
+}
+
+func (s *RedisPlaceStore) Close() {
+	s.conn.Close()
+}
+
+func (s *RedisPlaceStore) placeKey(id string) string {
+	return s.prefix + "place:" + id
+}
+
+func (s *RedisPlaceStore) UpsertPlace(place *Place) error {
+	bbox, err := json.Marshal(place.Bbox)
+	if err != nil {
+		return err
+	}
+
+	args := redis.Args{s.placeKey(place.Id)}.Add(
+		"id", place.Id,
+		"geohash", place.Geohash,
+		"bbox", string(bbox),
+		"updated", strconv.FormatInt(place.Updated, 10),
+	)
+	if place.Name != "" {
+		args = args.Add("name", place.Name)
+	}
+	_, err = s.conn.Do("HSET", args...)
+	return err
+}
+
+func (s *RedisPlaceStore) AddPlaceItem(placeId string, id datastore.ItemIdType, added int64) error {
+	_, err := s.conn.Do("ZADD", s.placeKey(placeId)+":items", added, string(id))
+	return err
+}
+
+// The place an item located at p belongs to
+func placeAt(p *GeoPoint, name string) *Place {
+	hash := ingest.Geohash(p, config.Places.Precision)
+	return &Place{
+		Id:      hash,
+		Name:    name,
+		Geohash: hash,
+		Bbox:    ingest.GeohashBbox(hash),
+		Updated: time.Now().Unix(),
+	}
+}
+
+// File a newly added item under its place
+func recordPlace(ps PlaceStore, meta *ItemMeta, name string) {
+	if ps == nil || meta.Location == nil {
+		return
+	}
+
+	place := placeAt(meta.Location, name)
+	if err := ps.UpsertPlace(place); err != nil {
+		log.Printf("Could not update place %s: %s", place.Id, err.Error())
+		countMetric("places.errors", 1)
+		return
+	}
+	if err := ps.AddPlaceItem(place.Id, meta.Id, meta.Added); err != nil {
+		log.Printf("Could not add item %s to place %s: %s", meta.Id, place.Id, err.Error())
+		countMetric("places.errors", 1)
+		return
+	}
+	countMetric("places.items", 1)
+}
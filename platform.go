@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Where the fetcher keeps its state, images and metadata unless configured
+// otherwise, and the system wide configuration file read when neither
+// -config nor a file in the home directory is given
+var (
+	dataDir          = defaultDataDir()
+	systemConfigFile = defaultSystemConfigFile()
+)
+
+func defaultDataDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(programData(), "Timescroll")
+	case "darwin":
+		return "/Library/Application Support/Timescroll"
+	default:
+		return "/var/opt/timescroll"
+	}
+}
+
+func defaultSystemConfigFile() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(programData(), "Timescroll", "placetime.conf")
+	case "darwin":
+		return "/Library/Application Support/Timescroll/placetime.conf"
+	default:
+		return "/etc/placetime.conf"
+	}
+}
+
+func programData() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+// The local syslog socket differs between Linux and macOS, Windows has
+// none and logs to the event log instead
+func defaultSyslogAddr() string {
+	if runtime.GOOS == "darwin" {
+		return "unix:///var/run/syslog"
+	}
+	return "unix:///dev/log"
+}
+
+// The file a file url names. On Windows file:///C:/feeds/news.xml has the
+// path /C:/feeds/news.xml, which needs its leading slash dropped.
+func fileUrlPath(u *url.URL) string {
+	p := u.Path
+	if runtime.GOOS == "windows" && len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		p = strings.TrimPrefix(p, "/")
+	}
+	return filepath.FromSlash(p)
+}
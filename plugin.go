@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/iand/feedparser"
+	"github.com/iand/imgpick"
+	"io"
+	"log"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Plugins are external programs that speak JSON-RPC (net/rpc/jsonrpc) on
+// their stdin and stdout. They let site specific integrations live out of
+// tree. Each is declared in the configuration with its kind:
+//
+//	[[plugin]]
+//	kind = "driver"
+//	name = "instagram"
+//	command = ["/usr/local/bin/placetime-instagram"]
+//
+// A driver plugin supplies feeds for profiles whose feed url has the
+// plugin's name as its scheme, e.g. instagram://someuser, and must serve
+// "Driver.Fetch" taking a PluginFetchArgs and returning PluginFetchReply.
+//
+// An image plugin replaces imgpick and must serve "Image.Pick" taking a
+// PluginPickArgs and returning PluginPickReply. Only one may be configured.
+//
+// A parser plugin parses feed documents in shadow of the built in parser,
+// see ShadowConfig. It must serve "Parser.Parse" taking a PluginParseArgs
+// and returning PluginFetchReply. Only one may be configured.
+//
+// A document plugin renders the first page of a document an item links to,
+// see DocumentConfig. It must serve "Document.Render" taking a
+// PluginRenderArgs and returning PluginRenderReply. Only one may be
+// configured.
+//
+// A sink plugin is told about every new item by "Sink.ItemAdded" taking a
+// WebhookItem and returning PluginSinkReply, or about a large poll at once
+// by "Sink.ItemsAdded" taking a WebhookBatch.
+const (
+	pluginDriver   = "driver"
+	pluginImage    = "image"
+	pluginSink     = "sink"
+	pluginParser   = "parser"
+	pluginDocument = "document"
+)
+
+type PluginConfig struct {
+	Kind    string   `toml:"kind"`
+	Name    string   `toml:"name"`
+	Command []string `toml:"command"`
+}
+
+type PluginFetchArgs struct {
+	Url string `json:"url"`
+}
+
+type PluginItem struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Link        string `json:"link"`
+	Description string `json:"description"`
+	Image       string `json:"image"`
+	When        int64  `json:"when"`
+}
+
+type PluginFetchReply struct {
+	Title string       `json:"title"`
+	Items []PluginItem `json:"items"`
+}
+
+type PluginPickArgs struct {
+	Url string `json:"url"`
+}
+
+type PluginPickReply struct {
+	Image string `json:"image"`
+	Media string `json:"media"`
+}
+
+type PluginRenderArgs struct {
+	Url  string `json:"url"`
+	Type string `json:"type"`
+	Body []byte `json:"body"`
+}
+
+// Image is the rendered first page as PNG or JPEG data. Title, Author and
+// Pages are the document's own where the plugin can read them.
+type PluginRenderReply struct {
+	Image  []byte `json:"image"`
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	Pages  int    `json:"pages"`
+}
+
+type PluginSinkReply struct{}
+
+// Plugin is a running plugin process. The process is started on first use
+// and restarted if it exits.
+type Plugin struct {
+	mu     sync.Mutex
+	config PluginConfig
+	cmd    *exec.Cmd
+	client *rpc.Client
+}
+
+type pluginConn struct {
+	io.ReadCloser
+	stdin io.WriteCloser
+}
+
+func (pc pluginConn) Write(p []byte) (int, error) { return pc.stdin.Write(p) }
+
+func (pc pluginConn) Close() error {
+	pc.stdin.Close()
+	return pc.ReadCloser.Close()
+}
+
+var (
+	driverPlugins  = map[string]*Plugin{}
+	imagePlugin    *Plugin
+	parserPlugin   *Plugin
+	documentPlugin *Plugin
+	sinkPlugins    []*Plugin
+)
+
+func registerPlugins() error {
+	for _, pc := range config.Plugins {
+		if len(pc.Command) == 0 {
+			return fmt.Errorf("plugin %s has no command", pc.Name)
+		}
+
+		p := &Plugin{config: pc}
+		switch pc.Kind {
+		case pluginDriver:
+			driverPlugins[pc.Name] = p
+		case pluginImage:
+			if imagePlugin != nil {
+				return fmt.Errorf("only one image plugin may be configured")
+			}
+			imagePlugin = p
+		case pluginParser:
+			if parserPlugin != nil {
+				return fmt.Errorf("only one parser plugin may be configured")
+			}
+			parserPlugin = p
+		case pluginDocument:
+			if documentPlugin != nil {
+				return fmt.Errorf("only one document plugin may be configured")
+			}
+			documentPlugin = p
+		case pluginSink:
+			sinkPlugins = append(sinkPlugins, p)
+		default:
+			return fmt.Errorf("plugin %s has unknown kind %s", pc.Name, pc.Kind)
+		}
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (p *Plugin) start() error {
+	cmd := exec.Command(p.config.Command[0], p.config.Command[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Printf("Started %s plugin %s (pid %d)", p.config.Kind, p.config.Name, cmd.Process.Pid)
+	p.cmd = cmd
+	p.client = jsonrpc.NewClient(pluginConn{ReadCloser: stdout, stdin: stdin})
+	return nil
+}
+
+// Must be called with the lock held
+func (p *Plugin) stop() {
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+		p.cmd = nil
+	}
+}
+
+// Call a plugin method, abandoning the call and restarting the plugin if it
+// does not answer within the timeout
+func (p *Plugin) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	p.mu.Lock()
+	if p.client == nil {
+		if err := p.start(); err != nil {
+			p.mu.Unlock()
+			return fmt.Errorf("could not start plugin %s: %s", p.config.Name, err.Error())
+		}
+	}
+	client := p.client
+	p.mu.Unlock()
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ErrShutdown || call.Error == io.ErrUnexpectedEOF {
+			p.restart(client)
+		}
+		return call.Error
+	case <-time.After(timeout):
+		p.restart(client)
+		return fmt.Errorf("plugin %s did not answer %s within %s", p.config.Name, method, timeout)
+	}
+}
+
+// Restart the plugin unless another caller already has
+func (p *Plugin) restart(client *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == client {
+		log.Printf("Restarting plugin %s", p.config.Name)
+		p.stop()
+	}
+}
+
+func driverPlugin(feedUrl string) *Plugin {
+	u, err := url.Parse(feedUrl)
+	if err != nil {
+		return nil
+	}
+	return driverPlugins[u.Scheme]
+}
+
+// Fetch a feed from a driver plugin, presenting it as though it had been
+// parsed from a feed document
+func (p *Plugin) FetchFeed(feedUrl string) (*FetchedFeed, error) {
+	var reply PluginFetchReply
+	if err := p.Call("Driver.Fetch", PluginFetchArgs{Url: feedUrl}, &reply, time.Minute); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &feedparser.Feed{Title: reply.Title}
+	for _, pi := range reply.Items {
+		item := &feedparser.FeedItem{
+			Id:          pi.Id,
+			Title:       pi.Title,
+			Link:        pi.Link,
+			Description: pi.Description,
+			Image:       pi.Image,
+		}
+		if pi.When != 0 {
+			item.When = time.Unix(pi.When, 0)
+		}
+		feed.Items = append(feed.Items, item)
+	}
+
+	return &FetchedFeed{
+		Feed:     feed,
+		Body:     body,
+		Header:   http.Header{},
+		Fetched:  time.Now().Unix(),
+		Snapshot: fmt.Sprintf("%x", md5.Sum(body)),
+	}, nil
+}
+
+// Render a document using the document plugin, under the context's
+// deadline
+func (p *Plugin) Render(ctx context.Context, args PluginRenderArgs) (*PluginRenderReply, error) {
+	timeout := time.Minute
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	var reply PluginRenderReply
+	if err := p.Call("Document.Render", args, &reply, timeout); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Pick an image using the image plugin, under the context's deadline
+func (p *Plugin) Pick(ctx context.Context, link string) (*imgpick.MediaData, error) {
+	timeout := time.Minute
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	var reply PluginPickReply
+	if err := p.Call("Image.Pick", PluginPickArgs{Url: link}, &reply, timeout); err != nil {
+		return nil, err
+	}
+	return &imgpick.MediaData{BestImage: reply.Image, MediaType: reply.Media}, nil
+}
+
+func notifySinkPlugins(item WebhookItem) {
+	for _, p := range sinkPlugins {
+		var reply PluginSinkReply
+		if err := p.Call("Sink.ItemAdded", item, &reply, 10*time.Second); err != nil {
+			log.Printf("Sink plugin %s failed to take item %s: %s", p.config.Name, item.Id, err.Error())
+		}
+	}
+}
+
+func notifySinkPluginsBatch(batch WebhookBatch) {
+	for _, p := range sinkPlugins {
+		var reply PluginSinkReply
+		if err := p.Call("Sink.ItemsAdded", batch, &reply, 10*time.Second); err != nil {
+			log.Printf("Sink plugin %s failed to take batch of %d items: %s", p.config.Name, batch.Count, err.Error())
+		}
+	}
+}
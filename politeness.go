@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Politeness profiles decide how hard the fetcher may press a host. A
+// profile limits the requests in flight to the host at once, spaces
+// request starts to at most Rate per second and pauses for CrawlDelay
+// milliseconds after each request completes. Hosts are assigned a profile
+// in the hosts section and other hosts use the default profile:
+//
+//	[hosts."feedburner.com"]
+//	politeness = "aggressive"
+//
+// A host entry also applies to its subdomains. A profile given in the
+// configuration file replaces the built in profile of that name entirely.
+const (
+	politeAggressive = "aggressive"
+	politeDefault    = "default"
+	politePolite     = "polite"
+)
+
+type PolitenessProfile struct {
+	Concurrency int     `toml:"concurrency"`
+	Rate        float64 `toml:"rate"`
+	CrawlDelay  int     `toml:"crawldelay"`
+}
+
+var DefaultPolitenessProfiles = map[string]PolitenessProfile{
+	politeAggressive: {
+		Concurrency: 8,
+		Rate:        20,
+	},
+	politeDefault: {
+		Concurrency: 2,
+		Rate:        2,
+	},
+	politePolite: {
+		Concurrency: 1,
+		Rate:        0.2,
+		CrawlDelay:  5000,
+	},
+}
+
+// Settings that apply to every request to a host, keyed by hostname. Owned
+// hosts are our own and their robots.txt is not consulted.
+type HostConfig struct {
+	Politeness string `toml:"politeness"`
+	Owned      bool   `toml:"owned"`
+}
+
+// The most specific host entry for a hostname, matching parent domains
+func hostConfig(host string) HostConfig {
+	host = strings.ToLower(host)
+	for {
+		if hc, exists := config.Hosts[host]; exists {
+			return hc
+		}
+		dot := strings.Index(host, ".")
+		if dot < 0 {
+			return HostConfig{}
+		}
+		host = host[dot+1:]
+	}
+}
+
+func politenessProfile(host string) PolitenessProfile {
+	name := hostConfig(host).Politeness
+	if name == "" {
+		name = politeDefault
+	}
+
+	p := config.Politeness[name]
+	if max := config.Fetcher.Http.HostRate; max > 0 && (p.Rate == 0 || p.Rate > max) {
+		p.Rate = max
+	}
+	return p
+}
+
+type hostSlot struct {
+	sem  chan struct{}
+	mu   sync.Mutex
+	next time.Time
+}
+
+// HostLimiter holds the politeness state of each host. State for a host is
+// created on first use with the profile the host has at that time.
+type HostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*hostSlot
+}
+
+var hostLimiter = &HostLimiter{hosts: make(map[string]*hostSlot)}
+
+func (hl *HostLimiter) slot(host string) (*hostSlot, PolitenessProfile) {
+	host = strings.ToLower(host)
+	p := politenessProfile(host)
+
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+
+	hs, exists := hl.hosts[host]
+	if !exists {
+		concurrency := p.Concurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		hs = &hostSlot{sem: make(chan struct{}, concurrency)}
+		hl.hosts[host] = hs
+	}
+	return hs, p
+}
+
+// Wait until a request to the host may start, or the request is cancelled.
+// The returned function must be called once the request has completed.
+func (hl *HostLimiter) Acquire(req *http.Request) (func(), error) {
+	hs, p := hl.slot(req.URL.Hostname())
+
+	select {
+	case hs.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	// Reserve the next start time allowed by the rate, then wait for it
+	hs.mu.Lock()
+	now := time.Now()
+	start := hs.next
+	if start.Before(now) {
+		start = now
+	}
+	if p.Rate > 0 {
+		hs.next = start.Add(time.Duration(float64(time.Second) / p.Rate))
+	}
+	hs.mu.Unlock()
+
+	if wait := start.Sub(now); wait > 0 {
+		countMetric("politeness.waits", 1)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			<-hs.sem
+			return nil, req.Context().Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if p.CrawlDelay > 0 {
+				hs.mu.Lock()
+				if after := time.Now().Add(time.Duration(p.CrawlDelay) * time.Millisecond); after.After(hs.next) {
+					hs.next = after
+				}
+				hs.mu.Unlock()
+			}
+			<-hs.sem
+		})
+	}, nil
+}
+
+// PolitenessTransport holds each request to its host's politeness profile.
+// A request keeps its place until its body has been read and closed.
+type PolitenessTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t *PolitenessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := hostLimiter.Acquire(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/placetime/datastore"
+	"net/http"
+	"net/url"
+)
+
+// Requests go through Fetcher.Http.Proxy when it is set and otherwise
+// through the proxy named by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables. A feed may name its own proxy, or "direct" to be
+// fetched without one. Proxies are http, https or socks5 urls.
+const directProxy = "direct"
+
+var (
+	defaultProxy *url.URL
+	feedProxies  = map[datastore.PidType]*url.URL{}
+)
+
+type proxyKey struct{}
+
+func parseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %s has no host", raw)
+	}
+	return u, nil
+}
+
+// Parse the configured proxies, once the config has been read
+func initProxies() error {
+	if raw := config.Fetcher.Http.Proxy; raw != "" {
+		u, err := parseProxy(raw)
+		if err != nil {
+			return err
+		}
+		defaultProxy = u
+	}
+
+	for pid, fc := range config.Feeds {
+		switch fc.Proxy {
+		case "":
+		case directProxy:
+			feedProxies[datastore.PidType(pid)] = nil
+		default:
+			u, err := parseProxy(fc.Proxy)
+			if err != nil {
+				return fmt.Errorf("feed %s: %s", pid, err.Error())
+			}
+			feedProxies[datastore.PidType(pid)] = u
+		}
+	}
+	return nil
+}
+
+// Send a request for a profile's feed through the proxy it overrides the
+// default with, if any
+func withFeedProxy(req *http.Request, pid datastore.PidType) *http.Request {
+	u, exists := feedProxies[pid]
+	if !exists {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), proxyKey{}, u))
+}
+
+// The Proxy function of the shared transport
+func requestProxy(req *http.Request) (*url.URL, error) {
+	if u, exists := req.Context().Value(proxyKey{}).(*url.URL); exists {
+		return u, nil
+	}
+	if defaultProxy != nil {
+		return defaultProxy, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
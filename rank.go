@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Weights of the parts of an item's rank, which the frontend uses to order
+// or trim busy timelines. Each part is between zero and one and the rank is
+// their weighted mean. Freshness halves for every HalfLife hours between
+// an item being published and the fetcher first seeing it.
+type RankConfig struct {
+	Trust     float64 `toml:"trust"`
+	Image     float64 `toml:"image"`
+	Text      float64 `toml:"text"`
+	Freshness float64 `toml:"freshness"`
+	HalfLife  float64 `toml:"halflife"`
+}
+
+// How much each trust tier adds to the rank of its items. Tiers defined in
+// the config without a rank get the default tier's.
+var trustRanks = map[string]float64{
+	trustTrusted:   1,
+	trustDefault:   0.5,
+	trustUntrusted: 0,
+}
+
+func trustRank(tier string) float64 {
+	if r, exists := trustRanks[tier]; exists {
+		return r
+	}
+	return trustRanks[trustDefault]
+}
+
+// A rough measure of how readable a title is, penalising titles that are
+// missing, very short or long, shouting or heavy on punctuation
+func textRank(title string) float64 {
+	title = strings.TrimSpace(title)
+	n := len([]rune(title))
+	if n == 0 {
+		return 0
+	}
+
+	r := 1.0
+	switch {
+	case n < 15:
+		r -= 0.4
+	case n > 150:
+		r -= 0.3
+	}
+
+	var letters, upper, marks int
+	for _, c := range title {
+		switch {
+		case unicode.IsLetter(c):
+			letters++
+			if unicode.IsUpper(c) {
+				upper++
+			}
+		case c == '!' || c == '?':
+			marks++
+		}
+	}
+	if letters == 0 {
+		return 0
+	}
+	if letters >= 10 && float64(upper)/float64(letters) > 0.6 {
+		r -= 0.3
+	}
+	if marks > 1 {
+		r -= 0.2
+	}
+	return math.Max(r, 0)
+}
+
+func freshnessRank(published int64, added int64) float64 {
+	if published == 0 || added == 0 {
+		return 0.5
+	}
+	age := time.Duration(added-published) * time.Second
+	if age <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, age.Hours()/config.Rank.HalfLife)
+}
+
+func imageRank(meta *ItemMeta) float64 {
+	switch {
+	case meta.Image == "":
+		return 0
+	case meta.RepeatedImage:
+		// Most likely the site's logo or a stock image
+		return 0.3
+	}
+	return 1
+}
+
+// Rank an item from what is known about it so far. Items are ranked when
+// ingested and ranked again once an image has been picked for them.
+func rankItem(meta *ItemMeta) float64 {
+	rc := config.Rank
+	total := rc.Trust + rc.Image + rc.Text + rc.Freshness
+	if total <= 0 {
+		return 0
+	}
+
+	rank := rc.Trust*trustRank(config.Feeds[string(meta.SourcePid())].Trust) +
+		rc.Image*imageRank(meta) +
+		rc.Text*textRank(meta.Title) +
+		rc.Freshness*freshnessRank(meta.Published, meta.Added)
+	return math.Round(rank/total*1000) / 1000
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/placetime/datastore"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Old items can be re-surfaced long after their artwork was picked, by which
+// time the publisher may have replaced the image. The refresh pass asks the
+// source of each old item's image whether it has changed and re-picks the
+// image when it has.
+
+func pumpImageRefreshJobs(ctx context.Context, jobs chan<- Job) {
+	metas, err := allItemMeta()
+	if err != nil {
+		log.Printf("Image refresh failed to read item metadata: %s", err.Error())
+		return
+	}
+
+	now := time.Now().Unix()
+	oldest := now - int64(config.Fetcher.Image.RefreshAge)
+	recent := now - int64(config.Fetcher.Image.Refresh)
+
+	for _, meta := range metas {
+		if meta.Image == "" || meta.Added == 0 || meta.Added > oldest || meta.ImageChecked > recent {
+			continue
+		}
+		if budget.Exhausted() {
+			return
+		}
+		image := meta.Image
+		if meta.ImageSource != "" {
+			// Revalidate the original rather than the proxy's rendition
+			image = meta.ImageSource
+		}
+		select {
+		case jobs <- ImageRefreshJob{ItemId: meta.Id, Link: meta.Link, Image: image, Modified: meta.ImageModified}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type ImageRefreshJob struct {
+	ItemId   datastore.ItemIdType
+	Link     string
+	Image    string
+	Modified string
+}
+
+func (job ImageRefreshJob) Do(ctx context.Context) {
+	log.Printf("Revalidating image %s for item %s", job.Image, job.ItemId)
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", job.Image, nil)
+	if err != nil {
+		log.Printf("Image refresh failed to create request for %s: %s", job.Image, err.Error())
+		return
+	}
+	if job.Modified != "" {
+		req.Header.Set("If-Modified-Since", job.Modified)
+	}
+
+	budget.AddRequest()
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		log.Printf("Image refresh failed to revalidate %s: %s", job.Image, err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	modified := resp.Header.Get("Last-Modified")
+	changed := resp.StatusCode == http.StatusOK && job.Modified != "" && modified != job.Modified
+
+	err = updateItemMeta(job.ItemId, func(meta *ItemMeta) {
+		meta.ImageChecked = time.Now().Unix()
+		if resp.StatusCode == http.StatusOK && modified != "" {
+			meta.ImageModified = modified
+		}
+	})
+	if err != nil {
+		log.Printf("Image refresh failed to write metadata for item %s: %s", job.ItemId, err.Error())
+	}
+
+	// Without a previous Last-Modified there is nothing to compare against,
+	// the value just recorded becomes the baseline for the next pass
+	if !changed {
+		return
+	}
+
+	log.Printf("Image for item %s has changed at the source, picking again", job.ItemId)
+	countMetric("image.refreshed", 1)
+	ImageJob{Url: job.Link, ItemId: job.ItemId}.Do(ctx)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/placetime/datastore"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Timelines served from other regions read images from a store near them.
+// Each image file written to the image directory is copied to every
+// configured replica in the background once its image job completes. A
+// replica is a directory, such as a mounted bucket, or an http or https
+// base url that files are PUT to and checked for with HEAD. Copies that
+// are dropped when the queue is full, that fail, or that are pending when
+// the fetcher stops are made good by the repair-replicas command, which
+// copies every image a replica lacks.
+
+type ImageReplica interface {
+	Has(name string) (bool, error)
+	Put(name string, data []byte) error
+	String() string
+}
+
+type dirReplica struct {
+	dir string
+}
+
+type httpReplica struct {
+	base string
+}
+
+const replicaQueueLength = 1000
+
+var (
+	imageReplicas []ImageReplica
+	replicaQueue  = make(chan string, replicaQueueLength)
+	replicaClient = &http.Client{Timeout: 60 * time.Second}
+)
+
+func newImageReplica(target string) (ImageReplica, error) {
+	// A Windows path such as C:\replica would parse with the drive as its
+	// scheme
+	if filepath.VolumeName(target) != "" {
+		return &dirReplica{dir: target}, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &httpReplica{base: strings.TrimRight(target, "/") + "/"}, nil
+	case "file":
+		return &dirReplica{dir: fileUrlPath(u)}, nil
+	case "":
+		return &dirReplica{dir: target}, nil
+	}
+	return nil, fmt.Errorf("unsupported image replica %s", target)
+}
+
+func initImageReplicas() {
+	for _, target := range config.Image.Replicas {
+		// Checked when the configuration was read
+		replica, _ := newImageReplica(target)
+		imageReplicas = append(imageReplicas, replica)
+	}
+	if len(imageReplicas) == 0 {
+		return
+	}
+
+	go func() {
+		for name := range replicaQueue {
+			replicateImage(name)
+		}
+	}()
+	log.Printf("Replicating images to %d stores", len(imageReplicas))
+}
+
+// Queue the image files of an item for copying to the replicas
+func replicateItemImages(id datastore.ItemIdType) {
+	if len(imageReplicas) == 0 {
+		return
+	}
+
+	files, _ := filepath.Glob(filepath.Join(config.Image.Path, string(id)+".*"))
+	for _, file := range files {
+		select {
+		case replicaQueue <- filepath.Base(file):
+		default:
+			log.Printf("Replica queue is full, skipping image %s until repaired", filepath.Base(file))
+			countMetric("replica.dropped", 1)
+		}
+	}
+	gaugeMetric("replica.queue", int64(len(replicaQueue)))
+}
+
+func replicateImage(name string) {
+	data, err := ioutil.ReadFile(filepath.Join(config.Image.Path, name))
+	if err != nil {
+		log.Printf("Could not read image %s to replicate: %s", name, err.Error())
+		countMetric("replica.errors", 1)
+		return
+	}
+
+	for _, replica := range imageReplicas {
+		if err := replica.Put(name, data); err != nil {
+			log.Printf("Could not copy image %s to replica %s: %s", name, replica, err.Error())
+			countMetric("replica.errors", 1)
+			continue
+		}
+		countMetric("replica.copied", 1)
+	}
+}
+
+// Copy every image in the image directory to the replicas that lack it
+func repairReplicas() {
+	if len(imageReplicas) == 0 {
+		log.Printf("No image replicas are configured")
+		return
+	}
+
+	entries, err := ioutil.ReadDir(config.Image.Path)
+	if err != nil {
+		log.Printf("Could not read image path %s: %s", config.Image.Path, err.Error())
+		os.Exit(1)
+	}
+
+	checked, copied, failed := 0, 0, 0
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		name := entry.Name()
+		checked++
+
+		var data []byte
+		for _, replica := range imageReplicas {
+			has, err := replica.Has(name)
+			if err != nil {
+				log.Printf("Could not check image %s in replica %s: %s", name, replica, err.Error())
+				failed++
+				continue
+			}
+			if has {
+				continue
+			}
+
+			if data == nil {
+				if data, err = ioutil.ReadFile(filepath.Join(config.Image.Path, name)); err != nil {
+					log.Printf("Could not read image %s: %s", name, err.Error())
+					failed++
+					break
+				}
+			}
+			if err := replica.Put(name, data); err != nil {
+				log.Printf("Could not copy image %s to replica %s: %s", name, replica, err.Error())
+				failed++
+				continue
+			}
+			copied++
+		}
+	}
+
+	log.Printf("Checked %d images against %d replicas, copied %d missing copies, %d failed", checked, len(imageReplicas), copied, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func (r *dirReplica) Has(name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(r.dir, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Written under a temporary name first so a reader never sees part of an
+// image
+func (r *dirReplica) Put(name string, data []byte) error {
+	filename := filepath.Join(r.dir, name)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func (r *dirReplica) String() string {
+	return r.dir
+}
+
+func (r *httpReplica) Has(name string) (bool, error) {
+	resp, err := replicaClient.Head(r.base + url.PathEscape(name))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("replica returned %s", resp.Status)
+	}
+	return true, nil
+}
+
+func (r *httpReplica) Put(name string, data []byte) error {
+	req, err := http.NewRequest("PUT", r.base+url.PathEscape(name), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(data))
+
+	resp, err := replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("replica returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *httpReplica) String() string {
+	return redactedUrl(r.base)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Feed fetches that fail with a network error or a server error are tried
+// again up to Attempts times in all, waiting exponentially longer from
+// Backoff milliseconds between attempts with up to half as much again added
+// at random so retries against a struggling host are spread out.
+type RetryConfig struct {
+	Attempts int `toml:"attempts"`
+	Backoff  int `toml:"backoff"`
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		// An open breaker will not have closed by the next attempt and a
+		// blocked host will still be blocked
+		var open *BreakerOpenError
+		var blocked *BlockedAddressError
+		return !errors.As(err, &open) && !errors.As(err, &blocked)
+	}
+	// A server saying when to come back will not want us sooner
+	return resp.StatusCode >= 500 && retryAfter(resp).IsZero()
+}
+
+// When a 429 or 503 response asks for the request to be made again, given
+// as a number of seconds or a date. Zero when it does not say.
+func retryAfter(resp *http.Response) time.Time {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return time.Time{}
+	}
+
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return time.Time{}
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return time.Time{}
+		}
+		return time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+func retryDelay(attempt int) time.Duration {
+	delay := time.Duration(config.Fetcher.Feed.Retry.Backoff) * time.Millisecond << uint(attempt-1)
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Send a request, retrying transient failures. Returns the response of the
+// last attempt along with the number of attempts made.
+func doWithRetry(client *http.Client, req *http.Request) (*http.Response, int, error) {
+	attempts := config.Fetcher.Feed.Retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		budget.AddRequest()
+		resp, err := doHedged(client, req)
+		if attempt == attempts || !retryable(resp, err) {
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("%w after %d attempts", err, attempt)
+			}
+			return resp, attempt, err
+		}
+
+		if err == nil {
+			resp.Body.Close()
+		}
+		countMetric("feed.retries", 1)
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-req.Context().Done():
+			return nil, attempt, req.Context().Err()
+		}
+	}
+}
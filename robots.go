@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Item pages are only scraped where the site's robots.txt allows it. The
+// rules for each site are cached for a day, or an hour when robots.txt
+// could not be read. Following RFC 9309, a missing robots.txt allows
+// everything and one the server fails to serve disallows everything until
+// it can be read. Hosts marked as owned are never checked.
+const (
+	robotsAgent     = "placetime"
+	robotsTtl       = 24 * time.Hour
+	robotsFailedTtl = time.Hour
+	robotsMaxBytes  = 500 * 1024
+)
+
+type robotsRule struct {
+	allow   bool
+	path    string
+	pattern *regexp.Regexp
+}
+
+type robotsRules struct {
+	rules   []robotsRule
+	all     bool // disallow everything, robots.txt was unreachable
+	expires time.Time
+}
+
+type RobotsCache struct {
+	mu    sync.Mutex
+	sites map[string]*robotsRules
+}
+
+var robotsCache = &RobotsCache{sites: make(map[string]*robotsRules)}
+
+// Report whether a page may be scraped
+func robotsAllowed(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return true
+	}
+	if hostConfig(u.Hostname()).Owned {
+		return true
+	}
+
+	rr := robotsCache.rules(u.Scheme + "://" + u.Host)
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return rr.Allowed(path)
+}
+
+func (rc *RobotsCache) rules(site string) *robotsRules {
+	rc.mu.Lock()
+	rr, exists := rc.sites[site]
+	rc.mu.Unlock()
+	if exists && time.Now().Before(rr.expires) {
+		return rr
+	}
+
+	rr = fetchRobots(site)
+	rc.mu.Lock()
+	rc.sites[site] = rr
+	rc.mu.Unlock()
+	return rr
+}
+
+func fetchRobots(site string) *robotsRules {
+	budget.AddRequest()
+	resp, err := fetchClient.Get(site + "/robots.txt")
+	if err != nil {
+		return &robotsRules{all: true, expires: time.Now().Add(robotsFailedTtl)}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return &robotsRules{all: true, expires: time.Now().Add(robotsFailedTtl)}
+	case resp.StatusCode >= 400:
+		return &robotsRules{expires: time.Now().Add(robotsTtl)}
+	}
+
+	rr := parseRobots(io.LimitReader(countingReader{resp.Body}, robotsMaxBytes))
+	rr.expires = time.Now().Add(robotsTtl)
+	return rr
+}
+
+// Parse the rules of the group that applies to us, which is the group
+// naming our agent if there is one and the * group otherwise
+func parseRobots(r io.Reader) *robotsRules {
+	var ours, any []robotsRule
+	var foundOurs bool
+
+	// The agents of the group being read, and whether its rules have
+	// started, since consecutive user-agent lines share a group
+	var agents []string
+	inRules := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+
+		switch field {
+		case "user-agent":
+			if inRules {
+				agents = nil
+				inRules = false
+			}
+			agents = append(agents, strings.ToLower(value))
+
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				// An empty disallow allows everything
+				continue
+			}
+			rule := robotsRule{allow: field == "allow", path: value, pattern: robotsPattern(value)}
+			for _, agent := range agents {
+				if agent == "*" {
+					any = append(any, rule)
+				} else if strings.Contains(robotsAgent, agent) || strings.Contains(agent, robotsAgent) {
+					ours = append(ours, rule)
+					foundOurs = true
+				}
+			}
+		}
+	}
+
+	if foundOurs {
+		return &robotsRules{rules: ours}
+	}
+	return &robotsRules{rules: any}
+}
+
+// The longest matching rule decides, with allow winning ties
+func (rr *robotsRules) Allowed(path string) bool {
+	if rr.all {
+		return false
+	}
+
+	allowed := true
+	longest := -1
+	for _, rule := range rr.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if len(rule.path) > longest || (len(rule.path) == longest && rule.allow) {
+			longest = len(rule.path)
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+// Compile a rule path, where * matches any run of characters and a
+// trailing $ anchors the end of the path
+func robotsPattern(path string) *regexp.Regexp {
+	anchored := strings.HasSuffix(path, "$")
+	expr := "^" + strings.Replace(regexp.QuoteMeta(strings.TrimSuffix(path, "$")), `\*`, ".*", -1)
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
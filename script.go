@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"github.com/iand/feedparser"
+	"go.starlark.net/starlark"
+	"time"
+)
+
+// A feed may name a Starlark script that is run on each of its items after
+// any transforms. The script must define a transform function taking a dict
+// with the keys title, link, image, description and tags. It returns None to
+// drop the item or a dict whose title, link, image and tags replace the
+// item's own:
+//
+//	def transform(item):
+//	    if item["title"].startswith("Advert:"):
+//	        return None
+//	    item["tags"].append("news")
+//	    return item
+//
+// Each call is limited in execution steps and in wall clock time.
+type Script struct {
+	filename  string
+	transform starlark.Value
+}
+
+func loadScript(filename string) (*Script, error) {
+	thread := &starlark.Thread{Name: filename}
+	globals, err := starlark.ExecFile(thread, filename, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+
+	fn, exists := globals["transform"]
+	if !exists {
+		return nil, fmt.Errorf("%s does not define transform", filename)
+	}
+	if _, ok := fn.(starlark.Callable); !ok {
+		return nil, fmt.Errorf("transform in %s is not a function", filename)
+	}
+	return &Script{filename: filename, transform: fn}, nil
+}
+
+// Run the script on an item, updating it in place. Returns the tags the
+// script assigned and whether the item should be kept.
+func (sc *Script) Apply(item *feedparser.FeedItem) ([]string, bool, error) {
+	thread := &starlark.Thread{Name: sc.filename}
+	thread.SetMaxExecutionSteps(config.Script.MaxSteps)
+	timer := time.AfterFunc(time.Duration(config.Script.Timeout)*time.Millisecond, func() {
+		thread.Cancel("time limit exceeded")
+	})
+	defer timer.Stop()
+
+	in := starlark.NewDict(5)
+	in.SetKey(starlark.String("title"), starlark.String(item.Title))
+	in.SetKey(starlark.String("link"), starlark.String(item.Link))
+	in.SetKey(starlark.String("image"), starlark.String(item.Image))
+	in.SetKey(starlark.String("description"), starlark.String(item.Description))
+	in.SetKey(starlark.String("tags"), starlark.NewList(nil))
+
+	result, err := starlark.Call(thread, sc.transform, starlark.Tuple{in}, nil)
+	if err != nil {
+		return nil, true, err
+	}
+	if result == starlark.None {
+		return nil, false, nil
+	}
+
+	out, ok := result.(*starlark.Dict)
+	if !ok {
+		return nil, true, fmt.Errorf("transform returned %s, not a dict or None", result.Type())
+	}
+
+	item.Title = dictString(out, "title", item.Title)
+	item.Link = dictString(out, "link", item.Link)
+	item.Image = dictString(out, "image", item.Image)
+
+	var tags []string
+	if v, found, _ := out.Get(starlark.String("tags")); found {
+		if list, ok := v.(*starlark.List); ok {
+			for i := 0; i < list.Len(); i++ {
+				if s, ok := starlark.AsString(list.Index(i)); ok {
+					tags = append(tags, s)
+				}
+			}
+		}
+	}
+	return tags, true, nil
+}
+
+func dictString(d *starlark.Dict, key string, fallback string) string {
+	v, found, _ := d.Get(starlark.String(key))
+	if !found {
+		return fallback
+	}
+	if s, ok := starlark.AsString(v); ok {
+		return s
+	}
+	return fallback
+}
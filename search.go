@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A lightweight inverted index over item titles and tags, kept in Redis so
+// that search needs no extra service. Every term maps to a sorted set of the
+// item ids containing it, scored by the time the item was added, and a
+// query intersects the sets of its terms, newest first.
+// GeoPrecisions are the geohash lengths located items are bucketed at.
+type SearchConfig struct {
+	Addr          string `toml:"addr"` // host:port of the redis server, empty to disable
+	Prefix        string `toml:"prefix"`
+	GeoPrecisions []int  `toml:"geoprecisions"`
+}
+
+// Seconds a query's intersection is kept so repeated queries are cheap
+const searchResultTtl = 60
+
+var searchPool *redis.Pool
+
+// Words too common to be worth indexing
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "for": true, "from": true, "in": true, "is": true,
+	"it": true, "of": true, "on": true, "or": true, "the": true, "to": true,
+	"with": true,
+}
+
+func initSearch() {
+	if config.Search.Addr == "" {
+		return
+	}
+
+	searchPool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.Search.Addr)
+		},
+	}
+	log.Printf("Maintaining search index in redis at %s", config.Search.Addr)
+}
+
+func searchEnabled() bool {
+	return searchPool != nil
+}
+
+// Split text into lower case index terms, dropping stop words, single
+// characters and repeats
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	terms := make([]string, 0)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(word)) < 2 || stopWords[word] || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+func searchKey(term string) string {
+	return config.Search.Prefix + "term:" + term
+}
+
+func indexItem(meta *ItemMeta) {
+	if !searchEnabled() {
+		return
+	}
+
+	conn := searchPool.Get()
+	defer conn.Close()
+
+	bucketItem(conn, meta)
+
+	terms := searchTerms(meta.Title + " " + strings.Join(meta.Tags, " "))
+	if len(terms) == 0 {
+		return
+	}
+
+	for _, term := range terms {
+		conn.Send("ZADD", searchKey(term), meta.Added, string(meta.Id))
+	}
+	if err := conn.Flush(); err != nil {
+		log.Printf("Could not index item %s: %s", meta.Id, err.Error())
+		return
+	}
+	for range terms {
+		if _, err := conn.Receive(); err != nil {
+			log.Printf("Could not index item %s: %s", meta.Id, err.Error())
+			return
+		}
+	}
+	countMetric("search.indexed", 1)
+}
+
+// Remove an item from the terms it was indexed under
+func unindexItem(meta *ItemMeta) {
+	if !searchEnabled() {
+		return
+	}
+
+	conn := searchPool.Get()
+	defer conn.Close()
+
+	unbucketItem(conn, meta)
+	for _, term := range searchTerms(meta.Title + " " + strings.Join(meta.Tags, " ")) {
+		if _, err := conn.Do("ZREM", searchKey(term), string(meta.Id)); err != nil {
+			log.Printf("Could not unindex item %s: %s", meta.Id, err.Error())
+			return
+		}
+	}
+}
+
+// Find up to limit ids of items matching every term in the query, newest
+// first
+func searchItems(query string, limit int) ([]datastore.ItemIdType, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	conn := searchPool.Get()
+	defer conn.Close()
+
+	key := searchKey(terms[0])
+	if len(terms) > 1 {
+		key = config.Search.Prefix + "query:" + strings.Join(terms, " ")
+		args := redis.Args{key, len(terms)}
+		for _, term := range terms {
+			args = args.Add(searchKey(term))
+		}
+		args = args.Add("AGGREGATE", "MAX")
+		if _, err := conn.Do("ZINTERSTORE", args...); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Do("EXPIRE", key, searchResultTtl); err != nil {
+			return nil, err
+		}
+	}
+
+	members, err := redis.Strings(conn.Do("ZREVRANGE", key, 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]datastore.ItemIdType, len(members))
+	for i, m := range members {
+		ids[i] = datastore.ItemIdType(m)
+	}
+	return ids, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/placetime/datastore"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most items in a feed have been seen before, and asking the datastore
+// about each costs a round trip. A bloom filter of the ids of items the
+// fetcher holds metadata for lets those be answered from the metadata
+// directory. The filter only knows items with metadata, not those stored
+// before metadata was kept or whose metadata could not be written, so an
+// item it has never had is still looked up in the datastore before being
+// taken as new.
+//
+// The filter is built from the metadata directory at startup and rebuilt
+// every Rebuild seconds, sized for Capacity ids at a FalsePositive rate.
+// A zero Capacity disables the filter.
+type SeenConfig struct {
+	Capacity      int     `toml:"capacity"`
+	FalsePositive float64 `toml:"falsepositive"`
+	Rebuild       int     `toml:"rebuild"`
+}
+
+type BloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes int
+}
+
+func NewBloomFilter(capacity int, falsePositive float64) *BloomFilter {
+	m := math.Ceil(-float64(capacity) * math.Log(falsePositive) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(m / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &BloomFilter{bits: make([]uint64, (uint64(m)+63)/64), m: uint64(m), hashes: hashes}
+}
+
+// The positions of a key's bits, by double hashing
+func (bf *BloomFilter) positions(key string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+
+	positions := make([]uint64, bf.hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % bf.m
+	}
+	return positions
+}
+
+func (bf *BloomFilter) Add(key string) {
+	for _, p := range bf.positions(key) {
+		bf.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+func (bf *BloomFilter) Has(key string) bool {
+	for _, p := range bf.positions(key) {
+		if bf.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type SeenItems struct {
+	mu     sync.RWMutex
+	filter *BloomFilter
+
+	// Ids added while a rebuild reads the directory, which the new filter
+	// is given once built. Nil when no rebuild is running.
+	pending map[datastore.ItemIdType]bool
+}
+
+var seenItems = &SeenItems{}
+
+func initSeenItems() {
+	if config.Seen.Capacity <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			seenItems.rebuild()
+			time.Sleep(time.Duration(config.Seen.Rebuild) * time.Second)
+		}
+	}()
+}
+
+// Fill a new filter with the ids of every item there is metadata for. Until
+// the first build completes the metadata directory is checked for every item.
+func (si *SeenItems) rebuild() {
+	started := time.Now()
+	si.mu.Lock()
+	si.pending = make(map[datastore.ItemIdType]bool)
+	si.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(config.Meta.Path)
+	if err != nil {
+		log.Printf("Could not build seen item filter: %s", err.Error())
+		si.mu.Lock()
+		si.pending = nil
+		si.mu.Unlock()
+		return
+	}
+
+	filter := NewBloomFilter(config.Seen.Capacity, config.Seen.FalsePositive)
+	count := 0
+	for _, entry := range entries {
+		if name := entry.Name(); !entry.IsDir() && strings.HasSuffix(name, ".json") {
+			filter.Add(strings.TrimSuffix(name, ".json"))
+			count++
+		}
+	}
+
+	// Items added while the directory was read may have been missed by it.
+	// Only those are carried over, so the old filter's false positives are
+	// not.
+	si.mu.Lock()
+	for id := range si.pending {
+		filter.Add(string(id))
+	}
+	si.pending = nil
+	si.filter = filter
+	si.mu.Unlock()
+
+	if count > config.Seen.Capacity {
+		log.Printf("Seen item filter holds %d items, more than its capacity of %d", count, config.Seen.Capacity)
+	}
+	log.Printf("Built seen item filter of %d items in %s", count, time.Since(started))
+	gaugeMetric("seen.items", int64(count))
+}
+
+func (si *SeenItems) Add(id datastore.ItemIdType) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if si.filter != nil {
+		si.filter.Add(string(id))
+	}
+	if si.pending != nil {
+		si.pending[id] = true
+	}
+}
+
+// Report whether an item is new, asking the datastore only when the filter
+// and the metadata directory cannot say it is known
+func (si *SeenItems) IsNew(s *datastore.RedisStore, id datastore.ItemIdType) bool {
+	si.mu.RLock()
+	known := si.filter == nil || si.filter.Has(string(id))
+	si.mu.RUnlock()
+
+	if known {
+		if _, err := os.Stat(itemMetaFilename(id)); err == nil {
+			countMetric("seen.local", 1)
+			return false
+		}
+	}
+
+	countMetric("seen.lookups", 1)
+	existing, err := s.Item(id)
+	isNew := err != nil || existing == nil
+	if !isNew {
+		si.Add(id)
+	}
+	return isNew
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// Elsewhere the fetcher is run under systemd, launchd or similar, which
+// stop it with SIGTERM and need nothing installed by the fetcher itself
+
+func handleStop(cancel context.CancelFunc) func() {
+	stopOnSignal(cancel)
+	return func() {}
+}
+
+func installService() {
+	log.Printf("Could not install service: only supported on Windows, use a systemd unit or launchd job")
+	os.Exit(1)
+}
+
+func removeService() {
+	log.Printf("Could not remove service: only supported on Windows")
+	os.Exit(1)
+}
+
+func NewEventLogWriter(tag string) (io.Writer, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
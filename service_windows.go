@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// On Windows the fetcher can run as a service, registered with the
+// install-service command to start automatically with the configuration
+// file it was installed with. Its log is best sent to the event log, with
+// a log target of eventlog, as a service has no console. Asked to stop,
+// the service cancels the fetcher and only reports itself stopped once the
+// workers have finished.
+
+const (
+	serviceName        = "placetime-fetcher"
+	serviceDisplayName = "Placetime Fetcher"
+)
+
+type fetcherService struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (fs *fetcherService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Printf("Received service stop, shutting down")
+				status <- svc.Status{State: svc.StopPending}
+				fs.cancel()
+				<-fs.done
+				return false, 0
+			}
+		case <-fs.done:
+			// The fetcher finished by itself, as with -runonce
+			return false, 0
+		}
+	}
+}
+
+// Cancel the fetcher when the service manager stops it, or on an interrupt
+// when run from a console. The returned function is called once the
+// fetcher has stopped.
+func handleStop(cancel context.CancelFunc) func() {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		stopOnSignal(cancel)
+		return func() {}
+	}
+
+	fs := &fetcherService{cancel: cancel, done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		if err := svc.Run(serviceName, fs); err != nil {
+			log.Printf("Could not run as a service: %s", err.Error())
+			cancel()
+		}
+		close(finished)
+	}()
+	return func() {
+		close(fs.done)
+		<-finished
+	}
+}
+
+func installService() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("Could not find the fetcher executable: %s", err.Error())
+		os.Exit(1)
+	}
+
+	var args []string
+	if configFilename != "" {
+		abs, err := filepath.Abs(configFilename)
+		if err != nil {
+			log.Printf("Could not resolve config file %s: %s", configFilename, err.Error())
+			os.Exit(1)
+		}
+		args = append(args, "-config", abs)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Printf("Could not connect to the service manager: %s", err.Error())
+		os.Exit(1)
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "Fetches feeds and images for Placetime profiles",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		log.Printf("Could not install service %s: %s", serviceName, err.Error())
+		os.Exit(1)
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(config.Log.Tag, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		log.Printf("Could not register event log source %s: %s", config.Log.Tag, err.Error())
+	}
+	log.Printf("Installed service %s running %s %s", serviceName, exe, strings.Join(args, " "))
+}
+
+func removeService() {
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Printf("Could not connect to the service manager: %s", err.Error())
+		os.Exit(1)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		log.Printf("Could not open service %s: %s", serviceName, err.Error())
+		os.Exit(1)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		log.Printf("Could not remove service %s: %s", serviceName, err.Error())
+		os.Exit(1)
+	}
+	if err := eventlog.Remove(config.Log.Tag); err != nil {
+		log.Printf("Could not remove event log source %s: %s", config.Log.Tag, err.Error())
+	}
+	log.Printf("Removed service %s", serviceName)
+}
+
+// EventLogWriter writes each log line to the Windows event log, as an
+// error, warning or information event
+type EventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func NewEventLogWriter(tag string) (*EventLogWriter, error) {
+	elog, err := eventlog.Open(tag)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLogWriter{elog: elog}, nil
+}
+
+func (ew *EventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+
+	var err error
+	switch logPriority(msg) {
+	case priorityErr:
+		err = ew.elog.Error(1, msg)
+	case priorityWarning:
+		err = ew.elog.Warning(1, msg)
+	default:
+		err = ew.elog.Info(1, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iand/feedparser"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A parser plugin can be run in shadow of the built in parser to validate
+// it before switching over. Sample is the fraction of parsed feeds also
+// handed to the plugin, whose result is compared field by field with the
+// built in parser's and otherwise ignored. Mismatches are counted in the
+// parser.shadow metrics and, when Report is set, appended to that file one
+// JSON object per line.
+type ShadowConfig struct {
+	Sample float64 `toml:"sample"`
+	Report string  `toml:"report"`
+}
+
+type PluginParseArgs struct {
+	Url  string `json:"url"`
+	Body []byte `json:"body"`
+}
+
+// A field on which the two parsers disagree. Item is the id of the item,
+// empty for a field of the feed itself.
+type ParserMismatch struct {
+	Url     string `json:"url"`
+	Item    string `json:"item,omitempty"`
+	Field   string `json:"field"`
+	Primary string `json:"primary"`
+	Shadow  string `json:"shadow"`
+	Found   int64  `json:"found"`
+}
+
+var shadowReportMutex sync.Mutex
+
+// Parse a feed with the parser plugin too, if this feed is sampled
+func shadowParse(feedUrl string, body []byte, primary *feedparser.Feed) {
+	if parserPlugin == nil || primary == nil || rand.Float64() >= config.Shadow.Sample {
+		return
+	}
+
+	// The pipeline rewrites items in place, compare what the parser gave
+	snapshot := *primary
+	snapshot.Items = make([]*feedparser.FeedItem, len(primary.Items))
+	for i, item := range primary.Items {
+		copied := *item
+		snapshot.Items[i] = &copied
+	}
+
+	go func() {
+		var reply PluginFetchReply
+		if err := parserPlugin.Call("Parser.Parse", PluginParseArgs{Url: feedUrl, Body: body}, &reply, time.Minute); err != nil {
+			log.Printf("Shadow parser failed on %s: %s", redactedUrl(feedUrl), err.Error())
+			countMetric("parser.shadow.errors", 1)
+			return
+		}
+
+		countMetric("parser.shadow.compared", 1)
+		mismatches := compareParsed(feedUrl, &snapshot, &reply)
+		if len(mismatches) == 0 {
+			return
+		}
+
+		log.Printf("Shadow parser disagrees on %d fields of %s", len(mismatches), redactedUrl(feedUrl))
+		countMetric("parser.shadow.mismatched", 1)
+		for _, m := range mismatches {
+			countMetric("parser.shadow.field."+m.Field, 1)
+		}
+		if config.Shadow.Report != "" {
+			writeShadowReport(config.Shadow.Report, mismatches)
+		}
+	}()
+}
+
+func compareParsed(feedUrl string, primary *feedparser.Feed, shadow *PluginFetchReply) []ParserMismatch {
+	var mismatches []ParserMismatch
+	now := time.Now().Unix()
+	differ := func(item string, field string, p string, s string) {
+		if strings.TrimSpace(p) != strings.TrimSpace(s) {
+			mismatches = append(mismatches, ParserMismatch{Url: feedUrl, Item: item, Field: field, Primary: p, Shadow: s, Found: now})
+		}
+	}
+
+	differ("", "title", primary.Title, shadow.Title)
+	differ("", "items", fmt.Sprint(len(primary.Items)), fmt.Sprint(len(shadow.Items)))
+
+	shadowItems := make(map[string]PluginItem)
+	for _, si := range shadow.Items {
+		shadowItems[si.Id] = si
+	}
+
+	for _, pi := range primary.Items {
+		si, exists := shadowItems[pi.Id]
+		if !exists {
+			differ(pi.Id, "item", "present", "missing")
+			continue
+		}
+		delete(shadowItems, pi.Id)
+
+		differ(pi.Id, "title", pi.Title, si.Title)
+		differ(pi.Id, "link", pi.Link, si.Link)
+		differ(pi.Id, "description", pi.Description, si.Description)
+		differ(pi.Id, "image", pi.Image, si.Image)
+
+		var when int64
+		if !pi.When.IsZero() {
+			when = pi.When.Unix()
+		}
+		differ(pi.Id, "when", fmt.Sprint(when), fmt.Sprint(si.When))
+	}
+
+	for id := range shadowItems {
+		differ(id, "item", "missing", "present")
+	}
+	return mismatches
+}
+
+func writeShadowReport(filename string, mismatches []ParserMismatch) {
+	shadowReportMutex.Lock()
+	defer shadowReportMutex.Unlock()
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("Failed to open shadow parser report %s: %s", filename, err.Error())
+		return
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, m := range mismatches {
+		if err := enc.Encode(m); err != nil {
+			log.Printf("Failed to write shadow parser report %s: %s", filename, err.Error())
+			return
+		}
+	}
+}
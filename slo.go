@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Each stage of ingestion, from fetching a feed through parsing, dedup,
+// enrichment and image picking to storing items, is timed on its own. A
+// stage's timings go to the metrics sinks as stage.<name>.duration, with
+// failures counted as stage.<name>.errors and every operation counted in
+// its latency bucket as stage.<name>.bucket.<ms>, so a sink with no
+// histograms of its own still has one. The same histograms, since the
+// fetcher started, are served by the API at /stages.
+//
+// Objectives can be set for any stage with [[slo]] sections. An operation
+// is good when it succeeds within the objective's latency, and the
+// objective is that at least Target of them are good. The rate at which
+// the remaining budget of bad operations is being spent is measured over
+// the objective's window and over the last twelfth of it. When both burn
+// faster than Burn times the rate the objective allows, an alert is posted
+// to the [alerts] url, and another once the burn over the window falls
+// back below. Failures include those of the sources themselves, such as a
+// feed answering 404, so objectives for the fetch stage should allow for
+// the feeds followed.
+
+const (
+	stageFetch  = "fetch"
+	stageParse  = "parse"
+	stageDedup  = "dedup"
+	stageEnrich = "enrich"
+	stageImage  = "image"
+	stageStore  = "store"
+)
+
+var stageNames = []string{stageFetch, stageParse, stageDedup, stageEnrich, stageImage, stageStore}
+
+// Upper bounds of the latency buckets in milliseconds, the last bucket
+// holding everything slower
+var stageBuckets = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// How few operations in a window are too few to judge an objective by
+const minSloEvents = 20
+
+// Stage is one of fetch, parse, dedup, enrich, image or store. Target is
+// the fraction of operations that must be good, such as 0.99. Latency is
+// the milliseconds a good operation finishes within, zero for any
+// successful operation to be good. Window is in seconds and defaults to an
+// hour. Burn defaults to 14.4, the rate that spends a month's budget in
+// two days.
+type SloConfig struct {
+	Stage   string  `toml:"stage"`
+	Target  float64 `toml:"target"`
+	Latency int     `toml:"latency"`
+	Window  int     `toml:"window"`
+	Burn    float64 `toml:"burn"`
+}
+
+// Url receives a JSON SloAlert when an objective starts and stops burning
+type AlertConfig struct {
+	Url string `toml:"url"`
+}
+
+// Posted to the alert url. State is firing or resolved.
+type SloAlert struct {
+	Stage     string  `json:"stage"`
+	State     string  `json:"state"`
+	Target    float64 `json:"target"`
+	Latency   int     `json:"latency,omitempty"`
+	Window    int     `json:"window"`
+	Burn      float64 `json:"burn"`
+	BurnRate  float64 `json:"burnrate"`
+	ShortBurn float64 `json:"shortburn"`
+	Events    int64   `json:"events"`
+	Bad       int64   `json:"bad"`
+	At        int64   `json:"at"`
+}
+
+type StageHistogram struct {
+	Count   int64          `json:"count"`
+	Errors  int64          `json:"errors"`
+	Buckets []StageBucket  `json:"buckets"`
+	Slos    []*SloSnapshot `json:"slos,omitempty"`
+}
+
+// Count is cumulative, of operations taking at most Le milliseconds. The
+// last bucket, with no Le, counts every operation.
+type StageBucket struct {
+	Le    int64 `json:"le,omitempty"`
+	Count int64 `json:"count"`
+}
+
+type SloSnapshot struct {
+	SloConfig
+	BurnRate  float64 `json:"burnrate"`
+	ShortBurn float64 `json:"shortburn"`
+	Events    int64   `json:"events"`
+	Firing    bool    `json:"firing"`
+}
+
+type stageStats struct {
+	count   int64
+	errors  int64
+	buckets []int64
+}
+
+// One minute of an objective's window
+type sloSlot struct {
+	minute int64
+	good   int64
+	total  int64
+}
+
+type sloTracker struct {
+	SloConfig
+	slots  []sloSlot
+	firing bool
+}
+
+var (
+	stageMutex  sync.Mutex
+	stages      = make(map[string]*stageStats)
+	sloTrackers []*sloTracker
+)
+
+func checkSloConfig() error {
+	for _, sc := range config.Slos {
+		if !validStage(sc.Stage) {
+			return fmt.Errorf("unknown stage %q in slo", sc.Stage)
+		}
+		if sc.Target <= 0 || sc.Target >= 1 {
+			return fmt.Errorf("slo target for stage %s must be between 0 and 1", sc.Stage)
+		}
+		if sc.Latency < 0 || sc.Burn < 0 || (sc.Window != 0 && sc.Window < 60) {
+			return fmt.Errorf("slo for stage %s needs a latency and burn of at least zero and a window of at least 60 seconds", sc.Stage)
+		}
+	}
+	return nil
+}
+
+func validStage(name string) bool {
+	for _, stage := range stageNames {
+		if stage == name {
+			return true
+		}
+	}
+	return false
+}
+
+func initSlos() {
+	for _, sc := range config.Slos {
+		if sc.Window == 0 {
+			sc.Window = 60 * 60
+		}
+		if sc.Burn == 0 {
+			sc.Burn = 14.4
+		}
+		sloTrackers = append(sloTrackers, &sloTracker{SloConfig: sc, slots: make([]sloSlot, sc.Window/60)})
+	}
+	if len(sloTrackers) == 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			checkSlos()
+		}
+	}()
+	log.Printf("Watching %d service level objectives", len(sloTrackers))
+}
+
+// Record one operation of a stage that began at start, failed when err is
+// set
+func stageDone(stage string, start time.Time, err error) {
+	d := time.Since(start)
+	ms := d.Milliseconds()
+	for _, sink := range metricsSinks {
+		sink.Timing("stage."+stage+".duration", d)
+	}
+	if err != nil {
+		countMetric("stage."+stage+".errors", 1)
+	}
+
+	bucket := len(stageBuckets)
+	for i, le := range stageBuckets {
+		if ms <= le {
+			bucket = i
+			break
+		}
+	}
+	if bucket < len(stageBuckets) {
+		countMetric("stage."+stage+".bucket."+strconv.FormatInt(stageBuckets[bucket], 10), 1)
+	} else {
+		countMetric("stage."+stage+".bucket.inf", 1)
+	}
+
+	stageMutex.Lock()
+	defer stageMutex.Unlock()
+	st, exists := stages[stage]
+	if !exists {
+		st = &stageStats{buckets: make([]int64, len(stageBuckets)+1)}
+		stages[stage] = st
+	}
+	st.count++
+	if err != nil {
+		st.errors++
+	}
+	st.buckets[bucket]++
+
+	minute := time.Now().Unix() / 60
+	for _, t := range sloTrackers {
+		if t.Stage != stage {
+			continue
+		}
+		slot := &t.slots[minute%int64(len(t.slots))]
+		if slot.minute != minute {
+			*slot = sloSlot{minute: minute}
+		}
+		slot.total++
+		if err == nil && (t.Latency == 0 || ms <= int64(t.Latency)) {
+			slot.good++
+		}
+	}
+}
+
+// The burn rate over the last minutes of the window, and the operations
+// it was judged by. Must be called with stageMutex held.
+func (t *sloTracker) burn(minutes int64) (float64, int64, int64) {
+	now := time.Now().Unix() / 60
+	var good, total int64
+	for _, slot := range t.slots {
+		if slot.minute > now-minutes && slot.minute <= now {
+			good += slot.good
+			total += slot.total
+		}
+	}
+	if total == 0 {
+		return 0, 0, 0
+	}
+	bad := total - good
+	return float64(bad) / float64(total) / (1 - t.Target), total, bad
+}
+
+func (t *sloTracker) snapshot() *SloSnapshot {
+	minutes := int64(len(t.slots))
+	rate, events, _ := t.burn(minutes)
+	short, _, _ := t.burn(shortWindow(minutes))
+	return &SloSnapshot{SloConfig: t.SloConfig, BurnRate: rate, ShortBurn: short, Events: events, Firing: t.firing}
+}
+
+func shortWindow(minutes int64) int64 {
+	if minutes < 12 {
+		return 1
+	}
+	return minutes / 12
+}
+
+func checkSlos() {
+	var alerts []SloAlert
+
+	stageMutex.Lock()
+	for _, t := range sloTrackers {
+		minutes := int64(len(t.slots))
+		rate, events, bad := t.burn(minutes)
+		short, _, _ := t.burn(shortWindow(minutes))
+		gaugeMetric("slo."+t.Stage+".burn", int64(rate*100))
+
+		firing := t.firing
+		switch {
+		case !t.firing && events >= minSloEvents && rate >= t.Burn && short >= t.Burn:
+			firing = true
+		case t.firing && rate < t.Burn:
+			firing = false
+		}
+		if firing == t.firing {
+			continue
+		}
+		t.firing = firing
+
+		alert := SloAlert{
+			Stage:     t.Stage,
+			State:     "resolved",
+			Target:    t.Target,
+			Latency:   t.Latency,
+			Window:    t.Window,
+			Burn:      t.Burn,
+			BurnRate:  rate,
+			ShortBurn: short,
+			Events:    events,
+			Bad:       bad,
+			At:        time.Now().Unix(),
+		}
+		if firing {
+			alert.State = "firing"
+			log.Printf("SLO for the %s stage failed: burning its error budget %.1f times too fast, %d of %d operations bad", t.Stage, rate, bad, events)
+			countMetric("slo.alerts", 1)
+		} else {
+			log.Printf("SLO for the %s stage recovered, burn rate now %.1f", t.Stage, rate)
+		}
+		alerts = append(alerts, alert)
+	}
+	stageMutex.Unlock()
+
+	for _, alert := range alerts {
+		if config.Alerts.Url != "" {
+			postWebhook(config.Alerts.Url, alert, "alert for the "+alert.Stage+" stage")
+		}
+	}
+}
+
+func handleStages(w http.ResponseWriter, r *http.Request) {
+	stageMutex.Lock()
+	defer stageMutex.Unlock()
+
+	histograms := make(map[string]*StageHistogram)
+	for _, stage := range stageNames {
+		h := &StageHistogram{}
+		cumulative := int64(0)
+		st := stages[stage]
+		for i := 0; i <= len(stageBuckets); i++ {
+			if st != nil {
+				cumulative += st.buckets[i]
+			}
+			var le int64
+			if i < len(stageBuckets) {
+				le = stageBuckets[i]
+			}
+			h.Buckets = append(h.Buckets, StageBucket{Le: le, Count: cumulative})
+		}
+		if st != nil {
+			h.Count = st.count
+			h.Errors = st.errors
+		}
+		for _, t := range sloTrackers {
+			if t.Stage == stage {
+				h.Slos = append(h.Slos, t.snapshot())
+			}
+		}
+		histograms[stage] = h
+	}
+	writeJson(w, histograms)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Links in feeds are followed wherever they point, so without a check a
+// feed could have the fetcher request a cloud metadata service or an
+// internal host. Every request's host is resolved before it is sent and
+// refused if any of its addresses is loopback, private, link local or
+// otherwise not publicly routable. Connections are checked again when
+// dialled, so a name cannot resolve to a public address for the check and
+// a private one for the fetch. Hosts and networks listed in
+// Fetcher.Http.Allow are exempt, for feeds served from our own network.
+// Requests sent through a proxy leave resolving the host to the proxy,
+// which may be the only way out of the network, so only a literal address
+// is checked for them.
+var reservedNets = parseNets(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"64:ff9b:1::/48",
+	"2001:db8::/32",
+)
+
+var (
+	allowedNets  []*net.IPNet
+	allowedHosts []string
+)
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// A request refused because its host is not publicly routable
+type BlockedAddressError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e *BlockedAddressError) Error() string {
+	return fmt.Sprintf("refusing to fetch from %s, it resolves to non-public address %s", e.Host, e.IP)
+}
+
+// Read the allowlist, entries being CIDR networks or host names that also
+// cover their subdomains
+func initAllowlist() error {
+	for _, entry := range config.Fetcher.Http.Allow {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return fmt.Errorf("invalid network %s", entry)
+			}
+			allowedNets = append(allowedNets, n)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			allowedNets = append(allowedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			allowedHosts = append(allowedHosts, strings.TrimSuffix(entry, "."))
+		}
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func hostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, h := range allowedHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipAllowed(ip net.IP) bool {
+	for _, n := range allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuse a host any of whose addresses is not public, unless allowlisted
+func checkAddresses(host string, ips []net.IP) error {
+	if hostAllowed(host) {
+		return nil
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) && !ipAllowed(ip) {
+			countMetric("http.blocked", 1)
+			return &BlockedAddressError{Host: host, IP: ip}
+		}
+	}
+	return nil
+}
+
+// Proxies are ours, so connections to them are not checked
+func isProxyHost(host string) bool {
+	proxies := []*url.URL{defaultProxy}
+	for _, u := range feedProxies {
+		proxies = append(proxies, u)
+	}
+	for _, env := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		if u, err := url.Parse(os.Getenv(env)); err == nil {
+			proxies = append(proxies, u)
+		}
+	}
+
+	for _, u := range proxies {
+		if u != nil && u.Hostname() != "" && strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// SafeTransport refuses requests for anything but http and https urls on
+// public hosts
+type SafeTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t *SafeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("refusing to fetch %s url", req.URL.Scheme)
+	}
+
+	host := req.URL.Hostname()
+	if proxy, err := requestProxy(req); err == nil && proxy != nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if err := checkAddresses(host, []net.IP{ip}); err != nil {
+				return nil, err
+			}
+		}
+		return t.Transport.RoundTrip(req)
+	}
+
+	ips, err := lookupHost(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAddresses(host, ips); err != nil {
+		return nil, err
+	}
+	return t.Transport.RoundTrip(req)
+}
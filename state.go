@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/placetime/datastore"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FetchRecord is the scheduling state kept for each feed driven profile. It
+// is persisted so that a restarted fetcher resumes the existing schedule
+// rather than fetching every feed at once. Changes to the outcome of
+// fetches are written straight away; claims and the recent images and
+// titles, which only cost a repeated fetch or a missed duplicate if lost,
+// are flushed every minute and when the fetcher stops.
+type FetchRecord struct {
+	Url          string `json:"url"`
+	Count        int32  `json:"count"`
+	Interval     int64  `json:"interval"`
+	LastFetched  int64  `json:"fetched"`
+	LastChanged  int64  `json:"changed"`
+	NextDue      int64  `json:"due"`
+	Failures     int    `json:"failures,omitempty"`
+	NotFound     int    `json:"notfound,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastmodified,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+
+	// The url held by the profile when its feed has permanently moved to
+	// Url. The datastore offers no way to update a profile, so the move is
+	// recorded here and applies for as long as the profile keeps that url.
+	MovedFrom string `json:"movedfrom,omitempty"`
+
+	// Content hashes of the profile's most recently picked images
+	RecentImages []string `json:"images,omitempty"`
+
+	// When each recently ingested title was first seen, by title key
+	RecentTitles map[string]int64 `json:"titles,omitempty"`
+}
+
+type FeedStateStore struct {
+	mu       sync.Mutex
+	filename string
+	records  map[datastore.PidType]*FetchRecord
+	dirty    bool
+}
+
+var feedStates = &FeedStateStore{records: make(map[datastore.PidType]*FetchRecord)}
+
+func loadFeedStates() {
+	feedStates.filename = config.Fetcher.State
+	if err := feedStates.Load(); err != nil {
+		log.Printf("Could not read fetcher state %s: %s", feedStates.filename, err.Error())
+		os.Exit(1)
+	}
+}
+
+func (fs *FeedStateStore) Load() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, err := ioutil.ReadFile(fs.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &fs.records)
+}
+
+// Must be called with the lock held
+func (fs *FeedStateStore) save() {
+	if fs.filename == "" {
+		return
+	}
+
+	data, err := json.Marshal(fs.records)
+	if err == nil {
+		if err = ioutil.WriteFile(fs.filename+".tmp", data, 0644); err == nil {
+			err = os.Rename(fs.filename+".tmp", fs.filename)
+		}
+	}
+	if err != nil {
+		// Tried again with the next flush
+		log.Printf("Could not write fetcher state %s: %s", fs.filename, err.Error())
+		fs.dirty = true
+		return
+	}
+	fs.dirty = false
+}
+
+func (fs *FeedStateStore) Flush() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.dirty {
+		fs.save()
+	}
+}
+
+// Flush the state periodically until the fetcher stops
+func flushFeedStates(ctx context.Context) {
+	ticker := time.NewTicker(historyFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			feedStates.Flush()
+		}
+	}
+}
+
+// Must be called with the lock held
+func (fs *FeedStateStore) record(pid datastore.PidType) *FetchRecord {
+	rec, exists := fs.records[pid]
+	if !exists {
+		rec = &FetchRecord{}
+		fs.records[pid] = rec
+	}
+	return rec
+}
+
+// Get a copy of the state for a feed
+func (fs *FeedStateStore) Get(pid datastore.PidType) FetchRecord {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return *fs.record(pid)
+}
+
+// The url a profile's feed should be fetched from, which differs from the
+// one it holds when the feed has permanently moved
+func (fs *FeedStateStore) FeedUrl(pid datastore.PidType, url string) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if rec, exists := fs.records[pid]; exists && rec.MovedFrom != "" && rec.MovedFrom == url {
+		return rec.Url
+	}
+	return url
+}
+
+// Record that a profile's feed has permanently moved to a new url
+func (fs *FeedStateStore) Moved(pid datastore.PidType, url string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec := fs.record(pid)
+	if rec.MovedFrom == "" {
+		rec.MovedFrom = rec.Url
+	}
+	rec.Url = url
+	if rec.Url == rec.MovedFrom {
+		rec.MovedFrom = ""
+	}
+	fs.save()
+}
+
+// Report whether a feed is due and if so reserve it for fetching until the
+// next interval so it is not queued twice
+func (fs *FeedStateStore) Claim(pid datastore.PidType, url string, force bool) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec := fs.record(pid)
+	now := time.Now().Unix()
+
+	// A changed url is a different feed as far as scheduling is concerned
+	if rec.Url != url {
+		rec.Url = url
+		rec.MovedFrom = ""
+		rec.NextDue = 0
+		rec.Failures = 0
+		rec.ETag = ""
+		rec.LastModified = ""
+		rec.Fingerprint = ""
+	}
+
+	if !force && rec.NextDue > now {
+		return false
+	}
+
+	rec.Interval = int64(config.Fetcher.Feed.Interval)
+	rec.NextDue = now + rec.Interval
+	fs.dirty = true
+	return true
+}
+
+func (fs *FeedStateStore) Succeeded(pid datastore.PidType, etag string, lastModified string, fingerprint string, changed bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec := fs.record(pid)
+	now := time.Now().Unix()
+
+	rec.Count++
+	rec.LastFetched = now
+	if changed {
+		rec.LastChanged = now
+	}
+	rec.Failures = 0
+	rec.NotFound = 0
+	rec.NextDue = now + rec.Interval
+	rec.ETag = etag
+	rec.LastModified = lastModified
+	rec.Fingerprint = fingerprint
+	fs.save()
+}
+
+// Clear any failures so the feed is fetched at the next check
+func (fs *FeedStateStore) Reset(pid datastore.PidType) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec := fs.record(pid)
+	rec.Failures = 0
+	rec.NotFound = 0
+	rec.NextDue = 0
+	fs.save()
+}
+
+// The feeds with at least failures consecutive failed fetches
+func (fs *FeedStateStore) Failing(failures int) []datastore.PidType {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var pids []datastore.PidType
+	for pid, rec := range fs.records {
+		if rec.Failures >= failures {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Push the next fetch of a feed back to no earlier than until, as a server
+// asking us to come back later wants
+func (fs *FeedStateStore) NotBefore(pid datastore.PidType, until time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec := fs.record(pid)
+	if until.Unix() > rec.NextDue {
+		rec.NextDue = until.Unix()
+		fs.save()
+	}
+}
+
+// Record a failed fetch and push the next fetch back exponentially,
+// returning the number of consecutive failures and of those how many in a
+// row were a 404
+func (fs *FeedStateStore) Failed(pid datastore.PidType, notFound bool) (int, int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec := fs.record(pid)
+	rec.Count++
+	rec.LastFetched = time.Now().Unix()
+	rec.Failures++
+	if notFound {
+		rec.NotFound++
+	} else {
+		rec.NotFound = 0
+	}
+	rec.NextDue = rec.LastFetched + backoffInterval(rec.Interval, rec.Failures)
+	fs.save()
+	return rec.Failures, rec.NotFound
+}
+
+// Record an image picked for one of the profile's items, reporting whether
+// the same image was used by one of its recent items
+func (fs *FeedStateStore) SeenImage(pid datastore.PidType, hash string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec := fs.record(pid)
+	for _, h := range rec.RecentImages {
+		if h == hash {
+			return true
+		}
+	}
+
+	rec.RecentImages = append(rec.RecentImages, hash)
+	if len(rec.RecentImages) > recentImageWindow {
+		rec.RecentImages = rec.RecentImages[len(rec.RecentImages)-recentImageWindow:]
+	}
+	fs.dirty = true
+	return false
+}
+
+// Record the title of a new item, reporting whether the profile had an item
+// with the same title within the last window seconds
+func (fs *FeedStateStore) SeenTitle(pid datastore.PidType, key string, window int) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec := fs.record(pid)
+	now := time.Now().Unix()
+	for k, seen := range rec.RecentTitles {
+		if seen <= now-int64(window) {
+			delete(rec.RecentTitles, k)
+		}
+	}
+	if _, exists := rec.RecentTitles[key]; exists {
+		return true
+	}
+
+	if rec.RecentTitles == nil {
+		rec.RecentTitles = make(map[string]int64)
+	}
+	rec.RecentTitles[key] = now
+	fs.dirty = true
+	return false
+}
+
+func backoffInterval(interval int64, failures int) int64 {
+	max := int64(config.Fetcher.Feed.MaxBackoff)
+	for i := 0; i < failures && interval < max; i++ {
+		interval *= 2
+	}
+	if interval > max {
+		interval = max
+	}
+	return interval
+}
+
+type dueProfile struct {
+	profile *datastore.Profile
+	due     int64
+}
+
+type byDue []dueProfile
+
+func (b byDue) Len() int           { return len(b) }
+func (b byDue) Less(i, j int) bool { return b[i].due < b[j].due }
+func (b byDue) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Select the profiles whose feeds are due, most overdue first. When more are
+// due than the catch up limit allows, only the most overdue are returned and
+// the rest wait for a later check.
+func dueProfiles(profiles []*datastore.Profile) []*datastore.Profile {
+	now := time.Now().Unix()
+
+	due := make([]dueProfile, 0, len(profiles))
+	for _, p := range profiles {
+		rec := feedStates.Get(p.Pid)
+		if rec.Url == feedStates.FeedUrl(p.Pid, p.FeedUrl) && rec.NextDue > now {
+			continue
+		}
+		due = append(due, dueProfile{profile: p, due: rec.NextDue})
+	}
+	sort.Sort(byDue(due))
+	recordFeedsDue(len(due))
+
+	limit := config.Fetcher.Feed.CatchUp
+	if limit > 0 && len(due) > limit {
+		log.Printf("Catching up: %d feeds are due, fetching the %d most overdue", len(due), limit)
+		due = due[:limit]
+	}
+
+	selected := make([]*datastore.Profile, 0, len(due))
+	for _, d := range due {
+		selected = append(selected, d.profile)
+	}
+	return selected
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// StatsdSink sends metrics to a statsd or Datadog agent over UDP. Tags are
+// appended in the DogStatsD format, which plain statsd servers ignore.
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+	tags   string
+}
+
+func NewStatsdSink(addr string, prefix string, tags []string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &StatsdSink{conn: conn, prefix: prefix}
+	if len(tags) > 0 {
+		sink.tags = "|#" + strings.Join(tags, ",")
+	}
+	return sink, nil
+}
+
+func (s *StatsdSink) Count(name string, value int64) {
+	s.send(fmt.Sprintf("%s%s:%d|c%s", s.prefix, name, value, s.tags))
+}
+
+func (s *StatsdSink) Gauge(name string, value int64) {
+	s.send(fmt.Sprintf("%s%s:%d|g%s", s.prefix, name, value, s.tags))
+}
+
+func (s *StatsdSink) Timing(name string, d time.Duration) {
+	s.send(fmt.Sprintf("%s%s:%d|ms%s", s.prefix, name, d.Nanoseconds()/int64(time.Millisecond), s.tags))
+}
+
+func (s *StatsdSink) send(line string) {
+	// Metrics are best effort, a lost packet is not worth more than a log line
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		log.Printf("Statsd failed to send metric: %s", err.Error())
+	}
+}
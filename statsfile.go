@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// StatsFileSink keeps a rolling history of metrics in a small JSON file,
+// one entry per period, for deployments with no metrics stack. The file
+// holds at most a fixed number of periods, oldest first.
+type StatsFileSink struct {
+	mu       sync.Mutex
+	filename string
+	keep     int
+	current  *StatsPeriod
+	history  []*StatsPeriod
+}
+
+type StatsPeriod struct {
+	Start    int64                  `json:"start"`
+	End      int64                  `json:"end,omitempty"`
+	Counters map[string]int64       `json:"counters"`
+	Gauges   map[string]int64       `json:"gauges,omitempty"`
+	Timers   map[string]*StatsTimer `json:"timers"`
+}
+
+// Durations are in milliseconds
+type StatsTimer struct {
+	Count int64 `json:"count"`
+	Total int64 `json:"total"`
+	Max   int64 `json:"max"`
+}
+
+func newStatsPeriod() *StatsPeriod {
+	return &StatsPeriod{
+		Start:    time.Now().Unix(),
+		Counters: make(map[string]int64),
+		Gauges:   make(map[string]int64),
+		Timers:   make(map[string]*StatsTimer),
+	}
+}
+
+// Create the sink, continuing any history already in the file, and start
+// writing a period every interval
+func NewStatsFileSink(filename string, interval time.Duration, keep int) *StatsFileSink {
+	sink := &StatsFileSink{filename: filename, keep: keep, current: newStatsPeriod()}
+
+	if data, err := ioutil.ReadFile(filename); err == nil {
+		if err := json.Unmarshal(data, &sink.history); err != nil {
+			log.Printf("Could not read stats file %s, starting a new one: %s", filename, err.Error())
+			sink.history = nil
+		}
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			sink.flush()
+		}
+	}()
+	return sink
+}
+
+func (s *StatsFileSink) Count(name string, value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.Counters[name] += value
+}
+
+// A period keeps the last value of each gauge
+func (s *StatsFileSink) Gauge(name string, value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.Gauges[name] = value
+}
+
+func (s *StatsFileSink) Timing(name string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, exists := s.current.Timers[name]
+	if !exists {
+		t = &StatsTimer{}
+		s.current.Timers[name] = t
+	}
+	ms := d.Nanoseconds() / int64(time.Millisecond)
+	t.Count++
+	t.Total += ms
+	if ms > t.Max {
+		t.Max = ms
+	}
+}
+
+func (s *StatsFileSink) flush() {
+	s.mu.Lock()
+	period := s.current
+	period.End = time.Now().Unix()
+	s.current = newStatsPeriod()
+
+	s.history = append(s.history, period)
+	if len(s.history) > s.keep {
+		s.history = s.history[len(s.history)-s.keep:]
+	}
+	data, err := json.Marshal(s.history)
+	s.mu.Unlock()
+
+	if err == nil {
+		if err = ioutil.WriteFile(s.filename+".tmp", data, 0644); err == nil {
+			err = os.Rename(s.filename+".tmp", s.filename)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not write stats file %s: %s", s.filename, err.Error())
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The most read in one go from a throttled body, so one reader cannot take
+// a large share of the bucket at once
+const throttleChunk = 16 * 1024
+
+// A TokenBucket shares a bandwidth allowance between every reader drawing
+// on it. Tokens are bytes and accrue at rate per second up to a second's
+// worth. Readers may overdraw the bucket and then wait for it to refill,
+// so a read never waits for more than the bytes it has just taken. Bytes
+// taken from a bucket with a parent are taken from the parent as well.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	parent *TokenBucket
+}
+
+// A nil bucket places no limit on reads. With no limit of its own the
+// bucket is just its parent, which may also be nil.
+func NewTokenBucket(bytesPerSecond int, parent *TokenBucket) *TokenBucket {
+	if bytesPerSecond <= 0 {
+		return parent
+	}
+	return &TokenBucket{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now(), parent: parent}
+}
+
+func (tb *TokenBucket) Take(n int) {
+	if tb == nil || n <= 0 {
+		return
+	}
+	defer tb.parent.Take(n)
+
+	tb.mu.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	wait := time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	tb.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type throttledReader struct {
+	r      io.Reader
+	bucket *TokenBucket
+}
+
+func (tr throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := tr.r.Read(p)
+	tr.bucket.Take(n)
+	return n, err
+}
+
+type throttledBody struct {
+	throttledReader
+	io.Closer
+}
+
+// ThrottleTransport draws the bodies of its responses from a bucket
+type ThrottleTransport struct {
+	Transport http.RoundTripper
+	Bucket    *TokenBucket
+}
+
+func (t *ThrottleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil || t.Bucket == nil {
+		return resp, err
+	}
+	resp.Body = throttledBody{throttledReader{resp.Body, t.Bucket}, resp.Body}
+	return resp, nil
+}
+
+// Every download draws on totalBandwidth. Feed downloads also draw on
+// feedBandwidth and those made for the image pipeline on imageBandwidth.
+var (
+	totalBandwidth *TokenBucket
+	feedBandwidth  *TokenBucket
+	imageBandwidth *TokenBucket
+)
+
+func initBandwidth() {
+	totalBandwidth = NewTokenBucket(config.Fetcher.Http.Bandwidth*1024, nil)
+	feedBandwidth = NewTokenBucket(config.Fetcher.Feed.Bandwidth*1024, totalBandwidth)
+	imageBandwidth = NewTokenBucket(config.Fetcher.Image.Bandwidth*1024, totalBandwidth)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLS settings for fetching. CaFile is a PEM bundle of certificate
+// authorities trusted on top of the system ones, for feeds served with a
+// private CA. CertFile and KeyFile are a client certificate offered to
+// servers that ask for one.
+type TlsConfig struct {
+	CaFile   string `toml:"cafile"`
+	CertFile string `toml:"certfile"`
+	KeyFile  string `toml:"keyfile"`
+}
+
+func fetchTlsConfig(tc TlsConfig) (*tls.Config, error) {
+	cfg := &tls.Config{}
+
+	if tc.CaFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(tc.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", tc.CaFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return nil, fmt.Errorf("a client certificate needs both a cert file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/placetime/datastore"
+)
+
+// Trust tiers decide how much work the fetcher is prepared to do for a
+// feed. Each feed is assigned a tier with the trust setting in its feed
+// config and feeds without one are in the default tier.
+const (
+	trustTrusted   = "trusted"
+	trustDefault   = "default"
+	trustUntrusted = "untrusted"
+)
+
+// The policy for a trust tier. Scrape allows visiting item pages to check
+// links and pick images. Annotate allows items to be sent to the external
+// annotation service. MaxItems caps the items ingested from a single fetch,
+// zero meaning no limit.
+//
+// A tier given in the configuration file replaces the built in policy for
+// that tier entirely.
+type TrustPolicy struct {
+	Scrape   bool `toml:"scrape"`
+	Annotate bool `toml:"annotate"`
+	MaxItems int  `toml:"maxitems"`
+}
+
+var DefaultTrustPolicies = map[string]TrustPolicy{
+	trustTrusted: {
+		Scrape:   true,
+		Annotate: true,
+	},
+	trustDefault: {
+		Scrape:   true,
+		Annotate: true,
+		MaxItems: 200,
+	},
+	trustUntrusted: {
+		Scrape:   false,
+		Annotate: false,
+		MaxItems: 20,
+	},
+}
+
+func validTrustTier(tier string) bool {
+	_, exists := config.Trust[tier]
+	return tier == "" || exists
+}
+
+func trustPolicy(pid datastore.PidType) TrustPolicy {
+	tier := config.Feeds[string(pid)].Trust
+	if tier == "" {
+		tier = trustDefault
+	}
+	return config.Trust[tier]
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A page whose main media is a video has the video's poster frame picked
+// as its image, cropped like any other, and the video's length recorded
+// with the item. The video is found in the start of the page's markup from
+// its Open Graph video tags, a VideoObject in its JSON-LD or its first
+// video element. When the page gives no length for an HLS stream the
+// length is added up from the stream's manifest.
+type PageVideo struct {
+	Url      string `json:"url,omitempty"`
+	Poster   string `json:"poster,omitempty"`
+	Duration int    `json:"duration,omitempty"` // seconds
+}
+
+var (
+	videoTagPattern  = regexp.MustCompile(`(?is)<video\s[^>]*>`)
+	sourceTagPattern = regexp.MustCompile(`(?is)<source\s[^>]*>`)
+	jsonLdPattern    = regexp.MustCompile(`(?is)<script[^>]*type\s*=\s*["']application/ld\+json["'][^>]*>(.*?)</script>`)
+	autoplayAttr     = regexp.MustCompile(`(?i)\sautoplay\b`)
+	loopAttr         = regexp.MustCompile(`(?i)\sloop\b`)
+	isoDuration      = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+)
+
+// The most of an HLS manifest read when adding up a stream's length
+const maxManifestBytes = 1024 * 1024
+
+// The video that is the main media of a checked page, nil when it has none
+func linkVideo(ctx context.Context, ls *LinkStatus) *PageVideo {
+	if ls == nil || len(ls.Peek) == 0 {
+		return nil
+	}
+	video := pageVideo(ls.Peek, ls.FinalUrl)
+	if video == nil {
+		return nil
+	}
+
+	if video.Duration == 0 && isHlsUrl(video.Url) {
+		duration, err := hlsDuration(ctx, video.Url)
+		if err != nil {
+			log.Printf("Image job failed to read video manifest %s: %s", video.Url, err.Error())
+			countMetric("video.errors", 1)
+		}
+		video.Duration = duration
+	}
+	countMetric("video.found", 1)
+	return video
+}
+
+func pageVideo(page []byte, base string) *PageVideo {
+	video := &PageVideo{}
+	var ogImage string
+	isVideo := false
+	for _, tag := range metaTagPattern.FindAll(page, -1) {
+		attrs := tagAttrs(tag)
+		content := attrs["content"]
+		switch strings.ToLower(firstNonEmpty(attrs["property"], attrs["name"])) {
+		case "og:type":
+			isVideo = isVideo || strings.HasPrefix(strings.ToLower(content), "video")
+		case "og:video", "og:video:url", "og:video:secure_url":
+			if video.Url == "" {
+				video.Url = resolveHref(content, base)
+			}
+		case "og:image":
+			if ogImage == "" {
+				ogImage = resolveHref(content, base)
+			}
+		case "video:duration":
+			if video.Duration == 0 {
+				video.Duration, _ = strconv.Atoi(strings.TrimSpace(content))
+			}
+		}
+	}
+	isVideo = isVideo || video.Url != ""
+
+	for _, m := range jsonLdPattern.FindAllSubmatch(page, -1) {
+		var doc interface{}
+		if err := json.Unmarshal(m[1], &doc); err != nil {
+			continue
+		}
+		if obj := findVideoObject(doc); obj != nil {
+			isVideo = true
+			video.Url = firstNonEmpty(video.Url, resolveHref(jsonLdString(obj["contentUrl"]), base), resolveHref(jsonLdString(obj["embedUrl"]), base))
+			video.Poster = firstNonEmpty(video.Poster, resolveHref(jsonLdString(obj["thumbnailUrl"]), base))
+			if video.Duration == 0 {
+				video.Duration = parseIsoDuration(jsonLdString(obj["duration"]))
+			}
+			break
+		}
+	}
+
+	if tag := videoTagPattern.Find(page); tag != nil && !isBackgroundVideo(tag) {
+		isVideo = true
+		attrs := tagAttrs(tag)
+		video.Poster = firstNonEmpty(video.Poster, resolveHref(attrs["poster"], base))
+		src := attrs["src"]
+		if src == "" {
+			// The sources of the element follow its opening tag
+			rest := page[bytes.Index(page, tag)+len(tag):]
+			if source := sourceTagPattern.Find(rest); source != nil {
+				src = tagAttrs(source)["src"]
+			}
+		}
+		video.Url = firstNonEmpty(video.Url, resolveHref(src, base))
+	}
+
+	if !isVideo {
+		return nil
+	}
+	// A video page's Open Graph image is the poster when nothing better
+	// is given
+	video.Poster = firstNonEmpty(video.Poster, ogImage)
+	return video
+}
+
+// Whether a video element loops silently behind the page, as decoration
+// rather than the page's media
+func isBackgroundVideo(tag []byte) bool {
+	return autoplayAttr.Match(tag) && loopAttr.Match(tag)
+}
+
+// The first VideoObject in a JSON-LD document, looking inside graphs and
+// lists
+func findVideoObject(doc interface{}) map[string]interface{} {
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, e := range v {
+			if obj := findVideoObject(e); obj != nil {
+				return obj
+			}
+		}
+	case map[string]interface{}:
+		if jsonLdString(v["@type"]) == "VideoObject" {
+			return v
+		}
+		for _, key := range []string{"@graph", "video", "mainEntity"} {
+			if obj := findVideoObject(v[key]); obj != nil {
+				return obj
+			}
+		}
+	}
+	return nil
+}
+
+// A JSON-LD value as a string, taking the first of a list and the url of
+// an object
+func jsonLdString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []interface{}:
+		if len(s) > 0 {
+			return jsonLdString(s[0])
+		}
+	case map[string]interface{}:
+		return jsonLdString(s["url"])
+	}
+	return ""
+}
+
+// Seconds in an ISO 8601 duration such as PT1H2M3S, zero when it cannot be
+// read
+func parseIsoDuration(s string) int {
+	m := isoDuration.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return 0
+	}
+	var seconds float64
+	for i, unit := range []float64{24 * 60 * 60, 60 * 60, 60, 1} {
+		if m[i+1] != "" {
+			n, _ := strconv.ParseFloat(m[i+1], 64)
+			seconds += n * unit
+		}
+	}
+	return int(math.Round(seconds))
+}
+
+func isHlsUrl(url string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.SplitN(url, "?", 2)[0]), ".m3u8")
+}
+
+// The length of an HLS stream, following a master playlist to its first
+// variant. A live stream, which has no end, has no length.
+func hlsDuration(ctx context.Context, url string) (int, error) {
+	for hops := 0; hops < 2; hops++ {
+		data, err := fetchManifest(ctx, url)
+		if err != nil {
+			return 0, err
+		}
+
+		var seconds float64
+		ended := false
+		variant := ""
+		lines := bufio.NewScanner(bytes.NewReader(data))
+		for lines.Scan() {
+			line := strings.TrimSpace(lines.Text())
+			switch {
+			case strings.HasPrefix(line, "#EXTINF:"):
+				n, _ := strconv.ParseFloat(strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0], 64)
+				seconds += n
+			case line == "#EXT-X-ENDLIST":
+				ended = true
+			case strings.HasPrefix(line, "#EXT-X-STREAM-INF") && variant == "":
+				variant = "next"
+			case variant == "next" && line != "" && !strings.HasPrefix(line, "#"):
+				variant = resolveHref(line, url)
+			}
+		}
+
+		if variant != "" && variant != "next" {
+			url = variant
+			continue
+		}
+		if !ended {
+			return 0, nil
+		}
+		return int(math.Round(seconds)), nil
+	}
+	return 0, fmt.Errorf("too many nested playlists at %s", url)
+}
+
+func fetchManifest(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	budget.AddRequest()
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("manifest fetch returned %s", resp.Status)
+	}
+	return readLimited(throttledReader{countingReader{resp.Body}, imageBandwidth}, maxManifestBytes)
+}
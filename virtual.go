@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/placetime/datastore"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// A virtual profile collects items from every feed that match a query rather
+// than fetching a feed of its own, e.g.
+//
+//	[virtual."london-events"]
+//	tags = ["events"]
+//	keywords = ["london"]
+//	bbox = [-0.51, 51.28, 0.33, 51.69]
+//
+// An item must satisfy every criterion that is given; within tags or
+// keywords any single match is enough. The profile itself must already
+// exist in the datastore.
+type VirtualProfileConfig struct {
+	Tags     []string  `toml:"tags"`
+	Keywords []string  `toml:"keywords"`
+	Bbox     []float64 `toml:"bbox"`
+}
+
+func (vp VirtualProfileConfig) Matches(meta *ItemMeta) bool {
+	if len(vp.Tags) > 0 {
+		found := false
+		for _, tag := range vp.Tags {
+			if hasTag(meta.Tags, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(vp.Keywords) > 0 {
+		title := strings.ToLower(meta.Title)
+		found := false
+		for _, kw := range vp.Keywords {
+			if strings.Contains(title, strings.ToLower(kw)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(vp.Bbox) == 4 {
+		if !inBbox(meta.Location, vp.Bbox) {
+			return false
+		}
+	}
+
+	return len(vp.Tags) > 0 || len(vp.Keywords) > 0 || len(vp.Bbox) == 4
+}
+
+// Report whether a point lies within a minlon,minlat,maxlon,maxlat box
+func inBbox(p *GeoPoint, bbox []float64) bool {
+	if p == nil {
+		return false
+	}
+	return p.Lon >= bbox[0] && p.Lat >= bbox[1] && p.Lon <= bbox[2] && p.Lat <= bbox[3]
+}
+
+// The id of the copy of an item in a virtual profile
+func virtualItemId(name string, id datastore.ItemIdType) datastore.ItemIdType {
+	hasher := md5.New()
+	io.WriteString(hasher, name+"\n"+string(id))
+	return datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+// Copy a newly ingested item into every virtual profile whose query it
+// matches. Each copy gets its own id so it can be timelined and have its
+// image picked independently of the original. Copies are placed on the
+// timeline at event, the time the source feed's event setting chose for
+// the original.
+func routeToVirtualProfiles(s *datastore.RedisStore, meta *ItemMeta, itemType string, event time.Time) {
+	for name, vp := range config.Virtual {
+		vpid := datastore.PidType(name)
+		if vpid == meta.Pid || !vp.Matches(meta) {
+			continue
+		}
+
+		vid := virtualItemId(name, meta.Id)
+
+		if _, err := s.AddItem(vpid, event, meta.Title, meta.Link, meta.Image, vid, itemType, 0); err != nil {
+			log.Printf("Failed to add item %s to virtual profile %s: %s", meta.Id, vpid, err.Error())
+			continue
+		}
+
+		err := updateItemMeta(vid, func(vmeta *ItemMeta) {
+			*vmeta = *meta
+			vmeta.Id = vid
+			vmeta.Pid = vpid
+			vmeta.Via = meta.Pid
+		})
+		if err != nil {
+			log.Printf("Failed to write metadata for virtual item %s: %s", vid, err.Error())
+		}
+		countMetric("virtual.items", 1)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// When an item's page has gone, its image can still be picked from a copy
+// archived by the Wayback Machine. The snapshot closest to the time the
+// item was published is used.
+type WaybackConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Api     string `toml:"api"`
+}
+
+type waybackAvailability struct {
+	ArchivedSnapshots struct {
+		Closest *struct {
+			Available bool   `json:"available"`
+			Url       string `json:"url"`
+			Status    string `json:"status"`
+		} `json:"closest"`
+	} `json:"archived_snapshots"`
+}
+
+// A link is worth looking up in the archive only if the page is missing
+func (ls *LinkStatus) IsGone() bool {
+	return ls.Status == 404 || ls.Status == 410
+}
+
+// Find an archived copy of a page, returning an empty url if there is none
+func waybackSnapshot(link string, near time.Time) (string, error) {
+	q := url.Values{}
+	q.Set("url", link)
+	if !near.IsZero() {
+		q.Set("timestamp", near.UTC().Format("20060102150405"))
+	}
+
+	budget.AddRequest()
+	resp, err := fetchClient.Get(config.Wayback.Api + "?" + q.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("wayback availability returned %s", resp.Status)
+	}
+
+	var wa waybackAvailability
+	if err := json.NewDecoder(io.LimitReader(countingReader{resp.Body}, 1<<20)).Decode(&wa); err != nil {
+		return "", err
+	}
+
+	closest := wa.ArchivedSnapshots.Closest
+	if closest == nil || !closest.Available || closest.Status != "200" {
+		return "", nil
+	}
+	return closest.Url, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/placetime/datastore"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Payload sent for each new item when the webhook format is "full"
+type WebhookItem struct {
+	Pid   datastore.PidType    `json:"pid"`
+	Id    datastore.ItemIdType `json:"id"`
+	Title string               `json:"title"`
+	Link  string               `json:"link"`
+	Image string               `json:"image,omitempty"`
+	Added int64                `json:"added"`
+
+	// The url of the license the item is published under, when known
+	License string `json:"license,omitempty"`
+}
+
+// Payload sent for each new item when the webhook format is "simple". This
+// is the flat shape expected by automation services such as IFTTT and Zapier.
+type SimpleWebhookItem struct {
+	Title     string `json:"title"`
+	Url       string `json:"url"`
+	ImageUrl  string `json:"image_url"`
+	CreatedAt string `json:"created_at"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func notifyWebhook(item WebhookItem) {
+	if config.Webhook.Url == "" {
+		return
+	}
+
+	var payload interface{}
+	switch config.Webhook.Format {
+	case "simple":
+		payload = SimpleWebhookItem{
+			Title:     item.Title,
+			Url:       item.Link,
+			ImageUrl:  item.Image,
+			CreatedAt: time.Unix(item.Added, 0).UTC().Format(time.RFC3339),
+		}
+	default:
+		payload = item
+	}
+
+	postWebhook(config.Webhook.Url, payload, "item "+string(item.Id))
+}
+
+func notifyWebhookBatch(batch WebhookBatch) {
+	if config.Webhook.Url == "" {
+		return
+	}
+
+	var payload interface{}
+	switch config.Webhook.Format {
+	case "simple":
+		// The simple shape has room for one link, the top item of the feed
+		top := batch.Items[0]
+		payload = SimpleWebhookItem{
+			Title:     batchTitle(batch.Count),
+			Url:       top.Link,
+			ImageUrl:  top.Image,
+			CreatedAt: time.Unix(batch.Added, 0).UTC().Format(time.RFC3339),
+		}
+	default:
+		payload = batch
+	}
+
+	postWebhook(config.Webhook.Url, payload, fmt.Sprintf("batch of %d items", batch.Count))
+}
+
+func postWebhook(url string, payload interface{}, desc string) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Webhook failed to encode %s: %s", desc, err.Error())
+		return
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Webhook failed to post %s: %s", desc, err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("Webhook rejected %s: %s", desc, resp.Status)
+	}
+}
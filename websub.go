@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/placetime/datastore"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Each profile's items are re-syndicated as an Atom feed by the query API.
+// When a hub is configured the feed advertises it and the hub is pinged
+// whenever new items are ingested, so subscribers receive pushed updates.
+
+const atomFeedLimit = 50
+
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type AtomEntry struct {
+	Id      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []AtomLink `xml:"link"`
+}
+
+var webSubClient = &http.Client{Timeout: 10 * time.Second}
+
+func atomFeedUrl(pid datastore.PidType) string {
+	return apiUrl("/feeds/" + url.PathEscape(string(pid)) + ".atom")
+}
+
+func handleAtomFeed(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/feeds/")
+	if !strings.HasSuffix(name, ".atom") {
+		http.NotFound(w, r)
+		return
+	}
+	pid := datastore.PidType(strings.TrimSuffix(name, ".atom"))
+
+	items, err := readItemMetas(itemIndex.Query(&ItemQuery{Pid: pid}, 0, atomFeedLimit))
+	if err != nil {
+		log.Printf("Atom feed failed to read item metadata: %s", err.Error())
+		http.Error(w, "could not read items", http.StatusInternalServerError)
+		return
+	}
+	if len(items) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	feed := AtomFeed{
+		Id:      atomFeedUrl(pid),
+		Title:   string(pid),
+		Updated: atomTime(items[0].Added),
+		Links:   []AtomLink{{Rel: "self", Type: "application/atom+xml", Href: atomFeedUrl(pid)}},
+	}
+	if config.WebSub.Hub != "" {
+		feed.Links = append(feed.Links, AtomLink{Rel: "hub", Href: config.WebSub.Hub})
+	}
+
+	for _, meta := range items {
+		entry := AtomEntry{
+			Id:      "urn:placetime:item:" + string(meta.Id),
+			Title:   meta.Title,
+			Updated: atomTime(meta.Added),
+			Links:   []AtomLink{{Rel: "alternate", Href: meta.Link}},
+		}
+		if meta.Image != "" {
+			entry.Links = append(entry.Links, AtomLink{Rel: "enclosure", Href: meta.Image})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	// Let the hub and subscribers know where to subscribe
+	w.Header().Add("Link", "<"+atomFeedUrl(pid)+`>; rel="self"`)
+	if config.WebSub.Hub != "" {
+		w.Header().Add("Link", "<"+config.WebSub.Hub+`>; rel="hub"`)
+	}
+	w.Header().Set("Content-Type", "application/atom+xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		log.Printf("Atom feed failed to write response: %s", err.Error())
+	}
+}
+
+func atomTime(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// Tell the hub that a profile's feed has new content
+func pingHub(pid datastore.PidType) {
+	if config.WebSub.Hub == "" {
+		return
+	}
+
+	form := url.Values{"hub.mode": {"publish"}, "hub.url": {atomFeedUrl(pid)}}
+	resp, err := webSubClient.PostForm(config.WebSub.Hub, form)
+	if err != nil {
+		log.Printf("WebSub failed to ping hub for %s: %s", pid, err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("WebSub hub rejected ping for %s: %s", pid, resp.Status)
+	}
+}